@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/eip/miio2mqtt/miio/sim"
+	log "github.com/go-pkgz/lgr"
+)
+
+func main() {
+	configPath := flag.String("config", "./sim.yml", "simulator configuration file")
+	address := flag.String("address", "", "UDP address to listen on, overrides the configuration")
+	debug := flag.Bool("debug", false, "log every packet")
+	flag.Parse()
+	setupLog(*debug)
+	cfg, err := sim.LoadConfig(*configPath)
+	if err != nil {
+		log.Printf("[ERROR] configuration: %v", err)
+		os.Exit(1)
+	}
+	if len(*address) > 0 {
+		cfg.Address = *address
+	}
+	simulator, err := sim.New(cfg)
+	if err != nil {
+		log.Printf("[ERROR] %v", err)
+		os.Exit(1)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := sync.WaitGroup{}
+	if err := simulator.Start(ctx, &wg); err != nil {
+		log.Printf("[ERROR] %v", err)
+		os.Exit(1)
+	}
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	s := <-sigChan
+	fmt.Print("\r")
+	log.Printf("[WARN] %v signal received", s)
+	cancel()
+	wg.Wait()
+}
+
+func setupLog(dbg bool) {
+	stripDate := log.Mapper{TimeFunc: func(s string) string { return s[11:] }}
+	if dbg {
+		log.Setup(log.Debug, log.Msec, log.LevelBraces, log.Map(stripDate))
+		return
+	}
+	log.Setup(log.Msec, log.LevelBraces, log.Map(stripDate))
+}
@@ -20,6 +20,7 @@ var suggestions = []prompt.Suggest{
 	// Commands
 	{Text: "quit", Description: "quit shell"},
 	{Text: "info", Description: "show device info"},
+	{Text: "scan", Description: "find devices leaking their token"},
 	// Config
 	{Text: "id", Description: "<id> set device id"},
 	{Text: "ip", Description: "<address> set device ip address"},
@@ -27,6 +28,7 @@ var suggestions = []prompt.Suggest{
 }
 
 type application struct {
+	config    *config.Config
 	deviceCfg *miio.DeviceCfg
 	device    *miio.Device
 	devices   miio.Devices
@@ -60,7 +62,7 @@ func identifyDevice(dc *miio.DeviceCfg) error {
 	if err != nil {
 		return fmt.Errorf("Unable to listen for UDP packets: %v", err)
 	}
-	err = app.poller.PollDevices(ctx)
+	err = app.poller.PollDevices(ctx, miio.AnyDevice)
 	app.transport.Stop()
 	if err != nil {
 		return fmt.Errorf("Unable to identify device: %v", err)
@@ -68,6 +70,33 @@ func identifyDevice(dc *miio.DeviceCfg) error {
 	return nil
 }
 
+// scanTokens broadcasts hello and prints tokens leaked by reset or not yet cloud-bound devices
+func scanTokens() error {
+	app.config.DiscoverTokens = true
+	defer func() { app.config.DiscoverTokens = false }()
+	wg := sync.WaitGroup{}
+	defer wg.Wait()
+	ctx := context.Background()
+	if err := app.transport.Start(ctx, &wg); err != nil {
+		return fmt.Errorf("Unable to listen for UDP packets: %v", err)
+	}
+	_ = app.poller.PollDevices(ctx, miio.AnyDevice)
+	app.transport.Stop()
+	found := 0
+	for {
+		select {
+		case t := <-app.poller.Tokens():
+			fmt.Printf("Device ID: %08x, Address: %s, Token: %x\n", t.ID, t.Address, t.Token)
+			found++
+		default:
+			if found == 0 {
+				fmt.Println("No tokens found")
+			}
+			return nil
+		}
+	}
+}
+
 func printDeviceInfo(d *miio.Device) {
 	if d.ID == 0 && len(d.Address) == 0 {
 		fmt.Println("Uninitialized device")
@@ -150,6 +179,10 @@ func executor(in string) {
 			break
 		}
 		printDeviceInfo(app.device)
+	case "scan":
+		if err := scanTokens(); err != nil {
+			colorPrintf(prompt.Brown, "%v\n", err)
+		}
 	case "id":
 		if err := setDeviceID(app.deviceCfg, blocks[1]); err != nil {
 			colorPrintf(prompt.Brown, "%v\n", err)
@@ -200,6 +233,7 @@ func initPrompt() *prompt.Prompt {
 func main() {
 	config := config.New()
 	setupLog()
+	app.config = config
 	app.devices = make(miio.Devices)
 	app.transport = net.NewTransport(config)
 	app.poller = net.NewPoller(config, app.transport, app.devices)
@@ -5,9 +5,16 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
 	"time"
 
+	h "github.com/eip/miio2mqtt/helpers"
 	"github.com/eip/miio2mqtt/miio"
 	"gopkg.in/yaml.v2"
 )
@@ -16,39 +23,112 @@ const (
 	defaultPollInterval  = 10 * time.Second
 	defaultPollAheadTime = 10 * time.Millisecond
 	defaultPollTimeout   = 5 * time.Second
+	defaultReqTimeout    = time.Second
 	defaultPushTimeout   = 4 * time.Second
 	defaultMiioPort      = 54321
+	defaultQuarantine    = 5
+	defaultProbeEvery    = 30
+	defaultStateInterval = 5 * time.Minute
+	defaultStatusTopic   = "miio2mqtt/status"
+	defaultPublishMode   = PublishJSON
+	defaultKeepAlive     = 30 * time.Second
+	defaultReconnect     = time.Minute
+	defaultQueueSize     = 1000
+	defaultOutboxMaxAge  = 24 * time.Hour
+	defaultOutboxMaxSize = 1 << 20
+)
+
+// Device state publish modes
+const (
+	PublishJSON       = "json"       // JSON object to <Topic>
+	PublishProperties = "properties" // scalar values to <Topic>/<param>
+	PublishBoth       = "both"
 )
 
 // Config defines application options
 type Config struct {
-	PollInterval  time.Duration               `yaml:"PollInterval"`
-	PollAheadTime time.Duration               `yaml:"PollAheadTime"`
-	PollTimeout   time.Duration               `yaml:"PollTimeout"`
-	PushTimeout   time.Duration               `yaml:"PushTimeout"`
-	Mqtt          MqttOptions                 `yaml:"MQTT"`
-	MiioPort      int                         `yaml:"MiioPort"`
-	Models        miio.Models                 `yaml:"Models"`
-	Devices       map[string]miio.DeviceCfg   `yaml:"Devices"`
-	Properties    map[interface{}]interface{} `yaml:"Properties"`
-	Debug         bool                        `yaml:"Debug"`
-	ChanStat      []int
+	PollInterval    time.Duration               `yaml:"PollInterval"`
+	PollAheadTime   time.Duration               `yaml:"PollAheadTime"`
+	PollTimeout     time.Duration               `yaml:"PollTimeout"`
+	RequestTimeout  time.Duration               `yaml:"RequestTimeout"` // unanswered requests are sent again after this time during the poll
+	PushTimeout     time.Duration               `yaml:"PushTimeout"`
+	QuarantineAfter int                         `yaml:"QuarantineAfter"` // failed polls before the unreachable device is quarantined, 0 disables the backoff
+	ProbeEvery      int                         `yaml:"ProbeEvery"`      // quarantined devices are polled once per this number of their poll intervals
+	Mqtt            MqttOptions                 `yaml:"MQTT"`
+	MiioPort        int                         `yaml:"MiioPort"`
+	Broadcast       []string                    `yaml:"Broadcast"`  // extra hello targets like broadcast addresses of routed subnets, ip or ip:port
+	Interfaces      []InterfaceOptions          `yaml:"Interfaces"` // networks to poll devices on, each with its own socket; the default route interface if empty
+	Models          miio.Models                 `yaml:"Models"`
+	Devices         map[string]miio.DeviceCfg   `yaml:"Devices"`
+	Properties      map[interface{}]interface{} `yaml:"Properties"`
+	DiscoverTokens  bool                        `yaml:"DiscoverTokens"` // broadcast hello every poll and report tokens leaked by reset devices
+	Capture         string                      `yaml:"Capture"`        // JSONL file to record sent and received miIO packets to, overwritten on start
+	Replay          string                      `yaml:"Replay"`         // capture file replayed instead of the network
+	StateFile       string                      `yaml:"StateFile"`      // file to keep learned device state across restarts, empty to disable
+	StateInterval   time.Duration               `yaml:"StateInterval"`  // how often the state file is saved besides the shutdown, 0 after every poll
+	Debug           bool                        `yaml:"Debug"`
+	ChanStat        []int
+	chanStatLock    sync.Mutex // several transports may update ChanStat concurrently
 }
 
 type MqttOptions struct {
-	BrokerURL string `yaml:"BrokerURL"`
+	BrokerURL          string        `yaml:"BrokerURL"`
+	ClientID           string        `yaml:"ClientID"` // random if empty
+	Username           string        `yaml:"Username"`
+	Password           string        `yaml:"Password"`
+	CAFile             string        `yaml:"CAFile"`
+	CertFile           string        `yaml:"CertFile"`
+	KeyFile            string        `yaml:"KeyFile"`
+	InsecureSkipVerify bool          `yaml:"InsecureSkipVerify"`
+	KeepAlive          time.Duration `yaml:"KeepAlive"`
+	CleanSession       bool          `yaml:"CleanSession"`
+	DiscoveryPrefix    string        `yaml:"DiscoveryPrefix"` // Home Assistant discovery prefix, e.g. homeassistant; the bridge removes miio2mqtt configs of other devices under it
+	StatusTopic        string        `yaml:"StatusTopic"`     // bridge online/offline status, also used as the Last Will
+	InventoryTopic     string        `yaml:"InventoryTopic"`  // prefix of discovered device tokens in plaintext, e.g. miio2mqtt/inventory, empty to disable
+	PublishMode        string        `yaml:"PublishMode"`     // json, properties or both
+	QoS                byte          `yaml:"QoS"`             // default QoS of device topics
+	Retain             bool          `yaml:"Retain"`          // retain device state messages by default
+	BaseTopic          string        `yaml:"BaseTopic"`       // prefix of device topics generated from their names
+	MaxReconnect       time.Duration `yaml:"MaxReconnect"`    // max interval between reconnect attempts
+	QueueSize          int           `yaml:"QueueSize"`       // max messages queued while disconnected, 0 to disable
+	Outbox             string        `yaml:"Outbox"`          // file to keep queued device states across restarts, empty to disable
+	OutboxMaxAge       time.Duration `yaml:"OutboxMaxAge"`    // device states older than this are not replayed
+	OutboxMaxSize      int           `yaml:"OutboxMaxSize"`   // max outbox file size in bytes
+	ProtocolVersion    int           `yaml:"ProtocolVersion"` // 3 (3.1), 4 (3.1.1) or 5, default is 3.1.1 falling back to 3.1
+	MessageExpiry      time.Duration `yaml:"MessageExpiry"`   // MQTT 5 expiry of device state messages
+}
+
+// InterfaceOptions selects the local network devices are polled on
+type InterfaceOptions struct {
+	Name      string `yaml:"Name"`      // network interface name, e.g. eth1
+	BindIP    string `yaml:"BindIP"`    // local IPv4 address to listen on, the first one of the interface if empty
+	Broadcast string `yaml:"Broadcast"` // hello broadcast address, derived from the interface network if empty
 }
 
 func New() *Config {
 	return &Config{
-		PollInterval:  defaultPollInterval,
-		PollAheadTime: defaultPollAheadTime,
-		PollTimeout:   defaultPollTimeout,
-		PushTimeout:   defaultPushTimeout,
-		Mqtt:          MqttOptions{},
-		MiioPort:      defaultMiioPort,
-		Models:        miio.Models{"*": miio.DefaultModel()},
-		Devices:       map[string]miio.DeviceCfg{},
+		PollInterval:    defaultPollInterval,
+		PollAheadTime:   defaultPollAheadTime,
+		PollTimeout:     defaultPollTimeout,
+		RequestTimeout:  defaultReqTimeout,
+		PushTimeout:     defaultPushTimeout,
+		QuarantineAfter: defaultQuarantine,
+		ProbeEvery:      defaultProbeEvery,
+		StateInterval:   defaultStateInterval,
+		Mqtt: MqttOptions{
+			KeepAlive:     defaultKeepAlive,
+			CleanSession:  true,
+			StatusTopic:   defaultStatusTopic,
+			PublishMode:   defaultPublishMode,
+			Retain:        true,
+			MaxReconnect:  defaultReconnect,
+			QueueSize:     defaultQueueSize,
+			OutboxMaxAge:  defaultOutboxMaxAge,
+			OutboxMaxSize: defaultOutboxMaxSize,
+		},
+		MiioPort: defaultMiioPort,
+		Models:   miio.Models{"*": miio.DefaultModel()},
+		Devices:  map[string]miio.DeviceCfg{},
 		Properties: map[interface{}]interface{}{
 			"off": 0,
 			"on":  1,
@@ -74,6 +154,9 @@ func (c *Config) Load(path string) error {
 	if err = c.parse(data); err != nil {
 		return err
 	}
+	if err = c.loadSpecs(filepath.Dir(path)); err != nil {
+		return err
+	}
 	return c.validate()
 }
 
@@ -81,8 +164,81 @@ func (c *Config) parse(data []byte) error {
 	return yaml.Unmarshal(data, c)
 }
 
+// loadSpecs generates MIoT mappings of the models from their spec files, relative paths are resolved against dir
+func (c *Config) loadSpecs(dir string) error {
+	for name, m := range c.Models {
+		if len(m.Spec) == 0 {
+			continue
+		}
+		spec := m.Spec
+		if !filepath.IsAbs(spec) {
+			spec = filepath.Join(dir, spec)
+		}
+		if err := m.LoadSpec(spec); err != nil {
+			return fmt.Errorf("unable to load %s MIoT spec: %v", name, err)
+		}
+		c.Models[name] = m
+	}
+	return nil
+}
+
 func (c *Config) validate() error {
+	switch c.Mqtt.PublishMode {
+	case PublishJSON, PublishProperties, PublishBoth:
+	default:
+		return fmt.Errorf("invalid MQTT publish mode %q", c.Mqtt.PublishMode)
+	}
+	if (len(c.Mqtt.CertFile) > 0) != (len(c.Mqtt.KeyFile) > 0) {
+		return errors.New("both MQTT CertFile and KeyFile should be set")
+	}
+	if len(c.Mqtt.Outbox) > 0 && c.Mqtt.QueueSize <= 0 {
+		return errors.New("MQTT Outbox requires a positive QueueSize")
+	}
+	switch c.Mqtt.ProtocolVersion {
+	case 0, 3, 4, 5:
+	default:
+		return fmt.Errorf("invalid MQTT protocol version %d", c.Mqtt.ProtocolVersion)
+	}
+	if c.PollInterval < time.Second {
+		return fmt.Errorf("PollInterval %v is less than a second", c.PollInterval)
+	}
+	for name, m := range c.Models {
+		if m.PollInterval != 0 && m.PollInterval < time.Second {
+			return fmt.Errorf("PollInterval %v of %s is less than a second", m.PollInterval, name)
+		}
+	}
+	if c.RequestTimeout <= 0 || c.RequestTimeout >= c.PollTimeout {
+		return fmt.Errorf("RequestTimeout %v should be positive and less than PollTimeout %v", c.RequestTimeout, c.PollTimeout)
+	}
+	if c.QuarantineAfter > 0 && c.ProbeEvery <= 0 {
+		return errors.New("ProbeEvery should be positive")
+	}
+	if c.Mqtt.QoS > 2 {
+		return fmt.Errorf("invalid MQTT QoS %d", c.Mqtt.QoS)
+	}
+	for _, b := range c.Broadcast {
+		if !validHostPort(b) {
+			return fmt.Errorf("invalid broadcast address %q", b)
+		}
+	}
+	for _, i := range c.Interfaces {
+		if len(i.BindIP) > 0 && net.ParseIP(i.BindIP).To4() == nil {
+			return fmt.Errorf("invalid bind address %q", i.BindIP)
+		}
+		if len(i.Broadcast) > 0 && net.ParseIP(i.Broadcast).To4() == nil {
+			return fmt.Errorf("invalid broadcast address %q", i.Broadcast)
+		}
+	}
 	for n, d := range c.Devices {
+		if d.QoS != nil && *d.QoS > 2 {
+			return fmt.Errorf("invalid MQTT QoS %d for %s", *d.QoS, n)
+		}
+		if d.PollInterval != 0 && d.PollInterval < time.Second {
+			return fmt.Errorf("PollInterval %v of %s is less than a second", d.PollInterval, n)
+		}
+		if d.Port < 0 || d.Port > 0xffff {
+			return fmt.Errorf("invalid port %d for %s", d.Port, n)
+		}
 		token, err := hex.DecodeString(d.Token)
 		if err != nil {
 			return fmt.Errorf("invalid token %q for %s - %v", d.Token, n, err)
@@ -90,16 +246,66 @@ func (c *Config) validate() error {
 		if len(token) != 16 {
 			return fmt.Errorf("invalid token length %q for %s", d.Token, n)
 		}
-		// copy(d.Token[:], token)
-		// d.Model = ""
-		// c.Devices[n] = d
+		d.Topic = c.deviceTopic(n, d)
+		c.Devices[n] = d
+	}
+	if err := c.validateTopics(); err != nil {
+		return err
 	}
 	// yml, err := yaml.Marshal(C)
 	// log.Print(string(yml), err)
 	return nil
 }
 
+// validateTopics checks that every device has its own topic, e.g. names of two devices may have the same slug
+func (c *Config) validateTopics() error {
+	names := make([]string, 0, len(c.Devices))
+	for n := range c.Devices {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	topics := map[string]string{}
+	for _, n := range names {
+		topic := c.Devices[n].Topic
+		if other, ok := topics[topic]; ok {
+			return fmt.Errorf("devices %s and %s have the same topic %q", other, n, topic)
+		}
+		topics[topic] = n
+	}
+	return nil
+}
+
+// validHostPort checks the IPv4 address with an optional port
+func validHostPort(addr string) bool {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host, port = addr, "0"
+	}
+	if p, err := strconv.Atoi(port); err != nil || p < 0 || p > 0xffff {
+		return false
+	}
+	return net.ParseIP(host).To4() != nil
+}
+
+// deviceTopic returns the configured device topic as is, or the one generated from the device name under the base topic
+func (c *Config) deviceTopic(name string, d miio.DeviceCfg) string {
+	if len(d.Topic) > 0 {
+		return d.Topic
+	}
+	topic := h.Slug(name)
+	base := d.BaseTopic
+	if len(base) == 0 {
+		base = c.Mqtt.BaseTopic
+	}
+	if len(base) == 0 {
+		return topic
+	}
+	return path.Join(base, topic)
+}
+
 func (c *Config) UpdateChanStat(packets, updates int) {
+	c.chanStatLock.Lock()
+	defer c.chanStatLock.Unlock()
 	if c.ChanStat == nil {
 		c.ChanStat = make([]int, 2)
 	}
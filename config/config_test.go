@@ -2,6 +2,9 @@ package config
 
 import (
 	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -9,6 +12,23 @@ import (
 	"github.com/eip/miio2mqtt/miio"
 )
 
+func testMqttOptions(brokerURL string) MqttOptions {
+	return MqttOptions{
+		BrokerURL:     brokerURL,
+		KeepAlive:     defaultKeepAlive,
+		CleanSession:  true,
+		StatusTopic:   defaultStatusTopic,
+		PublishMode:   defaultPublishMode,
+		Retain:        true,
+		MaxReconnect:  defaultReconnect,
+		QueueSize:     defaultQueueSize,
+		OutboxMaxAge:  defaultOutboxMaxAge,
+		OutboxMaxSize: defaultOutboxMaxSize,
+	}
+}
+
+const testToken = "0102030405060708090a0b0c0d0e0f10"
+
 func Test_New(t *testing.T) {
 	tests := []struct {
 		name string
@@ -17,15 +37,20 @@ func Test_New(t *testing.T) {
 		{
 			name: "Default",
 			want: &Config{
-				PollInterval:  defaultPollInterval,
-				PollAheadTime: defaultPollAheadTime,
-				PollTimeout:   defaultPollTimeout,
-				PushTimeout:   defaultPushTimeout,
-				MiioPort:      defaultMiioPort,
-				Models:        miio.Models{"*": miio.DefaultModel()},
-				Devices:       map[string]miio.DeviceCfg{},
-				Properties:    map[interface{}]interface{}{"off": 0, "on": 1},
-				Debug:         false,
+				PollInterval:    defaultPollInterval,
+				PollAheadTime:   defaultPollAheadTime,
+				PollTimeout:     defaultPollTimeout,
+				RequestTimeout:  defaultReqTimeout,
+				PushTimeout:     defaultPushTimeout,
+				QuarantineAfter: defaultQuarantine,
+				ProbeEvery:      defaultProbeEvery,
+				StateInterval:   defaultStateInterval,
+				Mqtt:            testMqttOptions(""),
+				MiioPort:        defaultMiioPort,
+				Models:          miio.Models{"*": miio.DefaultModel()},
+				Devices:         map[string]miio.DeviceCfg{},
+				Properties:      map[interface{}]interface{}{"off": 0, "on": 1},
+				Debug:           false,
 			},
 		},
 	}
@@ -54,7 +79,31 @@ func Test_Config_parse(t *testing.T) {
 PollAheadTime: 50ms
 PollTimeout: 5s
 PushTimeout: 4s
+QuarantineAfter: 3
+ProbeEvery: 10
+StateFile: /var/lib/miio2mqtt/state.json
+StateInterval: 1m
+MQTT:
+  BrokerURL: ssl://localhost:8883
+  ClientID: miio2mqtt-test
+  Username: user
+  Password: secret
+  CAFile: ca.crt
+  CertFile: client.crt
+  KeyFile: client.key
+  KeepAlive: 1m
+  CleanSession: false
+  QoS: 1
+  Retain: false
+  BaseTopic: home
+  Outbox: /var/lib/miio2mqtt/outbox.jsonl
+  OutboxMaxAge: 12h
+  OutboxMaxSize: 65536
+  ProtocolVersion: 5
+  MessageExpiry: 10m
 MiioPort: 12345
+Broadcast:
+  - 192.168.20.255
 Models:
   mi.dummy.v1:
     Methods:
@@ -68,18 +117,51 @@ Models:
 Devices:
   DummySensor:
     Address: 192.168.1.200
+    Port: 12346
     ID: 0x01234567
     Token: 0102030405060708090a0b0c0d0e0f10
     Topic: home/room/dummysensor
+    QoS: 2
+    Retain: true
+    BaseTopic: devices
 Properties:
     true: 1
     false: 0`),
 			want: &Config{
-				PollInterval:  10 * time.Second,
-				PollAheadTime: 50 * time.Millisecond,
-				PollTimeout:   5 * time.Second,
-				PushTimeout:   4 * time.Second,
-				MiioPort:      12345,
+				PollInterval:    10 * time.Second,
+				PollAheadTime:   50 * time.Millisecond,
+				PollTimeout:     5 * time.Second,
+				RequestTimeout:  defaultReqTimeout,
+				PushTimeout:     4 * time.Second,
+				QuarantineAfter: 3,
+				ProbeEvery:      10,
+				StateFile:       "/var/lib/miio2mqtt/state.json",
+				StateInterval:   time.Minute,
+				Mqtt: MqttOptions{
+					BrokerURL:       "ssl://localhost:8883",
+					ClientID:        "miio2mqtt-test",
+					Username:        "user",
+					Password:        "secret",
+					CAFile:          "ca.crt",
+					CertFile:        "client.crt",
+					KeyFile:         "client.key",
+					KeepAlive:       time.Minute,
+					CleanSession:    false,
+					StatusTopic:     defaultStatusTopic,
+					PublishMode:     defaultPublishMode,
+					QoS:             1,
+					Retain:          false,
+					BaseTopic:       "home",
+					MaxReconnect:    defaultReconnect,
+					QueueSize:       defaultQueueSize,
+					Outbox:          "/var/lib/miio2mqtt/outbox.jsonl",
+					OutboxMaxAge:    12 * time.Hour,
+					OutboxMaxSize:   65536,
+					ProtocolVersion: 5,
+					MessageExpiry:   10 * time.Minute,
+				},
+				MiioPort:  12345,
+				Broadcast: []string{"192.168.20.255"},
 				Models: miio.Models{
 					"*": miio.DefaultModel(),
 					"mi.dummy.v1": miio.Model{
@@ -92,10 +174,14 @@ Properties:
 				},
 				Devices: map[string]miio.DeviceCfg{
 					"DummySensor": {
-						Address: "192.168.1.200",
-						ID:      0x01234567,
-						Topic:   "home/room/dummysensor",
-						Token:   "0102030405060708090a0b0c0d0e0f10",
+						Address:   "192.168.1.200",
+						Port:      12346,
+						ID:        0x01234567,
+						Topic:     "home/room/dummysensor",
+						Token:     "0102030405060708090a0b0c0d0e0f10",
+						QoS:       func(v byte) *byte { return &v }(2),
+						Retain:    func(v bool) *bool { return &v }(true),
+						BaseTopic: "devices",
 					},
 				},
 				Properties: map[interface{}]interface{}{false: 0, true: 1, "off": 0, "on": 1},
@@ -136,6 +222,157 @@ func Test_Config_validate(t *testing.T) {
 			config: New(),
 			want:   New(),
 		},
+		{
+			name:   "Certificate without key",
+			config: func() *Config { c := New(); c.Mqtt.CertFile = "client.crt"; return c }(),
+			want:   func() *Config { c := New(); c.Mqtt.CertFile = "client.crt"; return c }(),
+			err:    errors.New("both MQTT CertFile and KeyFile should be set"),
+		},
+		{
+			name:   "Invalid publish mode",
+			config: func() *Config { c := New(); c.Mqtt.PublishMode = "foo"; return c }(),
+			want:   func() *Config { c := New(); c.Mqtt.PublishMode = "foo"; return c }(),
+			err:    errors.New(`invalid MQTT publish mode "foo"`),
+		},
+		{
+			name:   "Outbox without queue",
+			config: func() *Config { c := New(); c.Mqtt.Outbox, c.Mqtt.QueueSize = "outbox.jsonl", 0; return c }(),
+			want:   func() *Config { c := New(); c.Mqtt.Outbox, c.Mqtt.QueueSize = "outbox.jsonl", 0; return c }(),
+			err:    errors.New("MQTT Outbox requires a positive QueueSize"),
+		},
+		{
+			name:   "Quarantine without probes",
+			config: func() *Config { c := New(); c.ProbeEvery = 0; return c }(),
+			want:   func() *Config { c := New(); c.ProbeEvery = 0; return c }(),
+			err:    errors.New("ProbeEvery should be positive"),
+		},
+		{
+			name:   "Sub-second poll interval",
+			config: func() *Config { c := New(); c.PollInterval = 500 * time.Millisecond; return c }(),
+			want:   func() *Config { c := New(); c.PollInterval = 500 * time.Millisecond; return c }(),
+			err:    errors.New("PollInterval 500ms is less than a second"),
+		},
+		{
+			name: "Sub-second device poll interval",
+			config: func() *Config {
+				c := New()
+				c.Devices["Foo"] = miio.DeviceCfg{Token: testToken, PollInterval: 100 * time.Millisecond}
+				return c
+			}(),
+			want: func() *Config {
+				c := New()
+				c.Devices["Foo"] = miio.DeviceCfg{Token: testToken, PollInterval: 100 * time.Millisecond}
+				return c
+			}(),
+			err: errors.New("PollInterval 100ms of Foo is less than a second"),
+		},
+		{
+			name:   "Request timeout of the poll",
+			config: func() *Config { c := New(); c.RequestTimeout = c.PollTimeout; return c }(),
+			want:   func() *Config { c := New(); c.RequestTimeout = c.PollTimeout; return c }(),
+			err:    errors.New("RequestTimeout 5s should be positive and less than PollTimeout 5s"),
+		},
+		{
+			name:   "Broadcast",
+			config: func() *Config { c := New(); c.Broadcast = []string{"192.168.20.255", "10.0.0.255:54321"}; return c }(),
+			want:   func() *Config { c := New(); c.Broadcast = []string{"192.168.20.255", "10.0.0.255:54321"}; return c }(),
+		},
+		{
+			name:   "Invalid broadcast",
+			config: func() *Config { c := New(); c.Broadcast = []string{"192.168.20.255:port"}; return c }(),
+			want:   func() *Config { c := New(); c.Broadcast = []string{"192.168.20.255:port"}; return c }(),
+			err:    errors.New(`invalid broadcast address "192.168.20.255:port"`),
+		},
+		{
+			name:   "Interfaces",
+			config: func() *Config { c := New(); c.Interfaces = []InterfaceOptions{{Name: "eth1"}}; return c }(),
+			want:   func() *Config { c := New(); c.Interfaces = []InterfaceOptions{{Name: "eth1"}}; return c }(),
+		},
+		{
+			name:   "Invalid bind address",
+			config: func() *Config { c := New(); c.Interfaces = []InterfaceOptions{{BindIP: "eth1"}}; return c }(),
+			want:   func() *Config { c := New(); c.Interfaces = []InterfaceOptions{{BindIP: "eth1"}}; return c }(),
+			err:    errors.New(`invalid bind address "eth1"`),
+		},
+		{
+			name:   "Backoff disabled",
+			config: func() *Config { c := New(); c.QuarantineAfter, c.ProbeEvery = 0, 0; return c }(),
+			want:   func() *Config { c := New(); c.QuarantineAfter, c.ProbeEvery = 0, 0; return c }(),
+		},
+		{
+			name:   "Invalid protocol version",
+			config: func() *Config { c := New(); c.Mqtt.ProtocolVersion = 6; return c }(),
+			want:   func() *Config { c := New(); c.Mqtt.ProtocolVersion = 6; return c }(),
+			err:    errors.New("invalid MQTT protocol version 6"),
+		},
+		{
+			name:   "Invalid QoS",
+			config: func() *Config { c := New(); c.Mqtt.QoS = 3; return c }(),
+			want:   func() *Config { c := New(); c.Mqtt.QoS = 3; return c }(),
+			err:    errors.New("invalid MQTT QoS 3"),
+		},
+		{
+			name: "Invalid device QoS",
+			config: func() *Config {
+				c := New()
+				c.Devices["Foo"] = miio.DeviceCfg{QoS: func(v byte) *byte { return &v }(3)}
+				return c
+			}(),
+			want: func() *Config {
+				c := New()
+				c.Devices["Foo"] = miio.DeviceCfg{QoS: func(v byte) *byte { return &v }(3)}
+				return c
+			}(),
+			err: errors.New("invalid MQTT QoS 3 for Foo"),
+		},
+		{
+			name: "Device topics",
+			config: func() *Config {
+				c := New()
+				c.Mqtt.BaseTopic = "home"
+				c.Devices["Air Monitor"] = miio.DeviceCfg{Token: testToken}
+				c.Devices["DeskLamp"] = miio.DeviceCfg{Token: testToken, Topic: "livingroom/desklamp"}
+				c.Devices["Plug"] = miio.DeviceCfg{Token: testToken, BaseTopic: "/garage/"}
+				return c
+			}(),
+			want: func() *Config {
+				c := New()
+				c.Mqtt.BaseTopic = "home"
+				c.Devices["Air Monitor"] = miio.DeviceCfg{Token: testToken, Topic: "home/air_monitor"}
+				c.Devices["DeskLamp"] = miio.DeviceCfg{Token: testToken, Topic: "livingroom/desklamp"} // the configured topic is used as is
+				c.Devices["Plug"] = miio.DeviceCfg{Token: testToken, Topic: "/garage/plug", BaseTopic: "/garage/"}
+				return c
+			}(),
+		},
+		{
+			name: "Same topic",
+			config: func() *Config {
+				c := New()
+				c.Devices["Air Monitor"] = miio.DeviceCfg{Token: testToken}
+				c.Devices["air_monitor"] = miio.DeviceCfg{Token: testToken}
+				return c
+			}(),
+			want: func() *Config {
+				c := New()
+				c.Devices["Air Monitor"] = miio.DeviceCfg{Token: testToken, Topic: "air_monitor"}
+				c.Devices["air_monitor"] = miio.DeviceCfg{Token: testToken, Topic: "air_monitor"}
+				return c
+			}(),
+			err: errors.New(`devices Air Monitor and air_monitor have the same topic "air_monitor"`),
+		},
+		{
+			name: "Generated topic without base",
+			config: func() *Config {
+				c := New()
+				c.Devices["DeskLamp"] = miio.DeviceCfg{Token: testToken}
+				return c
+			}(),
+			want: func() *Config {
+				c := New()
+				c.Devices["DeskLamp"] = miio.DeviceCfg{Token: testToken, Topic: "desklamp"}
+				return c
+			}(),
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -163,16 +400,40 @@ func TestLoad(t *testing.T) {
 			name: "Empty path",
 			arg:  "../config_sample.yml",
 			want: &Config{
-				PollInterval:  10 * time.Second,
-				PollAheadTime: 100 * time.Millisecond,
-				PollTimeout:   4 * time.Second,
-				PushTimeout:   4 * time.Second,
-				Mqtt:          MqttOptions{BrokerURL: "tcp://localhost:1883"},
-				MiioPort:      defaultMiioPort,
+				PollInterval:    10 * time.Second,
+				PollAheadTime:   100 * time.Millisecond,
+				PollTimeout:     4 * time.Second,
+				RequestTimeout:  defaultReqTimeout,
+				PushTimeout:     4 * time.Second,
+				QuarantineAfter: defaultQuarantine,
+				ProbeEvery:      defaultProbeEvery,
+				StateInterval:   defaultStateInterval,
+				Mqtt:            testMqttOptions("tcp://localhost:1883"),
+				MiioPort:        defaultMiioPort,
 				Models: miio.Models{
-					"*":                   miio.DefaultModel(),
-					"yeelink.light.lamp2": miio.Model{Params: []string{"power", "bright", "ct", "color_mode"}},
-					"zhimi.airmonitor.v1": miio.Model{Params: []string{"power", "usb_state", "aqi", "battery"}},
+					"*": miio.DefaultModel(),
+					"yeelink.light.lamp2": miio.Model{
+						Methods: miio.ModelMethods{SetProp: map[string]string{"power": "set_power", "bright": "set_bright", "ct": "set_ct_abx"}},
+						Params:  []string{"power", "bright", "ct", "color_mode"},
+					},
+					"zhimi.airmonitor.v1": miio.Model{
+						Params: []string{"power", "usb_state", "aqi", "battery"},
+						Discovery: map[string]miio.ParamDiscovery{
+							"power":   {Component: "binary_sensor"},
+							"aqi":     {DeviceClass: "aqi"},
+							"battery": {Unit: "%", DeviceClass: "battery"},
+						},
+						PollInterval: 5 * time.Second,
+					},
+					"zhimi.airpurifier.mb3": miio.Model{
+						MIoT: map[string]miio.MIoTProp{
+							"power": {Siid: 2, Piid: 2},
+							"mode":  {Siid: 2, Piid: 5},
+							"aqi":   {Siid: 3, Piid: 6},
+						},
+						Actions: map[string]miio.MIoTAction{"toggle": {Siid: 2, Aiid: 1}},
+						Params:  []string{"power", "mode", "aqi"},
+					},
 				},
 				Devices: map[string]miio.DeviceCfg{
 					"AirMonitor": {
@@ -203,3 +464,44 @@ func TestLoad(t *testing.T) {
 		})
 	}
 }
+
+func TestLoad_Spec(t *testing.T) {
+	dir := t.TempDir()
+	spec := `{"type":"urn:miot-spec-v2:device:light:0000A001:yeelink-lamp22:1","services":[
+{"iid":1,"type":"urn:miot-spec-v2:service:device-information:00007801:yeelink-lamp22:1","properties":[{"iid":1,"type":"urn:miot-spec-v2:property:manufacturer:00000001:yeelink-lamp22:1","access":["read"]}]},
+{"iid":2,"type":"urn:miot-spec-v2:service:light:00007802:yeelink-lamp22:1","properties":[
+{"iid":1,"type":"urn:miot-spec-v2:property:on:00000006:yeelink-lamp22:1","access":["read","write","notify"]},
+{"iid":2,"type":"urn:miot-spec-v2:property:brightness:0000000D:yeelink-lamp22:1","access":["read","write","notify"]}],
+"actions":[{"iid":1,"type":"urn:miot-spec-v2:action:toggle:00002811:yeelink-lamp22:1"}]}]}`
+	h.AssertError(t, os.MkdirAll(filepath.Join(dir, "specs"), 0700), nil)
+	h.AssertError(t, ioutil.WriteFile(filepath.Join(dir, "specs", "lamp22.json"), []byte(spec), 0600), nil)
+	h.AssertError(t, ioutil.WriteFile(filepath.Join(dir, "config.yml"), []byte(`
+Models:
+  yeelink.light.lamp22:
+    Spec: specs/lamp22.json
+    MIoT:
+      power:
+        Siid: 2
+        Piid: 1
+  yeelink.light.lamp23:
+    Spec: specs/missing.json
+`), 0600), nil)
+
+	config := New()
+	err := config.Load(filepath.Join(dir, "config.yml"))
+	h.AssertError(t, err, errors.New("unable to load yeelink.light.lamp23 MIoT spec: open "+filepath.Join(dir, "specs", "missing.json")+": no such file or directory"))
+
+	config = New()
+	config.Models["yeelink.light.lamp22"] = miio.Model{Spec: "specs/lamp22.json", MIoT: map[string]miio.MIoTProp{"power": {Siid: 2, Piid: 1}}}
+	h.AssertError(t, config.loadSpecs(dir), nil)
+	h.AssertEqual(t, config.Models["yeelink.light.lamp22"], miio.Model{
+		Spec: "specs/lamp22.json",
+		MIoT: map[string]miio.MIoTProp{
+			"power":            {Siid: 2, Piid: 1},
+			"light_on":         {Siid: 2, Piid: 1},
+			"light_brightness": {Siid: 2, Piid: 2},
+		},
+		Actions: map[string]miio.MIoTAction{"light_toggle": {Siid: 2, Aiid: 1}},
+		Params:  []string{"light_on", "light_brightness"},
+	})
+}
@@ -0,0 +1,436 @@
+package config
+
+import (
+	"bytes"
+	"crypto/aes"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/eip/miio2mqtt/miio"
+	"gopkg.in/yaml.v2"
+	yamlv3 "gopkg.in/yaml.v3"
+)
+
+// sqliteDriver is the database/sql driver used to read Mi Home backups, it is registered by the sqlite build of the application
+const sqliteDriver = "sqlite3"
+
+var sqliteHeader = []byte("SQLite format 3\x00")
+
+// Mi Home backup tables: Android miio2.db and iOS *_mihome.sqlite
+const (
+	androidDevicesQuery = `SELECT did, name, localIP, token, model FROM devicerecord`
+	iosDevicesQuery     = `SELECT ZDID, ZNAME, ZLOCALIP, ZTOKEN, ZMODEL FROM ZDEVICE`
+)
+
+// ImportedDevice is the device found in the export of another tool
+type ImportedDevice struct {
+	Name    string
+	ID      uint32
+	Address string
+	Token   string
+	Model   string
+}
+
+// ImportDevices reads devices with tokens from the JSON export of Xiaomi cloud token extractors,
+// python-miio style YAML or JSON device lists and Mi Home app backup databases,
+// records without a valid miIO token (e.g. Bluetooth devices) are skipped
+func ImportDevices(path string) ([]ImportedDevice, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var records []map[string]string
+	if bytes.HasPrefix(data, sqliteHeader) {
+		records, err = readBackupRecords(path)
+	} else {
+		records, err = parseExportRecords(data)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to import %s: %v", path, err)
+	}
+	result := []ImportedDevice{}
+	for _, r := range records {
+		if d, ok := importedDevice(r); ok {
+			result = append(result, d)
+		}
+	}
+	return result, nil
+}
+
+// MergeDevices adds imported devices to the devices configuration, existing entries are matched by ID, address or name
+// and get the imported token, address and model, it returns names of added and updated entries
+func MergeDevices(devices map[string]miio.DeviceCfg, imported []ImportedDevice) (added []string, updated []string) {
+	for _, d := range imported {
+		name, found := findDevice(devices, d)
+		cfg := devices[name]
+		if !found {
+			name = uniqueDeviceName(devices, d)
+			cfg = miio.DeviceCfg{}
+		}
+		before := cfg
+		if d.ID != 0 {
+			cfg.ID = d.ID
+		}
+		if len(d.Address) > 0 {
+			cfg.Address = d.Address
+		}
+		if len(d.Model) > 0 {
+			cfg.Model = d.Model
+		}
+		cfg.Token = d.Token
+		devices[name] = cfg
+		switch {
+		case !found:
+			added = append(added, name)
+		case !sameDeviceCfg(before, cfg):
+			updated = append(updated, name)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(updated)
+	return added, updated
+}
+
+// ReadDevices reads the Devices section of the configuration file without validating the rest of it,
+// the missing file has no devices
+func ReadDevices(path string) (map[string]miio.DeviceCfg, error) {
+	cfg := struct {
+		Devices map[string]miio.DeviceCfg `yaml:"Devices"`
+	}{}
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		return nil, err
+	}
+	if cfg.Devices == nil {
+		cfg.Devices = map[string]miio.DeviceCfg{}
+	}
+	return cfg.Devices, nil
+}
+
+// UpdateDevicesFile writes the devices into the Devices section of the configuration file,
+// the rest of the file is kept as is, including its comments, formatting and mode
+func UpdateDevicesFile(path string, devices map[string]miio.DeviceCfg) error {
+	mode := os.FileMode(0600)
+	data, err := ioutil.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return err
+	default:
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		mode = info.Mode().Perm()
+	}
+	doc := yamlv3.Node{}
+	if err := yamlv3.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	if doc.Kind == 0 {
+		doc = yamlv3.Node{Kind: yamlv3.DocumentNode, Content: []*yamlv3.Node{{Kind: yamlv3.MappingNode}}}
+	}
+	root := doc.Content[0]
+	if root.Kind != yamlv3.MappingNode {
+		return errors.New("configuration should be a YAML mapping")
+	}
+	section := mappingValue(root, "Devices")
+	if section == nil || section.Kind != yamlv3.MappingNode {
+		section = &yamlv3.Node{Kind: yamlv3.MappingNode}
+	}
+	names := make([]string, 0, len(devices))
+	for name := range devices {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := updateDeviceNode(section, name, devices[name]); err != nil {
+			return err
+		}
+	}
+	buf := bytes.Buffer{}
+	enc := yamlv3.NewEncoder(&buf)
+	enc.SetIndent(2)
+	devicesDoc := yamlv3.Node{Kind: yamlv3.MappingNode, Content: []*yamlv3.Node{{Kind: yamlv3.ScalarNode, Value: "Devices"}, section}}
+	if err := enc.Encode(&devicesDoc); err != nil {
+		return err
+	}
+	if err := enc.Close(); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, replaceSection(data, root, "Devices", buf.Bytes()), mode)
+}
+
+// replaceSection replaces lines of the top level key of the YAML document with the text,
+// top level comment lines preceding the next key are kept as they belong to it, the missing key is appended
+func replaceSection(data []byte, root *yamlv3.Node, key string, text []byte) []byte {
+	lines := bytes.SplitAfter(data, []byte("\n"))
+	if len(lines[len(lines)-1]) == 0 {
+		lines = lines[:len(lines)-1]
+	}
+	start, end := -1, len(lines)
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if start >= 0 {
+			end = root.Content[i].Line - 1
+			break
+		}
+		if root.Content[i].Value == key {
+			start = root.Content[i].Line - 1
+		}
+	}
+	if start < 0 {
+		if len(data) > 0 && !bytes.HasSuffix(data, []byte("\n")) {
+			data = append(data, '\n')
+		}
+		return append(data, text...)
+	}
+	for end > start+1 {
+		if line := lines[end-1]; len(bytes.TrimSpace(line)) > 0 && line[0] != '#' {
+			break
+		}
+		end--
+	}
+	result := []byte{}
+	for _, l := range lines[:start] {
+		result = append(result, l...)
+	}
+	result = append(result, text...)
+	for _, l := range lines[end:] {
+		result = append(result, l...)
+	}
+	return result
+}
+
+func updateDeviceNode(section *yamlv3.Node, name string, cfg miio.DeviceCfg) error {
+	node := mappingValue(section, name)
+	if node == nil || node.Kind != yamlv3.MappingNode {
+		node = &yamlv3.Node{Kind: yamlv3.MappingNode}
+		setMappingValue(section, name, node)
+	}
+	fields := []struct {
+		key   string
+		value string
+		tag   string
+	}{
+		{"ID", fmt.Sprintf("%#08x", cfg.ID), "!!int"},
+		{"Address", cfg.Address, "!!str"},
+		{"Token", cfg.Token, "!!str"},
+		{"Model", cfg.Model, "!!str"},
+	}
+	for _, f := range fields {
+		if len(f.value) == 0 || f.key == "ID" && cfg.ID == 0 {
+			continue
+		}
+		setMappingValue(node, f.key, &yamlv3.Node{Kind: yamlv3.ScalarNode, Tag: f.tag, Value: f.value})
+	}
+	return nil
+}
+
+func mappingValue(node *yamlv3.Node, key string) *yamlv3.Node {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+func setMappingValue(node *yamlv3.Node, key string, value *yamlv3.Node) {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			value.HeadComment, value.LineComment = node.Content[i+1].HeadComment, node.Content[i+1].LineComment
+			node.Content[i+1] = value
+			return
+		}
+	}
+	node.Content = append(node.Content, &yamlv3.Node{Kind: yamlv3.ScalarNode, Value: key}, value)
+}
+
+// parseExportRecords finds the device list in the JSON or YAML export, which may be a list of devices,
+// a map of device names to devices, or a Xiaomi cloud reply with the list in result.list
+func parseExportRecords(data []byte) ([]map[string]string, error) {
+	var doc interface{}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	for _, key := range []string{"result", "list", "devices"} {
+		if m, ok := doc.(map[interface{}]interface{}); ok {
+			if v, ok := m[key]; ok {
+				doc = v
+			}
+		}
+	}
+	result := []map[string]string{}
+	switch list := doc.(type) {
+	case []interface{}:
+		for _, item := range list {
+			if m, ok := item.(map[interface{}]interface{}); ok {
+				result = append(result, stringRecord(m, ""))
+			}
+		}
+	case map[interface{}]interface{}:
+		for name, item := range list {
+			if m, ok := item.(map[interface{}]interface{}); ok {
+				result = append(result, stringRecord(m, fmt.Sprint(name)))
+			}
+		}
+	default:
+		return nil, errors.New("unable to find the device list")
+	}
+	return result, nil
+}
+
+func stringRecord(m map[interface{}]interface{}, name string) map[string]string {
+	result := map[string]string{}
+	if len(name) > 0 {
+		result["name"] = name
+	}
+	for k, v := range m {
+		if v == nil {
+			continue
+		}
+		result[strings.ToLower(fmt.Sprint(k))] = fmt.Sprint(v)
+	}
+	return result
+}
+
+// readBackupRecords reads devices from the Android or iOS Mi Home backup database
+func readBackupRecords(path string) ([]map[string]string, error) {
+	db, err := sql.Open(sqliteDriver, path)
+	if err != nil {
+		return nil, fmt.Errorf("%v, Mi Home backups are supported by the sqlite build only", err)
+	}
+	defer db.Close()
+	rows, err := db.Query(androidDevicesQuery)
+	if err != nil {
+		rows, err = db.Query(iosDevicesQuery)
+	}
+	if err != nil {
+		return nil, errors.New("unable to find the device table")
+	}
+	defer rows.Close()
+	result := []map[string]string{}
+	for rows.Next() {
+		var did, name, ip, token, model sql.NullString
+		if err := rows.Scan(&did, &name, &ip, &token, &model); err != nil {
+			return nil, err
+		}
+		result = append(result, map[string]string{
+			"did":   did.String,
+			"name":  name.String,
+			"ip":    ip.String,
+			"token": decryptBackupToken(token.String),
+			"model": model.String,
+		})
+	}
+	return result, rows.Err()
+}
+
+// decryptBackupToken decrypts the token of iOS backups, which is encrypted with AES-ECB and the zero key
+func decryptBackupToken(token string) string {
+	if len(token) <= 32 {
+		return token
+	}
+	data, err := hex.DecodeString(token)
+	if err != nil || len(data) < 32 {
+		return token
+	}
+	block, _ := aes.NewCipher(make([]byte, 16))
+	result := make([]byte, 32)
+	block.Decrypt(result[:16], data[:16])
+	block.Decrypt(result[16:], data[16:32])
+	return string(result)
+}
+
+// importedDevice normalizes the record fields named differently by various tools
+func importedDevice(r map[string]string) (ImportedDevice, bool) {
+	d := ImportedDevice{
+		Name:    firstValue(r, "name", "friendly_name"),
+		Address: firstValue(r, "ip", "localip", "host", "address"),
+		Token:   strings.ToLower(firstValue(r, "token")),
+		Model:   firstValue(r, "model"),
+	}
+	if id, err := strconv.ParseUint(firstValue(r, "did", "id"), 0, 32); err == nil {
+		d.ID = uint32(id)
+	}
+	if token, err := hex.DecodeString(d.Token); err != nil || len(token) != 16 {
+		return d, false
+	}
+	if d.ID == 0 && len(d.Address) == 0 {
+		return d, false
+	}
+	if len(d.Name) == 0 {
+		d.Name = d.Model
+	}
+	return d, true
+}
+
+func firstValue(r map[string]string, keys ...string) string {
+	for _, k := range keys {
+		if v := strings.TrimSpace(r[k]); len(v) > 0 {
+			return v
+		}
+	}
+	return ""
+}
+
+// findDevice returns the name of the configured device matched by ID, address or name, names are checked in order,
+// so the match does not depend on the map order; the device of the same name with another ID or address is not matched
+func findDevice(devices map[string]miio.DeviceCfg, d ImportedDevice) (string, bool) {
+	names := make([]string, 0, len(devices))
+	for name := range devices {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, match := range []func(miio.DeviceCfg) bool{
+		func(cfg miio.DeviceCfg) bool { return d.ID != 0 && cfg.ID == d.ID },
+		func(cfg miio.DeviceCfg) bool { return len(d.Address) > 0 && cfg.Address == d.Address },
+	} {
+		for _, name := range names {
+			if match(devices[name]) {
+				return name, true
+			}
+		}
+	}
+	cfg, found := devices[d.Name]
+	if found && (cfg.ID != 0 && d.ID != 0 || len(cfg.Address) > 0 && len(d.Address) > 0) { // another device with the same name
+		return d.Name, false
+	}
+	return d.Name, found
+}
+
+// uniqueDeviceName returns the imported device name, suffixed with its ID or address if the name is taken
+func uniqueDeviceName(devices map[string]miio.DeviceCfg, d ImportedDevice) string {
+	name := d.Name
+	if len(name) == 0 {
+		name = "Device"
+	}
+	if _, exists := devices[name]; !exists {
+		return name
+	}
+	suffix := d.Address
+	if d.ID != 0 {
+		suffix = fmt.Sprintf("%08x", d.ID)
+	}
+	result := fmt.Sprintf("%s %s", name, suffix)
+	for i := 2; ; i++ {
+		if _, exists := devices[result]; !exists {
+			return result
+		}
+		result = fmt.Sprintf("%s %s (%d)", name, suffix, i)
+	}
+}
+
+func sameDeviceCfg(a, b miio.DeviceCfg) bool {
+	return a.ID == b.ID && a.Address == b.Address && a.Token == b.Token && a.Model == b.Model
+}
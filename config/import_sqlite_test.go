@@ -0,0 +1,59 @@
+//go:build sqlite
+// +build sqlite
+
+package config
+
+import (
+	"crypto/aes"
+	"database/sql"
+	"encoding/hex"
+	"path/filepath"
+	"testing"
+
+	h "github.com/eip/miio2mqtt/helpers"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestImportDevices_Backup(t *testing.T) {
+	block, _ := aes.NewCipher(make([]byte, 16))
+	encrypted := make([]byte, 48)
+	block.Encrypt(encrypted[:16], []byte(testToken[:16]))
+	block.Encrypt(encrypted[16:32], []byte(testToken[16:]))
+	block.Encrypt(encrypted[32:], []byte("\x10\x10\x10\x10\x10\x10\x10\x10\x10\x10\x10\x10\x10\x10\x10\x10"))
+	tests := []struct {
+		name   string
+		schema string
+		insert string
+		args   []interface{}
+	}{
+		{
+			name:   "Android",
+			schema: `CREATE TABLE devicerecord (did TEXT, name TEXT, localIP TEXT, token TEXT, model TEXT)`,
+			insert: `INSERT INTO devicerecord VALUES (?, ?, ?, ?, ?)`,
+			args:   []interface{}{"123456789", "Air Purifier", "192.168.1.11", testToken, "zhimi.airpurifier.mb3"},
+		},
+		{
+			name:   "iOS",
+			schema: `CREATE TABLE ZDEVICE (ZDID TEXT, ZNAME TEXT, ZLOCALIP TEXT, ZTOKEN TEXT, ZMODEL TEXT)`,
+			insert: `INSERT INTO ZDEVICE VALUES (?, ?, ?, ?, ?)`,
+			args:   []interface{}{"123456789", "Air Purifier", "192.168.1.11", hex.EncodeToString(encrypted), "zhimi.airpurifier.mb3"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "mihome.sqlite")
+			db, err := sql.Open(sqliteDriver, path)
+			h.AssertError(t, err, nil)
+			_, err = db.Exec(tt.schema)
+			h.AssertError(t, err, nil)
+			_, err = db.Exec(tt.insert, tt.args...)
+			h.AssertError(t, err, nil)
+			h.AssertError(t, db.Close(), nil)
+			got, err := ImportDevices(path)
+			h.AssertError(t, err, nil)
+			h.AssertEqual(t, got, []ImportedDevice{
+				{Name: "Air Purifier", ID: 123456789, Address: "192.168.1.11", Token: testToken, Model: "zhimi.airpurifier.mb3"},
+			})
+		})
+	}
+}
@@ -0,0 +1,210 @@
+package config
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	h "github.com/eip/miio2mqtt/helpers"
+	"github.com/eip/miio2mqtt/miio"
+)
+
+func TestImportDevices(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    []ImportedDevice
+		wantErr error
+	}{
+		{
+			name: "Cloud",
+			data: `{"code":0,"message":"ok","result":{"list":[
+{"did":"123456789","name":"Air Purifier","localip":"192.168.1.11","token":"0102030405060708090A0B0C0D0E0F10","model":"zhimi.airpurifier.mb3"},
+{"did":"blt.3.1abcdefgh","name":"Thermometer","localip":"","token":"0102030405060708090a0b0c","model":"cgllc.sensor_ht.g1"}]}}`,
+			want: []ImportedDevice{
+				{Name: "Air Purifier", ID: 123456789, Address: "192.168.1.11", Token: testToken, Model: "zhimi.airpurifier.mb3"},
+			},
+		},
+		{
+			name: "List",
+			data: `
+- name: Ceiling Lamp
+  ip: 192.168.1.12
+  token: 0102030405060708090a0b0c0d0e0f10
+  model: yeelink.light.ceiling1
+  did: 0x01234567
+- ip: 192.168.1.13
+  token: 0102030405060708090a0b0c0d0e0f10
+  model: yeelink.light.lamp22
+`,
+			want: []ImportedDevice{
+				{Name: "Ceiling Lamp", ID: 0x01234567, Address: "192.168.1.12", Token: testToken, Model: "yeelink.light.ceiling1"},
+				{Name: "yeelink.light.lamp22", Address: "192.168.1.13", Token: testToken, Model: "yeelink.light.lamp22"},
+			},
+		},
+		{
+			name: "Map",
+			data: `
+devices:
+  Desk Lamp:
+    host: 192.168.1.14
+    token: 0102030405060708090a0b0c0d0e0f10
+`,
+			want: []ImportedDevice{
+				{Name: "Desk Lamp", Address: "192.168.1.14", Token: testToken},
+			},
+		},
+		{
+			name:    "No list",
+			data:    `"devices"`,
+			wantErr: errors.New("unable to find the device list"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "devices.json")
+			h.AssertError(t, ioutil.WriteFile(path, []byte(tt.data), 0600), nil)
+			got, err := ImportDevices(path)
+			if tt.wantErr != nil {
+				tt.wantErr = errors.New("unable to import " + path + ": " + tt.wantErr.Error())
+			}
+			h.AssertError(t, err, tt.wantErr)
+			if err == nil {
+				h.AssertEqual(t, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMergeDevices(t *testing.T) {
+	devices := map[string]miio.DeviceCfg{
+		"Purifier": {ID: 123456789, Address: "192.168.1.10", Token: "ffffffffffffffffffffffffffffffff", Topic: "purifier"},
+		"Lamp":     {Address: "192.168.1.12", Token: testToken},
+		"Heater":   {ID: 0x01234568, Token: testToken},
+	}
+	added, updated := MergeDevices(devices, []ImportedDevice{
+		{Name: "Air Purifier", ID: 123456789, Address: "192.168.1.11", Token: testToken, Model: "zhimi.airpurifier.mb3"},
+		{Name: "Ceiling Lamp", ID: 0x01234567, Address: "192.168.1.12", Token: testToken},
+		{Name: "Heater", ID: 0x01234568, Token: testToken},
+		{Name: "Lamp", ID: 0x01234569, Address: "192.168.1.13", Token: testToken},
+	})
+	h.AssertEqual(t, added, []string{"Lamp 01234569"})
+	h.AssertEqual(t, updated, []string{"Lamp", "Purifier"})
+	h.AssertEqual(t, devices, map[string]miio.DeviceCfg{
+		"Purifier":      {ID: 123456789, Address: "192.168.1.11", Token: testToken, Topic: "purifier", Model: "zhimi.airpurifier.mb3"},
+		"Lamp":          {ID: 0x01234567, Address: "192.168.1.12", Token: testToken},
+		"Heater":        {ID: 0x01234568, Token: testToken},
+		"Lamp 01234569": {ID: 0x01234569, Address: "192.168.1.13", Token: testToken},
+	})
+}
+
+func TestMergeDevices_sameName(t *testing.T) {
+	tests := []struct {
+		name     string
+		devices  map[string]miio.DeviceCfg
+		imported []ImportedDevice
+		want     map[string]miio.DeviceCfg
+	}{
+		{
+			name: "Without ID",
+			imported: []ImportedDevice{
+				{Name: "Lamp", Address: "192.168.1.12", Token: testToken},
+				{Name: "Lamp", Address: "192.168.1.13", Token: testToken},
+			},
+			want: map[string]miio.DeviceCfg{
+				"Lamp":              {Address: "192.168.1.12", Token: testToken},
+				"Lamp 192.168.1.13": {Address: "192.168.1.13", Token: testToken},
+			},
+		},
+		{
+			name: "Suffix taken",
+			devices: map[string]miio.DeviceCfg{
+				"Lamp":              {Address: "192.168.1.12", Token: testToken},
+				"Lamp 192.168.1.13": {ID: 0x01234567, Token: testToken},
+			},
+			imported: []ImportedDevice{{Name: "Lamp", Address: "192.168.1.13", Token: testToken}},
+			want: map[string]miio.DeviceCfg{
+				"Lamp":                  {Address: "192.168.1.12", Token: testToken},
+				"Lamp 192.168.1.13":     {ID: 0x01234567, Token: testToken},
+				"Lamp 192.168.1.13 (2)": {Address: "192.168.1.13", Token: testToken},
+			},
+		},
+		{
+			name: "Same ID in several entries",
+			devices: map[string]miio.DeviceCfg{
+				"Lamp B": {ID: 0x01234567, Token: testToken},
+				"Lamp A": {ID: 0x01234567, Token: testToken},
+			},
+			imported: []ImportedDevice{{Name: "Lamp", ID: 0x01234567, Address: "192.168.1.12", Token: testToken}},
+			want: map[string]miio.DeviceCfg{
+				"Lamp A": {ID: 0x01234567, Address: "192.168.1.12", Token: testToken},
+				"Lamp B": {ID: 0x01234567, Token: testToken},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			devices := tt.devices
+			if devices == nil {
+				devices = map[string]miio.DeviceCfg{}
+			}
+			MergeDevices(devices, tt.imported)
+			h.AssertEqual(t, devices, tt.want)
+		})
+	}
+}
+
+func TestUpdateDevicesFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yml")
+	h.AssertError(t, ioutil.WriteFile(path, []byte(`# miio2mqtt configuration
+Mqtt:
+  BrokerURL: tcp://localhost:1883
+Devices:
+  Lamp:
+    Address: 192.168.1.12 # living room
+    Topic: lamp
+
+# polling
+PollInterval:  5s # aligned
+`), 0640), nil)
+	devices, err := ReadDevices(path)
+	h.AssertError(t, err, nil)
+	MergeDevices(devices, []ImportedDevice{
+		{Name: "Lamp", ID: 0x01234567, Address: "192.168.1.12", Token: testToken},
+		{Name: "Air Purifier", ID: 0x075bcd15, Address: "192.168.1.11", Token: testToken, Model: "zhimi.airpurifier.mb3"},
+	})
+	h.AssertError(t, UpdateDevicesFile(path, devices), nil)
+	data, err := ioutil.ReadFile(path)
+	h.AssertError(t, err, nil)
+	h.AssertEqual(t, string(data), `# miio2mqtt configuration
+Mqtt:
+  BrokerURL: tcp://localhost:1883
+Devices:
+  Lamp:
+    Address: 192.168.1.12 # living room
+    Topic: lamp
+    ID: 0x01234567
+    Token: 0102030405060708090a0b0c0d0e0f10
+  Air Purifier:
+    ID: 0x075bcd15
+    Address: 192.168.1.11
+    Token: 0102030405060708090a0b0c0d0e0f10
+    Model: zhimi.airpurifier.mb3
+
+# polling
+PollInterval:  5s # aligned
+`)
+	info, err := os.Stat(path)
+	h.AssertError(t, err, nil)
+	h.AssertEqual(t, info.Mode().Perm(), os.FileMode(0640))
+	config := New()
+	config.Mqtt.BrokerURL = "tcp://localhost:1883"
+	h.AssertError(t, config.Load(path), nil)
+	h.AssertEqual(t, config.Devices["Air Purifier"].ID, uint32(123456789))
+
+	devices, err = ReadDevices(filepath.Join(t.TempDir(), "missing.yml"))
+	h.AssertError(t, err, nil)
+	h.AssertEqual(t, devices, map[string]miio.DeviceCfg{})
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/hex"
 	"regexp"
+	"strings"
 
 	log "github.com/go-pkgz/lgr"
 	"github.com/sergi/go-diff/diffmatchpatch"
@@ -67,6 +68,13 @@ func StripJSONQuotes(data string) string {
 	return reJSONKey.ReplaceAllString(data, "$1:")
 }
 
+var reSlugInvalid = regexp.MustCompile(`[^a-z0-9]+`)
+
+// Slug converts the name into a lowercase identifier suitable for MQTT topics
+func Slug(name string) string {
+	return strings.Trim(reSlugInvalid.ReplaceAllString(strings.ToLower(name), "_"), "_")
+}
+
 func DiffStrings(old, new, color string) string {
 	dmp := diffmatchpatch.New()
 	diffs := dmp.DiffMain(old, new, false)
@@ -173,3 +173,21 @@ func Test_InitTestLog(t *testing.T) {
 	log.Print("[ERROR] Foo bar")
 	AssertEqual(t, logger.Message, "[ERROR] Foo bar\n")
 }
+
+func Test_Slug(t *testing.T) {
+	tests := []struct {
+		arg  string
+		want string
+	}{
+		{arg: "", want: ""},
+		{arg: "AirMonitor", want: "airmonitor"},
+		{arg: "Living Room / Desk Lamp", want: "living_room_desk_lamp"},
+		{arg: "  lamp-2 ", want: "lamp_2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.arg, func(t *testing.T) {
+			got := Slug(tt.arg)
+			AssertEqual(t, got, tt.want)
+		})
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/eip/miio2mqtt/config"
+)
+
+// importDevices merges devices and tokens from exports of other tools into the configuration file
+func importDevices(path string, files []string) error {
+	if len(files) == 0 {
+		return errors.New("usage: miio2mqtt import <export file>...")
+	}
+	configured, err := config.ReadDevices(path)
+	if err != nil {
+		return err
+	}
+	imported := []config.ImportedDevice{}
+	for _, file := range files {
+		devices, err := config.ImportDevices(file)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s: %d devices with tokens found\n", file, len(devices))
+		imported = append(imported, devices...)
+	}
+	added, updated := config.MergeDevices(configured, imported)
+	if len(added)+len(updated) == 0 {
+		fmt.Println("configuration is up to date")
+		return nil
+	}
+	if err := config.UpdateDevicesFile(path, configured); err != nil {
+		return err
+	}
+	if len(added) > 0 {
+		fmt.Printf("added: %s\n", strings.Join(added, ", "))
+	}
+	if len(updated) > 0 {
+		fmt.Printf("updated: %s\n", strings.Join(updated, ", "))
+	}
+	return nil
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"os/signal"
@@ -27,6 +28,13 @@ func init() {
 
 func main() {
 	setupLog(false)
+	if len(os.Args) > 1 && os.Args[1] == "import" {
+		if err := importDevices("./config.yml", os.Args[2:]); err != nil {
+			log.Printf("[ERROR] import: %v", err)
+			os.Exit(1)
+		}
+		return
+	}
 	config := config.New()
 	if err := config.Load("./config.yml"); err != nil {
 		log.Printf("[ERROR] configuration: %v", err)
@@ -59,16 +67,37 @@ func run(ctx context.Context, config *config.Config) error {
 	wg := sync.WaitGroup{}
 	defer wg.Wait()
 
-	transport := net.NewTransport(config)
+	transport, err := newTransport(config)
+	if err != nil {
+		return err
+	}
 	poller := net.NewPoller(config, transport, devices)
-	broker := mqtt.NewClient(config)
+	broker, err := mqtt.NewClient(config)
+	if err != nil {
+		return err
+	}
 	defer broker.Disconnect()
+	if err := broker.Connect(); err != nil {
+		log.Printf("[WARN] unable to connect to MQTT broker: %v", err)
+	}
 	wg.Add(1)
-	go func() { defer wg.Done(); publishUpdates(ctx, broker, poller.Updates()) }()
+	go func() { defer wg.Done(); publishUpdates(ctx, broker, poller) }()
+	wake := make(chan struct{}, 1)
+	if err := broker.SubscribeCommands(devices, commandHandler(config, wake)); err != nil {
+		log.Printf("[WARN] unable to subscribe to MQTT command topics: %v", err)
+	}
+	if err := broker.SubscribeRPC(devices, rpcHandler(poller, wake)); err != nil {
+		log.Printf("[WARN] unable to subscribe to MQTT RPC topics: %v", err)
+	}
+	if err := broker.SubscribeDiscovery(devices); err != nil {
+		log.Printf("[WARN] unable to subscribe to MQTT discovery topics: %v", err)
+	}
+	poller.AnnounceRestored()
+	savedAt := time.Now()
 
-	deviceUpdateTimeout := 2 * miio.TimeStamp(config.PollInterval/time.Second)
+	scheduler := miio.NewScheduler(config.PollInterval, config.PollAheadTime, config.Models)
 	for {
-		next := nextTime(time.Now(), config.PollInterval, config.PollAheadTime)
+		next := scheduler.Next(time.Now(), devices)
 		if firstLoop {
 			startIn := next.Sub(time.Now()) / 100 / time.Millisecond * 100 * time.Millisecond
 			if startIn > 1550*time.Millisecond {
@@ -77,20 +106,28 @@ func run(ctx context.Context, config *config.Config) error {
 			fmt.Println("")
 			firstLoop = false
 		}
+		poll := miio.AnyDevice
 		select {
 		case <-ctx.Done():
 			log.Printf("[INFO] max queue lengths: packets = %d, updates = %d", config.ChanStat[0], config.ChanStat[1])
+			stats := transport.Stats()
+			log.Printf("[INFO] packets received: %d, truncated: %d", stats.Received, stats.Truncated)
+			wg.Wait() // publishUpdates and the transport may still use the devices
+			saveState(config)
 			return nil
+		case <-wake: // poll devices with pending commands only
+			poll = miio.DeviceHasCommands
 		case <-time.After(next.Sub(time.Now())):
+			devices.SetStage(miio.Undiscovered, scheduler.Outdated())
+			poll = scheduler.Schedule(time.Now(), devices)
+			poller.UpdateAvailability()
 		}
-		devices.SetStage(miio.Undiscovered, miio.DeviceOutdated(deviceUpdateTimeout))
-		devices.SetStage(miio.Valid, miio.DeviceUpdated)
 		err := transport.Start(ctx, &wg)
 		if err != nil {
 			log.Printf("[WARN] unable to listen for UDP packets: %v", err)
 			continue
 		}
-		err = poller.PollDevices(ctx)
+		err = poller.PollDevices(ctx, poll)
 		transport.Stop()
 		if err != nil {
 			log.Printf("[WARN] unable to update all devices: %v", err)
@@ -98,10 +135,27 @@ func run(ctx context.Context, config *config.Config) error {
 		} else {
 			log.Print("[DEBUG] all devices were updated successfully")
 		}
+		if time.Since(savedAt) >= config.StateInterval {
+			saveState(config)
+			savedAt = time.Now()
+		}
 	}
 }
 
+// newTransport returns the replay transport if the capture file to replay is configured,
+// the UDP one of every configured interface otherwise
+func newTransport(config *config.Config) (net.Transport, error) {
+	if len(config.Replay) > 0 {
+		return net.NewReplayTransport(config, config.Replay)
+	}
+	if len(config.Interfaces) > 1 {
+		return net.NewMultiTransport(config), nil
+	}
+	return net.NewTransport(config), nil
+}
+
 func initDevices(config *config.Config) {
+	states := loadState(config)
 	idx := 0
 	for n, dc := range config.Devices {
 		idx++
@@ -115,37 +169,132 @@ func initDevices(config *config.Config) {
 			log.Printf("[WARN] invalid device configuration: %s", n)
 			continue
 		}
+		device := miio.NewDevice(dc, n)
+		if s, ok := states[n]; ok {
+			if device.RestoreState(s) {
+				id = device.ID // identified devices are looked up by ID
+				log.Printf("[DEBUG] restored %s: %08x (%s), model %s", n, device.ID, device.Address, device.Model())
+			} else {
+				log.Printf("[INFO] saved state of %s does not match its configuration", n)
+			}
+		}
 		if d, exists := devices[id]; exists {
 			log.Printf("[WARN] duplicate device: %s (%08x) >>> %s", n, id, d.Name)
 			continue
 		}
-		devices[id] = miio.NewDevice(dc, n)
+		devices[id] = device
+	}
+}
+
+// loadState reads the saved device state, if the state file is configured
+func loadState(config *config.Config) map[string]miio.DeviceState {
+	if len(config.StateFile) == 0 {
+		return nil
+	}
+	states, err := miio.LoadState(config.StateFile)
+	if err != nil {
+		log.Printf("[WARN] unable to load device state: %v", err)
+		return nil
+	}
+	return states
+}
+
+// saveState writes the device state, if the state file is configured
+func saveState(config *config.Config) {
+	if len(config.StateFile) == 0 {
+		return
+	}
+	if err := miio.SaveState(config.StateFile, devices); err != nil {
+		log.Printf("[WARN] unable to save device state: %v", err)
+		return
+	}
+	log.Print("[DEBUG] device state saved")
+}
+
+func commandHandler(config *config.Config, wake chan<- struct{}) mqtt.CommandHandler {
+	return func(d *miio.Device, payload []byte) {
+		if !miio.DeviceValid(d) {
+			log.Printf("[WARN] unable to send command to %s: device is not identified yet", d.Name)
+			return
+		}
+		requests, err := config.Models.SetProp(d.Model(), payload)
+		if err != nil {
+			log.Printf("[WARN] invalid command for %s: %v", d.Name, err)
+			return
+		}
+		for _, r := range requests {
+			d.PushCommand(miio.NewCommand(r))
+		}
+		wakeUp(d, wake)
+	}
+}
+
+func rpcHandler(poller *net.Poller, wake chan<- struct{}) mqtt.CommandHandler {
+	return func(d *miio.Device, payload []byte) {
+		cmd, err := miio.NewRPCCommand(payload)
+		if err != nil {
+			log.Printf("[WARN] invalid RPC request for %s: %v", d.Name, err)
+			poller.Respond(d, cmd.ErrorResponse(err))
+			return
+		}
+		if !miio.DeviceValid(d) {
+			log.Printf("[WARN] unable to send RPC request to %s: device is not identified yet", d.Name)
+			poller.Respond(d, cmd.ErrorResponse(errors.New("device is not identified yet")))
+			return
+		}
+		d.PushCommand(cmd)
+		wakeUp(d, wake)
+	}
+}
+
+// wakeUp re-polls the device to send queued commands and publish the new state
+func wakeUp(d *miio.Device, wake chan<- struct{}) {
+	if miio.DeviceUpdated(d) {
+		d.SetStage(miio.Valid)
+	}
+	select {
+	case wake <- struct{}{}:
+	default:
 	}
 }
 
-func publishUpdates(ctx context.Context, client *mqtt.Client, updates <-chan *miio.Device) {
+func publishUpdates(ctx context.Context, client *mqtt.Client, poller *net.Poller) {
 	// defer client.Disconnect()
 	for {
 		select {
 		case <-ctx.Done():
 			log.Print("[DEBUG] stop processing mqtt messages")
 			return
-		case device := <-updates:
+		case device := <-poller.Updates():
 			if err := client.Publish(device); err != nil {
 				log.Printf("[WARN] unable to publish to MQTT broker: %v", err)
 			}
+		case device := <-poller.Availability():
+			if err := client.PublishAvailability(device); err != nil {
+				log.Printf("[WARN] unable to publish to MQTT broker: %v", err)
+			}
+		case device := <-poller.Identified():
+			if err := client.PublishDiscovery(device); err != nil {
+				log.Printf("[WARN] unable to publish to MQTT broker: %v", err)
+			}
+		case device := <-poller.Errors():
+			if err := client.PublishError(device); err != nil {
+				log.Printf("[WARN] unable to publish to MQTT broker: %v", err)
+			}
+		case token := <-poller.Tokens():
+			if err := client.PublishToken(token); err != nil {
+				log.Printf("[WARN] unable to publish to MQTT broker: %v", err)
+			}
+		case resp := <-poller.Responses():
+			if err := client.PublishResponse(resp.Device, resp.Data); err != nil {
+				log.Printf("[WARN] unable to publish to MQTT broker: %v", err)
+			}
+		case state := <-client.StateChanges():
+			log.Printf("[INFO] MQTT broker %s", state)
 		}
 	}
 }
 
-func nextTime(now time.Time, interval time.Duration, aheadTime time.Duration) time.Time {
-	result := now.Add(interval).Truncate(interval).Add(-aheadTime)
-	if result.Before(now) {
-		return result.Add(interval)
-	}
-	return result
-}
-
 func setupLog(dbg bool) {
 	stripDate := log.Mapper{TimeFunc: func(s string) string { return s[11:] }}
 	if dbg {
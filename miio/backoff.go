@@ -0,0 +1,65 @@
+package miio
+
+// SkipPoll checks if the unreachable device rests during its scheduled poll, the rest is counted down,
+// so it should be called once per poll interval of the device
+func (d *Device) SkipPoll() bool {
+	d.Lock()
+	defer d.Unlock()
+	if d.skipPolls > 0 {
+		d.skipPolls--
+		return true
+	}
+	return false
+}
+
+// Resting checks if the unreachable device skips its polls, polls out of its schedule should skip it too
+func (d *Device) Resting() bool {
+	d.Lock()
+	defer d.Unlock()
+	return d.skipPolls > 0
+}
+
+// PollFailed counts the poll the device did not reply to, the next polls it skips double with every failure;
+// after quarantineAfter failures the device is probed once per probeEvery of its polls, 0 disables the backoff.
+// It reports whether the device was quarantined just now
+func (d *Device) PollFailed(quarantineAfter, probeEvery int) bool {
+	d.Lock()
+	defer d.Unlock()
+	if quarantineAfter <= 0 {
+		return false
+	}
+	d.failures++
+	if d.failures < quarantineAfter {
+		d.skipPolls = 1<<(d.failures-1) - 1
+		return false
+	}
+	d.skipPolls = probeEvery - 1
+	quarantined := !d.quarantined
+	d.quarantined = true
+	return quarantined
+}
+
+// PollSucceeded resets the backoff of the device and returns the number of polls it failed before
+// and whether it was quarantined
+func (d *Device) PollSucceeded() (int, bool) {
+	d.Lock()
+	defer d.Unlock()
+	failures, quarantined := d.failures, d.quarantined
+	d.failures = 0
+	d.skipPolls = 0
+	d.quarantined = false
+	return failures, quarantined
+}
+
+// Failures returns the number of consecutive polls the device did not reply to
+func (d *Device) Failures() int {
+	d.Lock()
+	defer d.Unlock()
+	return d.failures
+}
+
+func (d *Device) Quarantined() bool {
+	d.Lock()
+	defer d.Unlock()
+	return d.quarantined
+}
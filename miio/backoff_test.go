@@ -0,0 +1,46 @@
+package miio
+
+import (
+	"testing"
+
+	h "github.com/eip/miio2mqtt/helpers"
+)
+
+func TestDevice_PollFailed(t *testing.T) {
+	d := &Device{}
+	skipped := []int{}
+	quarantinedAt := 0
+	for poll := 1; poll <= 60; poll++ {
+		if d.SkipPoll() {
+			continue
+		}
+		skipped = append(skipped, poll)
+		if d.PollFailed(5, 10) {
+			h.AssertEqual(t, quarantinedAt, 0)
+			quarantinedAt = poll
+		}
+	}
+	h.AssertEqual(t, skipped, []int{1, 2, 4, 8, 16, 26, 36, 46, 56})
+	h.AssertEqual(t, quarantinedAt, 16)
+	h.AssertEqual(t, d.Failures(), 9)
+	h.AssertEqual(t, d.Quarantined(), true)
+
+	failures, quarantined := d.PollSucceeded()
+	h.AssertEqual(t, failures, 9)
+	h.AssertEqual(t, quarantined, true)
+	h.AssertEqual(t, d.Failures(), 0)
+	h.AssertEqual(t, d.Quarantined(), false)
+	h.AssertEqual(t, d.SkipPoll(), false)
+}
+
+func TestDevice_PollFailed_disabled(t *testing.T) {
+	d := &Device{}
+	for poll := 1; poll <= 10; poll++ {
+		h.AssertEqual(t, d.SkipPoll(), false)
+		h.AssertEqual(t, d.PollFailed(0, 10), false)
+	}
+	h.AssertEqual(t, d.Failures(), 0)
+	failures, quarantined := d.PollSucceeded()
+	h.AssertEqual(t, failures, 0)
+	h.AssertEqual(t, quarantined, false)
+}
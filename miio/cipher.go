@@ -0,0 +1,86 @@
+package miio
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+)
+
+// Cipher is the AES-128-CBC state derived from the device token, it is safe for concurrent use
+type Cipher struct {
+	token [16]byte
+	iv    [aes.BlockSize]byte
+	block cipher.Block
+}
+
+// NewCipher derives the key and IV from the token: key = md5(token), iv = md5(key + token)
+func NewCipher(token []byte) (*Cipher, error) {
+	if len(token) != 16 {
+		return nil, errInvalidTokenLength
+	}
+	c := Cipher{}
+	copy(c.token[:], token)
+	key := md5.Sum(c.token[:])
+	seed := [32]byte{}
+	copy(seed[:16], key[:])
+	copy(seed[16:], c.token[:])
+	c.iv = md5.Sum(seed[:])
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	c.block = block
+	return &c, nil
+}
+
+// cipherFor returns the cipher of the token or nil for the empty one
+func cipherFor(token []byte) (*Cipher, error) {
+	if len(token) == 0 {
+		return nil, nil
+	}
+	return NewCipher(token)
+}
+
+// Token returns the token the cipher is derived from
+func (c *Cipher) Token() []byte {
+	return c.token[:]
+}
+
+// encrypt pads src and encrypts it into dst, which should be at least encryptedLen(len(src)) long
+func (c *Cipher) encrypt(dst, src []byte) int {
+	n := copy(dst, src)
+	padded, _ := pkcs7pad(dst[:n], aes.BlockSize)
+	prev := c.iv[:]
+	for i := 0; i < len(padded); i += aes.BlockSize {
+		b := padded[i : i+aes.BlockSize]
+		for j := range b {
+			b[j] ^= prev[j]
+		}
+		c.block.Encrypt(b, b)
+		prev = b
+	}
+	return len(padded)
+}
+
+// decrypt decrypts data in place and returns it without padding
+func (c *Cipher) decrypt(data []byte) ([]byte, error) {
+	if len(data) == 0 || len(data)%aes.BlockSize != 0 {
+		return nil, errInvalidDataLength
+	}
+	prev, next := c.iv, [aes.BlockSize]byte{}
+	for i := 0; i < len(data); i += aes.BlockSize {
+		b := data[i : i+aes.BlockSize]
+		copy(next[:], b)
+		c.block.Decrypt(b, b)
+		for j := range b {
+			b[j] ^= prev[j]
+		}
+		prev = next
+	}
+	return pkcs7strip(data, aes.BlockSize)
+}
+
+// encryptedLen returns the length of the padded data
+func encryptedLen(n int) int {
+	return n + aes.BlockSize - n%aes.BlockSize
+}
@@ -0,0 +1,67 @@
+package miio
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Command represents a request sent to the device on behalf of an MQTT client
+type Command struct {
+	Request []byte
+	RPC     bool            // reply should be sent back to the caller
+	ReplyID json.RawMessage // caller's correlation id
+}
+
+type rpcRequest struct {
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+	ID     json.RawMessage `json:"id"`
+}
+
+// NewCommand creates a command for the request built by Models.SetProp
+func NewCommand(request string) *Command {
+	return &Command{Request: []byte(request)}
+}
+
+// NewRPCCommand creates a command from the raw JSON-RPC request like {"method":"get_prop","params":["power"],"id":"abc"}
+func NewRPCCommand(payload []byte) (*Command, error) {
+	req := rpcRequest{}
+	if err := json.Unmarshal(payload, &req); err != nil {
+		return &Command{RPC: true}, fmt.Errorf("invalid RPC request: %v", err)
+	}
+	cmd := &Command{RPC: true, ReplyID: req.ID}
+	if len(req.Method) == 0 {
+		return cmd, errors.New("invalid RPC request: empty method")
+	}
+	if len(req.Params) == 0 || string(req.Params) == "null" {
+		req.Params = json.RawMessage("[]")
+	}
+	method, _ := json.Marshal(req.Method)
+	cmd.Request = []byte(fmt.Sprintf(`{"method":%s,"params":%s,"id":#}`, method, req.Params))
+	return cmd, nil
+}
+
+// Response builds the RPC response from the device reply replacing the reply id with the caller's one
+func (c *Command) Response(reply []byte) []byte {
+	data := map[string]json.RawMessage{}
+	if err := json.Unmarshal(reply, &data); err != nil {
+		return c.ErrorResponse(fmt.Errorf("invalid device reply: %s", reply))
+	}
+	delete(data, "id")
+	if len(c.ReplyID) > 0 {
+		data["id"] = c.ReplyID
+	}
+	result, _ := json.Marshal(data)
+	return result
+}
+
+// ErrorResponse builds the RPC response for the command failed to be executed
+func (c *Command) ErrorResponse(err error) []byte {
+	data := map[string]interface{}{"error": map[string]interface{}{"message": err.Error()}}
+	if len(c.ReplyID) > 0 {
+		data["id"] = c.ReplyID
+	}
+	result, _ := json.Marshal(data)
+	return result
+}
@@ -0,0 +1,98 @@
+package miio
+
+import (
+	"errors"
+	"testing"
+
+	h "github.com/eip/miio2mqtt/helpers"
+)
+
+func Test_NewRPCCommand(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+		want    *Command
+		err     error
+	}{
+		{
+			name:    "Invalid JSON",
+			payload: "foo",
+			want:    &Command{RPC: true},
+			err:     errors.New("invalid RPC request: invalid character 'o' in literal false (expecting 'a')"),
+		},
+		{
+			name:    "Empty method",
+			payload: `{"params":[],"id":"abc"}`,
+			want:    &Command{RPC: true, ReplyID: []byte(`"abc"`)},
+			err:     errors.New("invalid RPC request: empty method"),
+		},
+		{
+			name:    "No params",
+			payload: `{"method":"miIO.info","id":"abc"}`,
+			want:    &Command{Request: []byte(`{"method":"miIO.info","params":[],"id":#}`), RPC: true, ReplyID: []byte(`"abc"`)},
+		},
+		{
+			name:    "Array params",
+			payload: `{"method":"get_prop","params":["power","bright"],"id":42}`,
+			want:    &Command{Request: []byte(`{"method":"get_prop","params":["power","bright"],"id":#}`), RPC: true, ReplyID: []byte(`42`)},
+		},
+		{
+			name:    "Object params without id",
+			payload: `{"method":"action","params":{"siid":2,"aiid":1,"in":[]}}`,
+			want:    &Command{Request: []byte(`{"method":"action","params":{"siid":2,"aiid":1,"in":[]},"id":#}`), RPC: true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NewRPCCommand([]byte(tt.payload))
+			h.AssertError(t, err, tt.err)
+			h.AssertEqual(t, got, tt.want)
+		})
+	}
+}
+
+func TestCommand_Response(t *testing.T) {
+	tests := []struct {
+		name  string
+		cmd   *Command
+		reply string
+		want  string
+	}{
+		{
+			name:  "Result",
+			cmd:   &Command{RPC: true, ReplyID: []byte(`"abc"`)},
+			reply: `{"result":["on",40],"id":123}`,
+			want:  `{"id":"abc","result":["on",40]}`,
+		},
+		{
+			name:  "Error",
+			cmd:   &Command{RPC: true, ReplyID: []byte(`42`)},
+			reply: `{"error":{"code":-5001,"message":"invalid_arg"},"id":123}`,
+			want:  `{"error":{"code":-5001,"message":"invalid_arg"},"id":42}`,
+		},
+		{
+			name:  "No caller id",
+			cmd:   &Command{RPC: true},
+			reply: `{"result":["ok"],"id":123}`,
+			want:  `{"result":["ok"]}`,
+		},
+		{
+			name:  "Invalid reply",
+			cmd:   &Command{RPC: true, ReplyID: []byte(`"abc"`)},
+			reply: `foo`,
+			want:  `{"error":{"message":"invalid device reply: foo"},"id":"abc"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.cmd.Response([]byte(tt.reply))
+			h.AssertEqual(t, string(got), tt.want)
+		})
+	}
+}
+
+func TestCommand_ErrorResponse(t *testing.T) {
+	cmd := &Command{RPC: true, ReplyID: []byte(`"abc"`)}
+	got := cmd.ErrorResponse(errors.New("timeout"))
+	h.AssertEqual(t, string(got), `{"error":{"message":"timeout"},"id":"abc"}`)
+}
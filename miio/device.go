@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"regexp"
 	"sync"
+	"time"
 
 	log "github.com/go-pkgz/lgr"
 )
@@ -14,10 +15,16 @@ var reID = regexp.MustCompile(`("id":\s?)#+`)
 
 // DeviceCfg represents a miIO configurable device properties
 type DeviceCfg struct {
-	Address string `yaml:"Address"`
-	ID      uint32 `yaml:"ID"`
-	Topic   string `yaml:"Topic"`
-	Token   string `yaml:"Token"`
+	Address      string        `yaml:"Address"` // hello packets are sent to the address instead of broadcast if set
+	Port         int           `yaml:"Port"`    // overrides MiioPort
+	ID           uint32        `yaml:"ID"`
+	Topic        string        `yaml:"Topic"` // used as is, generated from the device name under BaseTopic if empty
+	Token        string        `yaml:"Token"`
+	QoS          *byte         `yaml:"QoS"`          // overrides MQTT QoS
+	Retain       *bool         `yaml:"Retain"`       // overrides MQTT Retain
+	BaseTopic    string        `yaml:"BaseTopic"`    // overrides MQTT BaseTopic of the generated topic
+	Model        string        `yaml:"Model"`        // informational, filled by the token import
+	PollInterval time.Duration `yaml:"PollInterval"` // overrides PollInterval of the model and the default one
 }
 
 type DeviceStage int32
@@ -48,21 +55,42 @@ const (
 type Device struct {
 	sync.Mutex
 	DeviceCfg
-	Name             string
-	model            string
-	token            [16]byte
-	properties       string
-	timeShift        TimeStamp
-	stage            DeviceStage
-	finalStage       DeviceStage
-	requestID        uint32
-	updatedAt        TimeStamp
-	stateChangedAt   TimeStamp
-	statePublishedAt TimeStamp
+	Name              string
+	model             string
+	token             [16]byte
+	cipher            *Cipher // derived from token on the first use
+	properties        string
+	timeShift         TimeStamp
+	stage             DeviceStage
+	finalStage        DeviceStage
+	requestID         uint32
+	commands          []*Command
+	inflight          map[uint32]*SentRequest
+	answered          []uint32 // recently answered request IDs
+	latency           time.Duration
+	batches           []*Reply // received get_prop batches
+	lastError         *DeviceError
+	failed            bool // error reply received during the current poll
+	failures          int  // consecutive polls without any reply
+	skipPolls         int  // polls left to skip because of the backoff
+	quarantined       bool // failed too many polls, probed rarely
+	restored          bool // time shift restored from the saved state, not confirmed by a reply yet
+	available         bool
+	availabilityKnown bool
+	updatedAt         TimeStamp
+	stateChangedAt    TimeStamp
+	statePublishedAt  TimeStamp
 }
 
 type Devices map[uint32]*Device
 
+// DiscoveredToken is the token leaked by the device in the hello reply
+type DiscoveredToken struct {
+	ID      uint32
+	Address string
+	Token   []byte
+}
+
 type CheckDevice func(d *Device) bool
 
 func NewDevice(cfg DeviceCfg, name string) *Device {
@@ -78,25 +106,130 @@ func NewDevice(cfg DeviceCfg, name string) *Device {
 }
 
 func (d *Device) Request(data []byte) (*Packet, []byte, error) {
+	pkt, raw, _, err := d.request(data)
+	return pkt, raw, err
+}
+
+func (d *Device) request(data []byte) (*Packet, []byte, uint32, error) {
 	timeStamp, err := d.Now()
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, 0, err
 	}
 	d.Lock()
 	defer d.Unlock()
 	d.requestID++
-	return deviceRequest(data, d.ID, d.requestID, timeStamp, d.token[:])
+	c, err := d.cipherLocked()
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	pkt, raw, err := deviceRequest(data, d.ID, d.requestID, timeStamp, c)
+	return pkt, raw, d.requestID, err
 }
 
-func deviceRequest(data []byte, deviceID uint32, requestID uint32, timeStamp TimeStamp, token []byte) (*Packet, []byte, error) {
+func deviceRequest(data []byte, deviceID uint32, requestID uint32, timeStamp TimeStamp, c *Cipher) (*Packet, []byte, error) {
 	pkt := NewPacket(deviceID, timeStamp, reID.ReplaceAll(data, []byte(fmt.Sprintf("${1}%d", requestID))))
-	raw, err := pkt.Encode(token)
+	raw, err := pkt.MarshalTo(nil, c)
 	if err != nil {
 		return pkt, nil, err
 	}
 	return pkt, raw, nil
 }
 
+// Decode validates and decodes the device reply, the payload is decrypted in place
+func (d *Device) Decode(data []byte) (*Packet, error) {
+	d.Lock()
+	c, err := d.cipherLocked()
+	d.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	p := Packet{}
+	if err := p.UnmarshalFrom(data, c); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// cipherLocked returns the cipher of the device token, it is created once on the first use
+func (d *Device) cipherLocked() (*Cipher, error) {
+	if d.cipher != nil {
+		return d.cipher, nil
+	}
+	c, err := NewCipher(d.token[:])
+	if err != nil {
+		return nil, err
+	}
+	d.cipher = c
+	return c, nil
+}
+
+// PushCommand queues the command to be sent with the next device poll
+func (d *Device) PushCommand(cmd *Command) {
+	d.Lock()
+	d.commands = append(d.commands, cmd)
+	d.Unlock()
+}
+
+// PopCommands returns all queued commands and clears the queue
+func (d *Device) PopCommands() []*Command {
+	d.Lock()
+	defer d.Unlock()
+	commands := d.commands
+	d.commands = nil
+	return commands
+}
+
+// HasCommands checks if any command is queued to be sent
+func (d *Device) HasCommands() bool {
+	d.Lock()
+	defer d.Unlock()
+	return len(d.commands) > 0
+}
+
+// MissingBatches returns indexes of get_prop batches which replies were not received yet
+func (d *Device) MissingBatches(count int) []int {
+	d.Lock()
+	defer d.Unlock()
+	if len(d.batches) != count {
+		d.batches = make([]*Reply, count)
+	}
+	result := []int{}
+	for i, b := range d.batches {
+		if b == nil {
+			result = append(result, i)
+		}
+	}
+	return result
+}
+
+// AddBatch stores the get_prop batch reply and returns all batches merged in order once the last one is received,
+// the reply to a batch unknown to the current layout (e.g. a late one of the previous poll) is ignored
+func (d *Device) AddBatch(index int, reply Reply) (Reply, bool) {
+	d.Lock()
+	defer d.Unlock()
+	if index < 0 || index >= len(d.batches) {
+		return Reply{}, false
+	}
+	d.batches[index] = &reply
+	result := Reply{Type: reply.Type, ID: reply.ID}
+	for _, b := range d.batches {
+		if b == nil {
+			return Reply{}, false
+		}
+		result.Props = append(result.Props, b.Props...)
+		result.Results = append(result.Results, b.Results...)
+	}
+	d.batches = nil
+	return result, true
+}
+
+// ResetBatches forgets get_prop batches received so far
+func (d *Device) ResetBatches() {
+	d.Lock()
+	d.batches = nil
+	d.Unlock()
+}
+
 func (d *Device) Model() string {
 	d.Lock()
 	defer d.Unlock()
@@ -186,6 +319,13 @@ func (d *Device) Now() (TimeStamp, error) {
 	return d.TimeStamp(Now())
 }
 
+// TimeShiftKnown checks if the device time was learned from the hello reply or restored
+func (d *Device) TimeShiftKnown() bool {
+	d.Lock()
+	defer d.Unlock()
+	return d.timeShift != 0
+}
+
 func (d *Device) SetTimeShift(now TimeStamp, replyTS TimeStamp) error {
 	if replyTS >= now {
 		return errors.New("device time cannot be in future")
@@ -197,6 +337,56 @@ func (d *Device) SetTimeShift(now TimeStamp, replyTS TimeStamp) error {
 	return nil
 }
 
+func (d *Device) Available() bool {
+	d.Lock()
+	defer d.Unlock()
+	return d.available
+}
+
+// SetAvailable updates the device availability and reports whether it was changed
+func (d *Device) SetAvailable(available bool) bool {
+	d.Lock()
+	defer d.Unlock()
+	changed := !d.availabilityKnown || d.available != available
+	d.available = available
+	d.availabilityKnown = true
+	return changed
+}
+
+// LastError returns the last error replied by the device, nil if the device was updated since then
+func (d *Device) LastError() *DeviceError {
+	d.Lock()
+	defer d.Unlock()
+	return d.lastError
+}
+
+// SetError updates the last device error and reports whether it was changed,
+// not nil error also marks the device failed until the next poll
+func (d *Device) SetError(err *DeviceError) bool {
+	d.Lock()
+	defer d.Unlock()
+	changed := (d.lastError == nil) != (err == nil) || err != nil && *err != *d.lastError
+	d.lastError = err
+	if err != nil {
+		d.failed = true
+	}
+	return changed
+}
+
+// Failed checks if the device replied with an error during the current poll
+func (d *Device) Failed() bool {
+	d.Lock()
+	defer d.Unlock()
+	return d.failed
+}
+
+// ResetFailed allows to retry requests of the failed device
+func (d *Device) ResetFailed() {
+	d.Lock()
+	d.failed = false
+	d.Unlock()
+}
+
 func (d *Device) UpdatedAt() TimeStamp {
 	d.Lock()
 	defer d.Unlock()
@@ -277,6 +467,11 @@ func AnyDevice(_ *Device) bool {
 	return true
 }
 
+// DeviceHasCommands checks if the device has commands queued to be sent
+func DeviceHasCommands(d *Device) bool {
+	return d.HasCommands()
+}
+
 func DeviceNeedsUpdate(d *Device) bool {
 	return d.Stage() < Updated
 }
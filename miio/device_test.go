@@ -113,7 +113,6 @@ func Test_deviceRequest(t *testing.T) {
 			requestID: 0,
 			timeStamp: sampleTS,
 			token:     h.FromHex("00112233445566778899aabbccddeeff00"),
-			wantPkt:   NewPacket(0x00112233, sampleTS, h.FromHex("31323334353637383940414243444546474849")),
 			err:       errInvalidTokenLength,
 		},
 		{
@@ -129,7 +128,12 @@ func Test_deviceRequest(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			gotPkt, gotData, err := deviceRequest([]byte(tt.data), tt.deviceID, tt.requestID, tt.timeStamp, tt.token)
+			var gotPkt *Packet
+			var gotData []byte
+			c, err := NewCipher(tt.token)
+			if err == nil {
+				gotPkt, gotData, err = deviceRequest([]byte(tt.data), tt.deviceID, tt.requestID, tt.timeStamp, c)
+			}
 			h.AssertError(t, err, tt.err)
 			h.AssertEqual(t, gotPkt, tt.wantPkt)
 			// h.AssertEqual(t, gotPkt.Data, tt.wantPkt.Data)
@@ -138,6 +142,35 @@ func Test_deviceRequest(t *testing.T) {
 	}
 }
 
+func TestDevice_PushCommand(t *testing.T) {
+	device := &Device{}
+	h.AssertEqual(t, len(device.PopCommands()), 0)
+	device.PushCommand(NewCommand(`{"method":"set_power","params":["on"],"id":#}`))
+	device.PushCommand(NewCommand(`{"method":"set_bright","params":[40],"id":#}`))
+	got := device.PopCommands()
+	h.AssertEqual(t, len(got), 2)
+	h.AssertEqual(t, got[0].Request, []byte(`{"method":"set_power","params":["on"],"id":#}`))
+	h.AssertEqual(t, got[1].Request, []byte(`{"method":"set_bright","params":[40],"id":#}`))
+	h.AssertEqual(t, len(device.PopCommands()), 0)
+}
+
+func TestDevice_Batches(t *testing.T) {
+	device := &Device{}
+	h.AssertEqual(t, device.MissingBatches(2), []int{0, 1})
+	_, complete := device.AddBatch(1, Reply{Type: GetProp, ID: 12, Props: []interface{}{"bar", 2.0}})
+	h.AssertEqual(t, complete, false)
+	h.AssertEqual(t, device.MissingBatches(2), []int{0})
+	got, complete := device.AddBatch(0, Reply{Type: GetProp, ID: 11, Props: []interface{}{"foo"}})
+	h.AssertEqual(t, complete, true)
+	h.AssertEqual(t, got, Reply{Type: GetProp, ID: 11, Props: []interface{}{"foo", "bar", 2.0}})
+	h.AssertEqual(t, device.MissingBatches(2), []int{0, 1})
+	device.ResetBatches()
+	h.AssertEqual(t, device.MissingBatches(1), []int{0})
+	_, complete = device.AddBatch(1, Reply{Type: GetProp, ID: 12, Props: []interface{}{"bar", 2.0}}) // of the previous layout
+	h.AssertEqual(t, complete, false)
+	h.AssertEqual(t, device.MissingBatches(1), []int{0})
+}
+
 func TestDevice_Model(t *testing.T) {
 	tests := []struct {
 		name   string
@@ -486,6 +519,32 @@ func TestDevice_UpdatedAt(t *testing.T) {
 	}
 }
 
+func TestDevice_SetAvailable(t *testing.T) {
+	device := Device{}
+	h.AssertEqual(t, device.Available(), false)
+	h.AssertEqual(t, device.SetAvailable(false), true)
+	h.AssertEqual(t, device.SetAvailable(false), false)
+	h.AssertEqual(t, device.SetAvailable(true), true)
+	h.AssertEqual(t, device.Available(), true)
+	h.AssertEqual(t, device.SetAvailable(true), false)
+}
+
+func TestDevice_SetError(t *testing.T) {
+	device := &Device{}
+	h.AssertEqual(t, device.SetError(nil), false)
+	h.AssertEqual(t, device.Failed(), false)
+	h.AssertEqual(t, device.SetError(&DeviceError{Code: -5001, Message: "invalid_arg"}), true)
+	h.AssertEqual(t, device.Failed(), true)
+	h.AssertEqual(t, device.SetError(&DeviceError{Code: -5001, Message: "invalid_arg"}), false)
+	h.AssertEqual(t, device.SetError(&DeviceError{Code: -9999, Message: "user ack timeout"}), true)
+	h.AssertEqual(t, device.LastError(), &DeviceError{Code: -9999, Message: "user ack timeout"})
+	h.AssertEqual(t, device.LastError().Error(), "user ack timeout (code -9999)")
+	device.ResetFailed()
+	h.AssertEqual(t, device.Failed(), false)
+	h.AssertEqual(t, device.SetError(nil), true)
+	h.AssertEqual(t, device.LastError() == nil, true)
+}
+
 func TestDevice_SetUpdatedNow(t *testing.T) {
 	device := Device{updatedAt: sampleTS}
 	h.AssertEqual(t, device.updatedAt, sampleTS)
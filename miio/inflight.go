@@ -0,0 +1,181 @@
+package miio
+
+import (
+	"time"
+)
+
+// RequestKind tells what the sent request is for
+type RequestKind int32
+
+const (
+	InfoRequest RequestKind = iota
+	PropRequest
+	CommandRequest
+)
+
+func (k RequestKind) String() string {
+	switch k {
+	case InfoRequest:
+		return "info"
+	case PropRequest:
+		return "prop"
+	case CommandRequest:
+		return "command"
+	default:
+		return "INVALID"
+	}
+}
+
+// ReplyMatch is the result of matching the reply ID to the sent requests
+type ReplyMatch int32
+
+const (
+	MatchedReply   ReplyMatch = iota
+	DuplicateReply            // the request was already answered
+	StaleReply                // the request is unknown or expired
+)
+
+// answeredIDs is the number of answered request IDs remembered to recognize duplicate replies
+const answeredIDs = 32
+
+// SentRequest is the request waiting for the device reply
+type SentRequest struct {
+	ID       uint32
+	Kind     RequestKind
+	Data     []byte   // request payload with the actual ID
+	Command  *Command // set for CommandRequest
+	Batch    int      // get_prop batch index of PropRequest
+	SentAt   time.Time
+	Deadline time.Time
+}
+
+// InfoRequest works as Request but waits for the miIO.info reply until the timeout
+func (d *Device) InfoRequest(data []byte, timeout time.Duration) (*Packet, []byte, error) {
+	return d.sendRequest(&SentRequest{Kind: InfoRequest}, data, timeout)
+}
+
+// BatchRequest works as Request but waits for the get_prop batch reply until the timeout
+func (d *Device) BatchRequest(data []byte, index int, timeout time.Duration) (*Packet, []byte, error) {
+	return d.sendRequest(&SentRequest{Kind: PropRequest, Batch: index}, data, timeout)
+}
+
+// CommandRequest works as Request but waits for the command reply until the timeout
+func (d *Device) CommandRequest(cmd *Command, timeout time.Duration) (*Packet, []byte, error) {
+	return d.sendRequest(&SentRequest{Kind: CommandRequest, Command: cmd}, cmd.Request, timeout)
+}
+
+func (d *Device) sendRequest(req *SentRequest, data []byte, timeout time.Duration) (*Packet, []byte, error) {
+	pkt, raw, id, err := d.request(data)
+	if err != nil {
+		return pkt, raw, err
+	}
+	req.ID = id
+	req.Data = pkt.Data
+	req.SentAt = time.Now()
+	req.Deadline = req.SentAt.Add(timeout)
+	d.Lock()
+	if d.inflight == nil {
+		d.inflight = map[uint32]*SentRequest{}
+	}
+	d.inflight[id] = req
+	d.Unlock()
+	return pkt, raw, nil
+}
+
+// MatchReply returns the sent request the reply ID belongs to and forgets it,
+// the round-trip latency of the matched request is recorded
+func (d *Device) MatchReply(id uint32, now time.Time) (*SentRequest, ReplyMatch) {
+	d.Lock()
+	defer d.Unlock()
+	req, ok := d.inflight[id]
+	if !ok {
+		for _, answered := range d.answered {
+			if answered == id {
+				return nil, DuplicateReply
+			}
+		}
+		return nil, StaleReply
+	}
+	delete(d.inflight, id)
+	if now.After(req.Deadline) {
+		return req, StaleReply
+	}
+	d.answered = append(d.answered, id)
+	if len(d.answered) > answeredIDs {
+		d.answered = d.answered[1:]
+	}
+	d.latency = now.Sub(req.SentAt)
+	return req, MatchedReply
+}
+
+// ExpireRequests returns the sent requests not answered until their deadline and forgets them,
+// so their late replies are stale
+func (d *Device) ExpireRequests(now time.Time) []*SentRequest {
+	d.Lock()
+	defer d.Unlock()
+	result := []*SentRequest{}
+	for id, req := range d.inflight {
+		if now.Before(req.Deadline) {
+			continue
+		}
+		delete(d.inflight, id)
+		result = append(result, req)
+	}
+	return result
+}
+
+// Waiting checks if the request of the kind, or the get_prop batch for PropRequest, is waiting for reply
+func (d *Device) Waiting(kind RequestKind, batch int) bool {
+	d.Lock()
+	defer d.Unlock()
+	for _, req := range d.inflight {
+		if req.Kind == kind && (kind != PropRequest || req.Batch == batch) {
+			return true
+		}
+	}
+	return false
+}
+
+// NextDeadline returns the earliest deadline of the sent requests, zero time if none is waiting for reply
+func (d *Device) NextDeadline() time.Time {
+	d.Lock()
+	defer d.Unlock()
+	result := time.Time{}
+	for _, req := range d.inflight {
+		if result.IsZero() || req.Deadline.Before(result) {
+			result = req.Deadline
+		}
+	}
+	return result
+}
+
+// CancelRequests returns all sent requests still waiting for reply and forgets them
+func (d *Device) CancelRequests() []*SentRequest {
+	d.Lock()
+	defer d.Unlock()
+	result := make([]*SentRequest, 0, len(d.inflight))
+	for _, req := range d.inflight {
+		result = append(result, req)
+	}
+	d.inflight = nil
+	return result
+}
+
+// PendingRPC checks if any sent RPC command is waiting for reply
+func (d *Device) PendingRPC() bool {
+	d.Lock()
+	defer d.Unlock()
+	for _, req := range d.inflight {
+		if req.Kind == CommandRequest && req.Command.RPC {
+			return true
+		}
+	}
+	return false
+}
+
+// Latency returns the round-trip time of the last answered request
+func (d *Device) Latency() time.Duration {
+	d.Lock()
+	defer d.Unlock()
+	return d.latency
+}
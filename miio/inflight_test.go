@@ -0,0 +1,98 @@
+package miio
+
+import (
+	"testing"
+	"time"
+
+	h "github.com/eip/miio2mqtt/helpers"
+)
+
+func TestDevice_CommandRequest(t *testing.T) {
+	device := &Device{DeviceCfg: DeviceCfg{ID: 0x00112233}, timeShift: 10 * sec, requestID: 122}
+	cmd := NewCommand(`{"method":"set_power","params":["on"],"id":#}`)
+	pkt, _, err := device.CommandRequest(cmd, time.Second)
+	h.AssertError(t, err, nil)
+	h.AssertEqual(t, pkt.Data, Payload(`{"method":"set_power","params":["on"],"id":123}`))
+	h.AssertEqual(t, device.PendingRPC(), false)
+	req, match := device.MatchReply(123, time.Now())
+	h.AssertEqual(t, match, MatchedReply)
+	h.AssertEqual(t, req.Kind, CommandRequest)
+	h.AssertEqual(t, req.Command == cmd, true)
+	h.AssertEqual(t, req.Data, []byte(`{"method":"set_power","params":["on"],"id":123}`))
+}
+
+func TestDevice_MatchReply(t *testing.T) {
+	device := &Device{DeviceCfg: DeviceCfg{ID: 0x00112233}, timeShift: 10 * sec, requestID: 10}
+	now := time.Now()
+	_, _, err := device.InfoRequest([]byte(`{"method":"miIO.info","params":[],"id":#}`), time.Second)
+	h.AssertError(t, err, nil)
+	_, _, err = device.BatchRequest([]byte(`{"method":"get_prop","params":["power"],"id":#}`), 1, time.Second)
+	h.AssertError(t, err, nil)
+	_, _, err = device.BatchRequest([]byte(`{"method":"get_prop","params":["bright"],"id":#}`), 2, time.Second)
+	h.AssertError(t, err, nil)
+
+	req, match := device.MatchReply(12, now.Add(100*time.Millisecond))
+	h.AssertEqual(t, match, MatchedReply)
+	h.AssertEqual(t, req.Kind, PropRequest)
+	h.AssertEqual(t, req.Batch, 1)
+	h.AssertEqual(t, device.Latency() > 0, true)
+	_, match = device.MatchReply(12, now.Add(100*time.Millisecond))
+	h.AssertEqual(t, match, DuplicateReply)
+	_, match = device.MatchReply(9, now)
+	h.AssertEqual(t, match, StaleReply)
+	_, match = device.MatchReply(13, now.Add(2*time.Second))
+	h.AssertEqual(t, match, StaleReply) // deadline passed
+	_, match = device.MatchReply(13, now)
+	h.AssertEqual(t, match, StaleReply)
+
+	got := device.CancelRequests()
+	h.AssertEqual(t, len(got), 1)
+	h.AssertEqual(t, got[0].Kind, InfoRequest)
+	h.AssertEqual(t, got[0].ID, uint32(11))
+	h.AssertEqual(t, len(device.CancelRequests()), 0)
+}
+
+func TestDevice_CancelRequests(t *testing.T) {
+	device := &Device{DeviceCfg: DeviceCfg{ID: 0x00112233}, timeShift: 10 * sec}
+	rpc, _ := NewRPCCommand([]byte(`{"method":"get_prop","params":["power"],"id":"abc"}`))
+	_, _, err := device.CommandRequest(rpc, time.Second)
+	h.AssertError(t, err, nil)
+	h.AssertEqual(t, device.PendingRPC(), true)
+	got := device.CancelRequests()
+	h.AssertEqual(t, len(got), 1)
+	h.AssertEqual(t, got[0].Command == rpc, true)
+	h.AssertEqual(t, device.PendingRPC(), false)
+	h.AssertEqual(t, len(device.CancelRequests()), 0)
+}
+
+func TestDevice_ExpireRequests(t *testing.T) {
+	device := &Device{DeviceCfg: DeviceCfg{ID: 0x00112233}, timeShift: 10 * sec}
+	now := time.Now()
+	h.AssertEqual(t, device.NextDeadline(), time.Time{})
+	_, _, err := device.InfoRequest([]byte(`{"method":"miIO.info","params":[],"id":#}`), time.Second)
+	h.AssertError(t, err, nil)
+	_, _, err = device.BatchRequest([]byte(`{"method":"get_prop","params":["power"],"id":#}`), 1, 3*time.Second)
+	h.AssertError(t, err, nil)
+	h.AssertEqual(t, device.Waiting(InfoRequest, 0), true)
+	h.AssertEqual(t, device.Waiting(PropRequest, 0), false)
+	h.AssertEqual(t, device.Waiting(PropRequest, 1), true)
+	h.AssertEqual(t, device.Waiting(CommandRequest, 0), false)
+	deadline := device.NextDeadline()
+	h.AssertEqual(t, deadline.Sub(now) >= time.Second && deadline.Sub(now) < 2*time.Second, true)
+
+	h.AssertEqual(t, len(device.ExpireRequests(now)), 0)
+	got := device.ExpireRequests(now.Add(2 * time.Second))
+	h.AssertEqual(t, len(got), 1)
+	h.AssertEqual(t, got[0].Kind, InfoRequest)
+	h.AssertEqual(t, device.Waiting(InfoRequest, 0), false)
+	_, match := device.MatchReply(got[0].ID, now.Add(2*time.Second))
+	h.AssertEqual(t, match, StaleReply) // the late reply of the expired request
+	h.AssertEqual(t, device.Waiting(PropRequest, 1), true)
+}
+
+func TestRequestKind_String(t *testing.T) {
+	h.AssertEqual(t, InfoRequest.String(), "info")
+	h.AssertEqual(t, PropRequest.String(), "prop")
+	h.AssertEqual(t, CommandRequest.String(), "command")
+	h.AssertEqual(t, RequestKind(5).String(), "INVALID")
+}
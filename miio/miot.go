@@ -0,0 +1,183 @@
+package miio
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+)
+
+// MIoTProp maps the model param to the MIoT service property
+type MIoTProp struct {
+	Siid int `yaml:"Siid"`
+	Piid int `yaml:"Piid"`
+}
+
+// MIoTAction maps the command name to the MIoT service action
+type MIoTAction struct {
+	Siid int `yaml:"Siid"`
+	Aiid int `yaml:"Aiid"`
+}
+
+// MIoTResult is the property value or the operation status returned by the MIoT device
+type MIoTResult struct {
+	DID   string      `json:"did"`
+	Siid  int         `json:"siid"`
+	Piid  int         `json:"piid"`
+	Code  int         `json:"code"`
+	Value interface{} `json:"value"`
+}
+
+const (
+	defaultGetPropertiesRequest = `{"method":"get_properties","params":#,"id":#}`
+	defaultSetPropertiesRequest = `{"method":"set_properties","params":[{"did":%q,"siid":%d,"piid":%d,"value":%s}],"id":#}`
+	defaultActionRequest        = `{"method":"action","params":{"did":%q,"siid":%d,"aiid":%d,"in":%s},"id":#}`
+)
+
+// miotSpecService is skipped when generating the mapping, its properties never change
+const miotSpecService = "device-information"
+
+type miotParam struct {
+	DID  string `json:"did"`
+	Siid int    `json:"siid"`
+	Piid int    `json:"piid"`
+}
+
+type miotSpec struct {
+	Services []struct {
+		Iid        int    `json:"iid"`
+		Type       string `json:"type"`
+		Properties []struct {
+			Iid    int      `json:"iid"`
+			Type   string   `json:"type"`
+			Access []string `json:"access"`
+		} `json:"properties"`
+		Actions []struct {
+			Iid  int    `json:"iid"`
+			Type string `json:"type"`
+		} `json:"actions"`
+	} `json:"services"`
+}
+
+// IsMIoT checks if the model params are MIoT properties
+func (m *Model) IsMIoT() bool {
+	return len(m.MIoT) > 0
+}
+
+// LoadSpec generates MIoT properties and actions of the model from the MIoT spec JSON file (as served by miot-spec.org),
+// names are built from the service and property types like light_brightness, explicitly configured ones are kept
+func (m *Model) LoadSpec(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	spec := miotSpec{}
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return fmt.Errorf("invalid MIoT spec %s: %v", path, err)
+	}
+	if m.MIoT == nil {
+		m.MIoT = map[string]MIoTProp{}
+	}
+	if m.Actions == nil {
+		m.Actions = map[string]MIoTAction{}
+	}
+	params := []string{}
+	props := map[string]bool{}
+	actions := map[string]bool{}
+	for _, s := range spec.Services {
+		service := miotTypeName(s.Type)
+		if service == miotSpecService {
+			continue
+		}
+		for _, p := range s.Properties {
+			name := miotName(service, miotTypeName(p.Type), s.Iid, p.Iid, props)
+			if _, ok := m.MIoT[name]; !ok {
+				m.MIoT[name] = MIoTProp{Siid: s.Iid, Piid: p.Iid}
+			}
+			if hasAccess(p.Access, "read") {
+				params = append(params, name)
+			}
+		}
+		for _, a := range s.Actions {
+			name := miotName(service, miotTypeName(a.Type), s.Iid, a.Iid, actions)
+			if _, ok := m.Actions[name]; !ok {
+				m.Actions[name] = MIoTAction{Siid: s.Iid, Aiid: a.Iid}
+			}
+		}
+	}
+	if len(m.Params) == 0 {
+		m.Params = params
+	}
+	return nil
+}
+
+func (mm Models) getPropertiesParams(model string, params []string) ([]miotParam, error) {
+	m := mm[model]
+	result := make([]miotParam, 0, len(params))
+	for _, p := range params {
+		prop, ok := m.MIoT[p]
+		if !ok {
+			return nil, fmt.Errorf("unable to find %s MIoT property %q", model, p)
+		}
+		result = append(result, miotParam{DID: p, Siid: prop.Siid, Piid: prop.Piid})
+	}
+	return result, nil
+}
+
+// miotRequest builds set_properties or action request of the MIoT model for the param
+func (mm Models) miotRequest(model, param string, value json.RawMessage) (string, bool) {
+	m, ok := mm[model]
+	if !ok {
+		return "", false
+	}
+	if prop, ok := m.MIoT[param]; ok {
+		return fmt.Sprintf(defaultSetPropertiesRequest, param, prop.Siid, prop.Piid, value), true
+	}
+	if action, ok := m.Actions[param]; ok {
+		if value = bytes.TrimSpace(value); len(value) == 0 || value[0] != '[' {
+			value = append(append([]byte{'['}, value...), ']')
+		}
+		return fmt.Sprintf(defaultActionRequest, param, action.Siid, action.Aiid, value), true
+	}
+	return "", false
+}
+
+func (mm Models) miotParams(model string) []string {
+	m := mm[model]
+	result := make([]string, 0, len(m.MIoT))
+	for name := range m.MIoT {
+		result = append(result, name)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// miotTypeName extracts the name from the MIoT spec type like urn:miot-spec-v2:property:color-temperature:0000000F:yeelink-lamp2:1
+func miotTypeName(urn string) string {
+	parts := strings.Split(urn, ":")
+	if len(parts) < 4 {
+		return urn
+	}
+	return parts[3]
+}
+
+// miotName builds the unique name of the generated property or action, adding iids to the repeated ones
+func miotName(service, name string, siid, iid int, names map[string]bool) string {
+	result := strings.ReplaceAll(service+"_"+name, "-", "_")
+	if names[result] {
+		result = fmt.Sprintf("%s_%d_%d", result, siid, iid)
+	}
+	names[result] = true
+	return result
+}
+
+func hasAccess(access []string, mode string) bool {
+	for _, a := range access {
+		if a == mode {
+			return true
+		}
+	}
+	return false
+}
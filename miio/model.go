@@ -1,27 +1,47 @@
 package miio
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"regexp"
+	"time"
 
 	log "github.com/go-pkgz/lgr"
 )
 
 // Device represents a miIO all device properties
 type Model struct {
-	Methods ModelMethods `yaml:"Methods"`
-	Params  []string     `yaml:"Params"`
+	Methods      ModelMethods              `yaml:"Methods"`
+	Params       []string                  `yaml:"Params"`
+	MIoT         map[string]MIoTProp       `yaml:"MIoT"`         // param name => MIoT property, get_properties is used instead of get_prop
+	Actions      map[string]MIoTAction     `yaml:"Actions"`      // command name => MIoT action
+	Spec         string                    `yaml:"Spec"`         // MIoT spec JSON file to generate MIoT properties and actions from
+	BatchSize    int                       `yaml:"BatchSize"`    // max params per get_prop request, all in one if 0
+	Discovery    map[string]ParamDiscovery `yaml:"Discovery"`    // param name => Home Assistant entity options
+	PollInterval time.Duration             `yaml:"PollInterval"` // overrides PollInterval for devices of the model
+}
+
+// ParamDiscovery describes a Home Assistant entity created for the model param
+type ParamDiscovery struct {
+	Component   string `yaml:"Component"` // sensor, binary_sensor, switch...
+	Unit        string `yaml:"Unit"`
+	DeviceClass string `yaml:"DeviceClass"`
 }
 
 type ModelMethods struct {
-	MiioInfo string `yaml:"MiioInfo"`
-	GetProp  string `yaml:"GetProp"`
+	MiioInfo string            `yaml:"MiioInfo"`
+	GetProp  string            `yaml:"GetProp"`
+	SetProp  map[string]string `yaml:"SetProp"` // param name => miIO method name
 }
 
+const defaultDiscoveryComponent = "sensor"
+
 const (
 	defaultMiioInfoRequest = `{"method":"miIO.info","params":[],"id":#}`
 	defaultGetPropRequest  = `{"method":"get_prop","params":#,"id":#}`
+	defaultSetPropRequest  = `{"method":%q,"params":%s,"id":#}`
 )
 
 func DefaultModel() Model {
@@ -38,12 +58,28 @@ const (
 	Unrecognized ReplyType = iota
 	MiioInfo
 	GetProp
+	GetProperties
+	Action
+	Error
 )
 
 type Reply struct {
-	Type  ReplyType
-	Model string
-	Props []interface{}
+	Type    ReplyType
+	ID      uint32
+	Model   string
+	Props   []interface{}
+	Results []MIoTResult
+	Err     *DeviceError
+}
+
+// DeviceError is the error returned by the device, e.g. for unsupported methods or invalid params
+type DeviceError struct {
+	Code    int    `json:"code" yaml:"Code"`
+	Message string `json:"message" yaml:"Message"`
+}
+
+func (e *DeviceError) Error() string {
+	return fmt.Sprintf("%s (code %d)", e.Message, e.Code)
 }
 
 var reParams = regexp.MustCompile(`("params":\s?)#+`)
@@ -72,12 +108,16 @@ func (mm Models) Params(model string) []string {
 		if len(params) > 0 {
 			return params
 		}
+		if m.IsMIoT() {
+			return mm.miotParams(model)
+		}
 	}
 	log.Printf("[WARN] unable to find %s parameters list", model)
 	return nil
 }
 
-func (mm Models) GetProp(model string) string {
+// GetProp builds requests of the model params, split into batches of the model BatchSize
+func (mm Models) GetProp(model string) []string {
 	var request []byte
 	for _, name := range []string{model, "*"} {
 		if m, ok := mm[name]; ok {
@@ -87,20 +127,145 @@ func (mm Models) GetProp(model string) string {
 			}
 		}
 	}
+	m := mm[model]
+	if m.IsMIoT() && len(m.Methods.GetProp) == 0 {
+		request = []byte(defaultGetPropertiesRequest)
+	}
 	if len(request) == 0 {
 		log.Printf("[WARN] unable to find %s get_prop request", model)
-		return ""
+		return nil
 	}
 	params := mm.Params(model)
 	if len(params) == 0 {
-		return ""
+		return nil
+	}
+	size := mm.batchSize(model)
+	if size <= 0 {
+		size = len(params)
+	}
+	result := []string{}
+	for start := 0; start < len(params); start += size {
+		end := start + size
+		if end > len(params) {
+			end = len(params)
+		}
+		batch, err := mm.getPropRequest(model, request, params[start:end])
+		if err != nil {
+			log.Printf("[WARN] %v", err)
+			return nil
+		}
+		result = append(result, batch)
+	}
+	return result
+}
+
+func (mm Models) getPropRequest(model string, request []byte, params []string) (string, error) {
+	var requestParams interface{} = params
+	if m := mm[model]; m.IsMIoT() {
+		miotParams, err := mm.getPropertiesParams(model, params)
+		if err != nil {
+			return "", err
+		}
+		requestParams = miotParams
 	}
-	paramsStr, err := json.Marshal(params)
+	paramsStr, err := json.Marshal(requestParams)
 	if err != nil {
-		log.Printf("[WARN] invalid %s request parameters %v: %s", model, params, err)
-		return ""
+		return "", fmt.Errorf("invalid %s request parameters %v: %s", model, params, err)
+	}
+	return string(reParams.ReplaceAll(request, []byte(fmt.Sprintf("${1}%s", paramsStr)))), nil
+}
+
+func (mm Models) batchSize(model string) int {
+	for _, name := range []string{model, "*"} {
+		if m, ok := mm[name]; ok && m.BatchSize > 0 {
+			return m.BatchSize
+		}
+	}
+	return 0
+}
+
+// PollInterval returns the model poll interval, 0 if it is not overridden
+func (mm Models) PollInterval(model string) time.Duration {
+	if m, ok := mm[model]; ok && m.PollInterval > 0 {
+		return m.PollInterval
+	}
+	return 0
+}
+
+// Discovery returns the Home Assistant entity options of the model param, or of the param of any model
+func (mm Models) Discovery(model, param string) ParamDiscovery {
+	result := ParamDiscovery{}
+	for _, name := range []string{model, "*"} {
+		if m, ok := mm[name]; ok {
+			if d, ok := m.Discovery[param]; ok {
+				result = d
+				break
+			}
+		}
+	}
+	if len(result.Component) == 0 {
+		result.Component = defaultDiscoveryComponent
+	}
+	return result
+}
+
+// SetProp converts a JSON object like {"power":"on","bright":40} into the list of
+// requests to be sent to the device, keeping the order of the object keys;
+// MIoT properties and actions of the model are set with set_properties and action requests
+func (mm Models) SetProp(model string, payload []byte) ([]string, error) {
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	dec.UseNumber()
+	if t, err := dec.Token(); err != nil || t != json.Delim('{') {
+		return nil, errors.New("command should be a JSON object")
+	}
+	result := []string{}
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		param, _ := t.(string)
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return nil, err
+		}
+		if request, ok := mm.miotRequest(model, param, value); ok {
+			result = append(result, request)
+			continue
+		}
+		method := mm.setPropMethod(model, param)
+		if len(method) == 0 {
+			return nil, fmt.Errorf("unable to find %s set method for %q", model, param)
+		}
+		if value = bytes.TrimSpace(value); len(value) == 0 || value[0] != '[' {
+			value = append(append([]byte{'['}, value...), ']')
+		}
+		result = append(result, fmt.Sprintf(defaultSetPropRequest, method, value))
 	}
-	return string(reParams.ReplaceAll(request, []byte(fmt.Sprintf("${1}%s", paramsStr))))
+	if len(result) == 0 {
+		return nil, errors.New("empty command")
+	}
+	return result, nil
+}
+
+func (mm Models) setPropMethod(model, param string) string {
+	for _, name := range []string{model, "*"} {
+		if m, ok := mm[name]; ok {
+			if method, ok := m.Methods.SetProp[param]; ok && len(method) > 0 {
+				return method
+			}
+		}
+	}
+	return ""
+}
+
+type replyID struct {
+	ID uint32 `json:"id"`
+}
+
+type deviceErrorReply struct {
+	ID    int          `json:"id"`
+	Error *DeviceError `json:"error"`
 }
 
 type deviceInfoReply struct {
@@ -115,14 +280,47 @@ type devicePropReply struct {
 	Result []interface{} `json:"result"`
 }
 
+type miotPropReply struct {
+	ID     int          `json:"id"`
+	Result []MIoTResult `json:"result"`
+}
+
+type miotActionReply struct {
+	ID     int `json:"id"`
+	Result struct {
+		Code *int `json:"code"`
+	} `json:"result"`
+}
+
 func ParseReply(data []byte) Reply {
 	result := Reply{Type: Unrecognized}
+	id := replyID{}
+	if err := json.Unmarshal(data, &id); err == nil {
+		result.ID = id.ID
+	}
+	deviceErr := deviceErrorReply{}
+	if err := json.Unmarshal(data, &deviceErr); err == nil && deviceErr.Error != nil {
+		result.Err = deviceErr.Error
+		result.Type = Error
+		return result
+	}
 	info := deviceInfoReply{}
 	if err := json.Unmarshal(data, &info); err == nil && info.Result.Model != "" {
 		result.Model = info.Result.Model
 		result.Type = MiioInfo
 		return result
 	}
+	miot := miotPropReply{}
+	if err := json.Unmarshal(data, &miot); err == nil && len(miot.Result) > 0 && miot.Result[0].Siid > 0 {
+		result.Results = miot.Result
+		result.Type = GetProperties
+		return result
+	}
+	action := miotActionReply{}
+	if err := json.Unmarshal(data, &action); err == nil && action.Result.Code != nil {
+		result.Type = Action
+		return result
+	}
 	props := devicePropReply{}
 	if err := json.Unmarshal(data, &props); err == nil && len(props.Result) > 0 {
 		result.Props = props.Result
@@ -1,6 +1,7 @@
 package miio
 
 import (
+	"errors"
 	"regexp"
 	"testing"
 
@@ -152,6 +153,14 @@ func TestModels_Params(t *testing.T) {
 			model: "dummy.test.v1",
 			want:  []string{"foo", "bar", "baz"},
 		},
+		{
+			name: "MIoT model without Params",
+			models: Models{
+				"dummy.test.v1": Model{MIoT: map[string]MIoTProp{"power": {Siid: 2, Piid: 1}, "bright": {Siid: 2, Piid: 2}}},
+			},
+			model: "dummy.test.v1",
+			want:  []string{"bright", "power"},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -169,14 +178,14 @@ func TestModels_GetProp(t *testing.T) {
 		name   string
 		models Models
 		model  string
-		want   string
+		want   []string
 		logRe  *regexp.Regexp
 	}{
 		{
 			name:   "Empty Models",
 			models: Models{},
 			model:  "dummy.test.v1",
-			want:   "",
+			want:   nil,
 			logRe:  logRe,
 		},
 		{
@@ -186,7 +195,7 @@ func TestModels_GetProp(t *testing.T) {
 				"dummy.test.v1": Model{Methods: ModelMethods{GetProp: `{"method":"foo","id":#}`}},
 			},
 			model: "dummy.test.v2",
-			want:  "",
+			want:  nil,
 			logRe: logRe,
 		},
 		{
@@ -196,7 +205,7 @@ func TestModels_GetProp(t *testing.T) {
 				"dummy.test.v1": Model{Methods: ModelMethods{}},
 			},
 			model: "dummy.test.v1",
-			want:  "",
+			want:  nil,
 			logRe: logRe,
 		},
 		{
@@ -206,7 +215,7 @@ func TestModels_GetProp(t *testing.T) {
 				"dummy.test.v1": Model{Methods: ModelMethods{}, Params: []string{"foo", "bar", "baz"}},
 			},
 			model: "dummy.test.v1",
-			want:  `{"method":"get_prop","params":["foo","bar","baz"],"id":#}`,
+			want:  []string{`{"method":"get_prop","params":["foo","bar","baz"],"id":#}`},
 		},
 		{
 			name: "Model with empty GetProp method",
@@ -215,7 +224,7 @@ func TestModels_GetProp(t *testing.T) {
 				"dummy.test.v1": Model{Methods: ModelMethods{GetProp: ""}},
 			},
 			model: "dummy.test.v1",
-			want:  "",
+			want:  nil,
 			logRe: logRe,
 		},
 		{
@@ -225,7 +234,7 @@ func TestModels_GetProp(t *testing.T) {
 				"dummy.test.v1": Model{Methods: ModelMethods{GetProp: `{"method":"bar","params":#,"id":#}`}},
 			},
 			model: "dummy.test.v1",
-			want:  "",
+			want:  nil,
 			logRe: logRe,
 		},
 		{
@@ -235,7 +244,7 @@ func TestModels_GetProp(t *testing.T) {
 				"dummy.test.v1": Model{Methods: ModelMethods{GetProp: `{"method":"bar","params":#,"id":#}`}, Params: []string{"foo", "bar", "baz"}},
 			},
 			model: "dummy.test.v1",
-			want:  `{"method":"bar","params":["foo","bar","baz"],"id":#}`,
+			want:  []string{`{"method":"bar","params":["foo","bar","baz"],"id":#}`},
 		},
 		{
 			name: "Model with defined GetProp method and empty Params",
@@ -243,9 +252,59 @@ func TestModels_GetProp(t *testing.T) {
 				"dummy.test.v1": Model{Methods: ModelMethods{GetProp: `{"method":"bar","params":#,"id":#}`}, Params: []string{}},
 			},
 			model: "dummy.test.v1",
-			want:  "",
+			want:  nil,
 			logRe: logRe,
 		},
+		{
+			name: "MIoT model",
+			models: Models{
+				"*":             DefaultModel(),
+				"dummy.test.v1": Model{MIoT: map[string]MIoTProp{"power": {Siid: 2, Piid: 1}, "bright": {Siid: 2, Piid: 2}}, Params: []string{"power", "bright"}},
+			},
+			model: "dummy.test.v1",
+			want:  []string{`{"method":"get_properties","params":[{"did":"power","siid":2,"piid":1},{"did":"bright","siid":2,"piid":2}],"id":#}`},
+		},
+		{
+			name: "MIoT model with defined GetProp method",
+			models: Models{
+				"dummy.test.v1": Model{Methods: ModelMethods{GetProp: `{"method":"bar","params":#,"id":#}`}, MIoT: map[string]MIoTProp{"power": {Siid: 2, Piid: 1}}},
+			},
+			model: "dummy.test.v1",
+			want:  []string{`{"method":"bar","params":[{"did":"power","siid":2,"piid":1}],"id":#}`},
+		},
+		{
+			name: "MIoT model with unknown param",
+			models: Models{
+				"dummy.test.v1": Model{MIoT: map[string]MIoTProp{"power": {Siid: 2, Piid: 1}}, Params: []string{"power", "foo"}},
+			},
+			model: "dummy.test.v1",
+			want:  nil,
+			logRe: regexp.MustCompile(`^\[WARN\]\s+unable to find dummy.test.v1 MIoT property "foo"`),
+		},
+		{
+			name: "Model with BatchSize",
+			models: Models{
+				"*":             DefaultModel(),
+				"dummy.test.v1": Model{Params: []string{"foo", "bar", "baz"}, BatchSize: 2},
+			},
+			model: "dummy.test.v1",
+			want: []string{
+				`{"method":"get_prop","params":["foo","bar"],"id":#}`,
+				`{"method":"get_prop","params":["baz"],"id":#}`,
+			},
+		},
+		{
+			name: "Default BatchSize",
+			models: Models{
+				"*":             Model{Methods: DefaultModel().Methods, BatchSize: 1},
+				"dummy.test.v1": Model{MIoT: map[string]MIoTProp{"power": {Siid: 2, Piid: 1}, "bright": {Siid: 2, Piid: 2}}, Params: []string{"power", "bright"}},
+			},
+			model: "dummy.test.v1",
+			want: []string{
+				`{"method":"get_properties","params":[{"did":"power","siid":2,"piid":1}],"id":#}`,
+				`{"method":"get_properties","params":[{"did":"bright","siid":2,"piid":2}],"id":#}`,
+			},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -257,6 +316,126 @@ func TestModels_GetProp(t *testing.T) {
 	}
 }
 
+func TestModels_Discovery(t *testing.T) {
+	models := Models{
+		"*": Model{Discovery: map[string]ParamDiscovery{
+			"power":    {Component: "binary_sensor"},
+			"humidity": {Unit: "%", DeviceClass: "humidity"},
+		}},
+		"dummy.test.v1": Model{Discovery: map[string]ParamDiscovery{
+			"power": {Component: "switch"},
+			"temp":  {Unit: "°C", DeviceClass: "temperature"},
+		}},
+	}
+	tests := []struct {
+		name  string
+		model string
+		param string
+		want  ParamDiscovery
+	}{
+		{name: "Unknown model", model: "dummy.test.v2", param: "power", want: ParamDiscovery{Component: "binary_sensor"}},
+		{name: "Unknown model param", model: "dummy.test.v2", param: "temp", want: ParamDiscovery{Component: "sensor"}},
+		{name: "Any model param", model: "dummy.test.v1", param: "humidity", want: ParamDiscovery{Component: "sensor", Unit: "%", DeviceClass: "humidity"}},
+		{name: "Unknown param", model: "dummy.test.v1", param: "foo", want: ParamDiscovery{Component: "sensor"}},
+		{name: "Component", model: "dummy.test.v1", param: "power", want: ParamDiscovery{Component: "switch"}},
+		{name: "Default component", model: "dummy.test.v1", param: "temp", want: ParamDiscovery{Component: "sensor", Unit: "°C", DeviceClass: "temperature"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := models.Discovery(tt.model, tt.param)
+			h.AssertEqual(t, got, tt.want)
+		})
+	}
+}
+
+func TestModels_SetProp(t *testing.T) {
+	models := Models{
+		"*":             DefaultModel(),
+		"dummy.test.v1": Model{Methods: ModelMethods{SetProp: map[string]string{"power": "set_power", "bright": "set_bright", "ct": "set_ct_abx"}}},
+		"dummy.miot.v1": Model{
+			MIoT:    map[string]MIoTProp{"power": {Siid: 2, Piid: 1}},
+			Actions: map[string]MIoTAction{"toggle": {Siid: 2, Aiid: 1}, "fade": {Siid: 3, Aiid: 2}},
+		},
+	}
+	tests := []struct {
+		name    string
+		model   string
+		payload string
+		want    []string
+		err     error
+	}{
+		{
+			name:    "Invalid JSON",
+			model:   "dummy.test.v1",
+			payload: "foo",
+			err:     errors.New("command should be a JSON object"),
+		},
+		{
+			name:    "Not an object",
+			model:   "dummy.test.v1",
+			payload: `["on"]`,
+			err:     errors.New("command should be a JSON object"),
+		},
+		{
+			name:    "Empty object",
+			model:   "dummy.test.v1",
+			payload: `{}`,
+			err:     errors.New("empty command"),
+		},
+		{
+			name:    "Unknown param",
+			model:   "dummy.test.v1",
+			payload: `{"power":"on","foo":1}`,
+			err:     errors.New(`unable to find dummy.test.v1 set method for "foo"`),
+		},
+		{
+			name:    "Unknown model",
+			model:   "dummy.test.v2",
+			payload: `{"power":"on"}`,
+			err:     errors.New(`unable to find dummy.test.v2 set method for "power"`),
+		},
+		{
+			name:    "Single value",
+			model:   "dummy.test.v1",
+			payload: `{"power":"on"}`,
+			want:    []string{`{"method":"set_power","params":["on"],"id":#}`},
+		},
+		{
+			name:    "Multiple values keep order",
+			model:   "dummy.test.v1",
+			payload: `{"power":"on", "bright": 40, "ct":[4000,"smooth",500]}`,
+			want: []string{
+				`{"method":"set_power","params":["on"],"id":#}`,
+				`{"method":"set_bright","params":[40],"id":#}`,
+				`{"method":"set_ct_abx","params":[4000,"smooth",500],"id":#}`,
+			},
+		},
+		{
+			name:    "MIoT properties and actions",
+			model:   "dummy.miot.v1",
+			payload: `{"power":true,"toggle":[],"fade":50}`,
+			want: []string{
+				`{"method":"set_properties","params":[{"did":"power","siid":2,"piid":1,"value":true}],"id":#}`,
+				`{"method":"action","params":{"did":"toggle","siid":2,"aiid":1,"in":[]},"id":#}`,
+				`{"method":"action","params":{"did":"fade","siid":3,"aiid":2,"in":[50]},"id":#}`,
+			},
+		},
+		{
+			name:    "MIoT unknown param",
+			model:   "dummy.miot.v1",
+			payload: `{"bright":50}`,
+			err:     errors.New(`unable to find dummy.miot.v1 set method for "bright"`),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := models.SetProp(tt.model, []byte(tt.payload))
+			h.AssertError(t, err, tt.err)
+			h.AssertEqual(t, got, tt.want)
+		})
+	}
+}
+
 func Test_ParseReply(t *testing.T) {
 	logRe := regexp.MustCompile(`^\[WARN\]\s+unable to parse`)
 	tests := []struct {
@@ -271,51 +450,75 @@ func Test_ParseReply(t *testing.T) {
 			want:  Reply{Type: Unrecognized},
 			logRe: logRe,
 		},
+		{
+			name:  "Invalid ID",
+			data:  `{"result":{"life":123456,"cfg_time":0},"id":"foo"}`,
+			want:  Reply{Type: Unrecognized},
+			logRe: logRe,
+		},
 		{
 			name:  "Invalid MiioInfo reply 1",
 			data:  `{"result":{"life":123456,"cfg_time":0},"id":1}`,
-			want:  Reply{Type: Unrecognized},
+			want:  Reply{Type: Unrecognized, ID: 1},
 			logRe: logRe,
 		},
 		{
 			name:  "Invalid MiioInfo reply 2",
 			data:  `{"result":{"life":123456,"cfg_time":0,"model":123.45},"id":1}`,
-			want:  Reply{Type: Unrecognized},
+			want:  Reply{Type: Unrecognized, ID: 1},
 			logRe: logRe,
 		},
 		{
 			name:  "Invalid MiioInfo reply 2",
 			data:  `{"result":{"life":123456,"cfg_time":0,"model":""},"id":1}`,
-			want:  Reply{Type: Unrecognized},
+			want:  Reply{Type: Unrecognized, ID: 1},
 			logRe: logRe,
 		},
 		{
 			name: "MiioInfo reply",
 			data: `{"result":{"life":123456,"cfg_time":0,"model":"dummy.test.v1"},"id":1}`,
-			want: Reply{Type: MiioInfo, Model: "dummy.test.v1"},
+			want: Reply{Type: MiioInfo, ID: 1, Model: "dummy.test.v1"},
 		},
 		{
 			name:  "Invalid GetProp reply 1",
 			data:  `{"foo":["foo","bar",123.45,true],"id":1}`,
-			want:  Reply{Type: Unrecognized},
+			want:  Reply{Type: Unrecognized, ID: 1},
 			logRe: logRe,
 		},
 		{
 			name:  "Invalid GetProp reply 2",
 			data:  `{"result":123.45,"id":1}`,
-			want:  Reply{Type: Unrecognized},
+			want:  Reply{Type: Unrecognized, ID: 1},
 			logRe: logRe,
 		},
 		{
 			name:  "Invalid GetProp reply 3",
 			data:  `{"result":[],"id":1}`,
-			want:  Reply{Type: Unrecognized},
+			want:  Reply{Type: Unrecognized, ID: 1},
 			logRe: logRe,
 		},
 		{
 			name: "GetProp reply",
 			data: `{"result":["foo","bar",123.45,true],"id":1}`,
-			want: Reply{Type: GetProp, Props: []interface{}{"foo", "bar", 123.45, true}},
+			want: Reply{Type: GetProp, ID: 1, Props: []interface{}{"foo", "bar", 123.45, true}},
+		},
+		{
+			name: "GetProperties reply",
+			data: `{"result":[{"did":"power","siid":2,"piid":1,"code":0,"value":true},{"did":"bright","siid":2,"piid":2,"code":-4001}],"id":1}`,
+			want: Reply{Type: GetProperties, ID: 1, Results: []MIoTResult{
+				{DID: "power", Siid: 2, Piid: 1, Code: 0, Value: true},
+				{DID: "bright", Siid: 2, Piid: 2, Code: -4001},
+			}},
+		},
+		{
+			name: "Error reply",
+			data: `{"error":{"code":-5001,"message":"invalid_arg"},"id":1}`,
+			want: Reply{Type: Error, ID: 1, Err: &DeviceError{Code: -5001, Message: "invalid_arg"}},
+		},
+		{
+			name: "Action reply",
+			data: `{"result":{"code":0,"out":[]},"id":1}`,
+			want: Reply{Type: Action, ID: 1},
 		},
 	}
 	for _, tt := range tests {
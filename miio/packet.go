@@ -2,8 +2,6 @@ package miio
 
 import (
 	"bytes"
-	"crypto/aes"
-	"crypto/cipher"
 	"crypto/md5"
 	"encoding/binary"
 	"errors"
@@ -73,58 +71,141 @@ func GetDeviceID(data []byte) (uint32, error) {
 	return binary.BigEndian.Uint32(data[8:12]), nil
 }
 
-// Decode creates a packet from the byte slice
+// headerSize is the length of the packet header, the encrypted payload follows it
+const headerSize = 32
+
+// Decode creates a packet from the byte slice, data is left intact
 func Decode(data []byte, token []byte) (*Packet, error) {
-	p, err := decode(data)
+	c, err := cipherFor(token)
 	if err != nil {
 		return nil, err
 	}
-	if err := p.Validate(token); err != nil {
+	p := Packet{}
+	if err := p.UnmarshalFrom(append([]byte(nil), data...), c); err != nil {
 		return nil, err
 	}
-	return p.decrypt(token)
+	return &p, nil
 }
 
-func decode(data []byte) (*Packet, error) {
-	if len(data) < 32 {
-		return nil, errInvalidDataLength
+// UnmarshalFrom validates and decodes the packet without allocations,
+// the payload is decrypted in place and p.Data refers to data
+func (p *Packet) UnmarshalFrom(data []byte, c *Cipher) error {
+	if err := p.unmarshalHeader(data); err != nil {
+		return err
 	}
-	p := Packet{}
-	buf := bytes.NewReader(data)
-	for _, v := range []interface{}{&p.Magic, &p.Length, &p.Unused, &p.DeviceID, &p.TimeStamp, p.Checksum[:]} {
-		if err := binary.Read(buf, binary.BigEndian, v); err != nil {
-			return nil, err
+	if p.Magic != 0x2131 {
+		return errInvalidMagicField
+	}
+	if p.Length != headerSize+uint16(len(p.Data)) {
+		return errInvalidDataLength
+	}
+	if len(p.Data) == 0 {
+		if ok, _ := p.validateChecksum(nil); !ok {
+			return errInvalidChecksum
 		}
+		return nil
+	}
+	if c == nil {
+		return errInvalidTokenLength
+	}
+	copy(data[16:headerSize], c.token[:]) // the checksum is calculated with the token in place of it
+	checksum := md5.Sum(data)
+	copy(data[16:headerSize], p.Checksum[:])
+	if checksum != p.Checksum {
+		return errInvalidChecksum
+	}
+	return p.decrypt(c)
+}
+
+// DecodeHello creates a packet from the hello reply, the token is returned as well
+// if the device leaks it in the checksum field (reset or not yet cloud-bound devices do so)
+func DecodeHello(data []byte) (*Packet, []byte, error) {
+	p, err := decode(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = p.Validate(nil)
+	if err == errInvalidChecksum && len(p.Data) == 0 {
+		token := make([]byte, len(p.Checksum))
+		copy(token, p.Checksum[:])
+		return p, token, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return p, nil, nil
+}
+
+func decode(data []byte) (*Packet, error) {
+	p := Packet{}
+	if err := p.unmarshalHeader(data); err != nil {
+		return nil, err
 	}
-	p.Data = data[32:]
 	return &p, nil
 }
 
+func (p *Packet) unmarshalHeader(data []byte) error {
+	if len(data) < headerSize {
+		return errInvalidDataLength
+	}
+	p.Magic = binary.BigEndian.Uint16(data[0:2])
+	p.Length = binary.BigEndian.Uint16(data[2:4])
+	p.Unused = binary.BigEndian.Uint32(data[4:8])
+	p.DeviceID = binary.BigEndian.Uint32(data[8:12])
+	p.TimeStamp = TimeStamp(binary.BigEndian.Uint32(data[12:16]))
+	copy(p.Checksum[:], data[16:headerSize])
+	p.Data = data[headerSize:]
+	return nil
+}
+
+func (p *Packet) marshalHeader(buf []byte, length uint16, checksum []byte) {
+	binary.BigEndian.PutUint16(buf[0:2], p.Magic)
+	binary.BigEndian.PutUint16(buf[2:4], length)
+	binary.BigEndian.PutUint32(buf[4:8], p.Unused)
+	binary.BigEndian.PutUint32(buf[8:12], p.DeviceID)
+	binary.BigEndian.PutUint32(buf[12:16], uint32(p.TimeStamp))
+	copy(buf[16:headerSize], checksum)
+}
+
 // Encode converts the packet into a byte slice
 func (p *Packet) Encode(token []byte) ([]byte, error) {
-	penc, err := p.encrypt(token)
+	c, err := cipherFor(token)
 	if err != nil {
 		return nil, err
 	}
-	return penc.encode(nil)
+	return p.MarshalTo(nil, c)
+}
+
+// MarshalTo appends the packet encrypted with the cipher to dst, the payload is sent as is without the cipher,
+// no allocations are made if dst has enough capacity
+func (p *Packet) MarshalTo(dst []byte, c *Cipher) ([]byte, error) {
+	if c == nil || len(p.Data) == 0 {
+		start := len(dst)
+		dst = grow(dst, headerSize+len(p.Data))
+		p.marshalHeader(dst[start:], p.Length, p.Checksum[:])
+		copy(dst[start+headerSize:], p.Data)
+		return dst, nil
+	}
+	start := len(dst)
+	dst = grow(dst, headerSize+encryptedLen(len(p.Data)))
+	buf := dst[start:]
+	n := c.encrypt(buf[headerSize:], p.Data)
+	p.marshalHeader(buf, uint16(headerSize+n), c.token[:])
+	checksum := md5.Sum(buf)
+	copy(buf[16:headerSize], checksum[:])
+	return dst, nil
 }
 
 func (p *Packet) encode(checksum []byte) ([]byte, error) {
-	buf := new(bytes.Buffer)
 	if len(checksum) == 0 {
 		checksum = p.Checksum[:]
 	} else if len(checksum) != 16 {
 		return nil, errInvalidChecksumLength
 	}
-	for _, v := range []interface{}{p.Magic, p.Length, p.Unused, p.DeviceID, p.TimeStamp, checksum, p.Data} {
-		if dataLen(v) == 0 { // empty []byte
-			continue
-		}
-		if err := binary.Write(buf, binary.BigEndian, v); err != nil {
-			return nil, err
-		}
-	}
-	return buf.Bytes(), nil
+	buf := make([]byte, headerSize+len(p.Data))
+	p.marshalHeader(buf, p.Length, checksum)
+	copy(buf[headerSize:], p.Data)
+	return buf, nil
 }
 
 // CalcChecksum calculates the packet checksum
@@ -218,59 +299,19 @@ func (p *Packet) validateChecksum(token []byte) (bool, error) {
 	return bytes.Equal(checksum, p.Checksum[:]), nil
 }
 
-func (p *Packet) decrypt(token []byte) (*Packet, error) {
-	if len(token) == 0 || len(p.Data) == 0 {
-		return p, nil
-	}
-	if len(token) != 16 {
-		return nil, errInvalidTokenLength
+// decrypt decrypts the payload in place
+func (p *Packet) decrypt(c *Cipher) error {
+	if c == nil || len(p.Data) == 0 {
+		return nil
 	}
-	key := hash(token)
-	iv := hash(append(key, token...))
-	block, err := aes.NewCipher(key)
+	decrypted, err := c.decrypt(p.Data)
 	if err != nil {
-		return nil, err
-	}
-	if len(p.Data)%block.BlockSize() != 0 {
-		return nil, errInvalidDataLength
+		return err
 	}
-	stream := cipher.NewCBCDecrypter(block, iv)
-	decrypted := make([]byte, len(p.Data))
-	stream.CryptBlocks(decrypted, p.Data)
-	decrypted, _ = pkcs7strip(decrypted, block.BlockSize())
 	p.Data = decrypted
-	p.Length = 0x0020 + uint16(len(decrypted))
-	for i := range p.Checksum {
-		p.Checksum[i] = 0
-	}
-	return p, nil
-}
-
-func (p *Packet) encrypt(token []byte) (*Packet, error) {
-	if len(token) == 0 || len(p.Data) == 0 {
-		return p, nil
-	}
-	if len(token) != 16 {
-		return nil, errInvalidTokenLength
-	}
-	key := hash(token)
-	iv := hash(append(key, token...))
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		return nil, err
-	}
-	stream := cipher.NewCBCEncrypter(block, iv)
-	encrypted, _ := pkcs7pad(p.Data, block.BlockSize())
-	stream.CryptBlocks(encrypted, encrypted)
-	result := *p
-	result.Data = encrypted
-	result.Length = 0x0020 + uint16(len(encrypted))
-	checksum, err := result.CalcChecksum(token)
-	if err != nil {
-		return nil, err
-	}
-	copy(result.Checksum[:], checksum)
-	return &result, nil
+	p.Length = headerSize + uint16(len(decrypted))
+	p.Checksum = [16]byte{}
+	return nil
 }
 
 func (d Payload) String() string {
@@ -302,19 +343,14 @@ func (d Payload) string(quotes, simplify bool) string {
 	return string(d)
 }
 
-func dataLen(data interface{}) int {
-	switch data := data.(type) {
-	case nil:
-		return 0
-	case []byte:
-		return len(data)
-	}
-	return -1
-}
-
-func hash(data []byte) []byte {
-	digest := md5.Sum(data)
-	return digest[:]
+// grow extends the slice by n bytes, reallocating it only if the capacity is not enough
+func grow(data []byte, n int) []byte {
+	if len(data)+n <= cap(data) {
+		return data[:len(data)+n]
+	}
+	result := make([]byte, len(data)+n)
+	copy(result, data)
+	return result
 }
 
 func pkcs7pad(data []byte, blockSize int) ([]byte, error) {
@@ -325,8 +361,10 @@ func pkcs7pad(data []byte, blockSize int) ([]byte, error) {
 		return nil, errInvalidDataLength
 	}
 	padLen := blockSize - len(data)%blockSize
-	padding := bytes.Repeat([]byte{byte(padLen)}, padLen)
-	return append(data, padding...), nil
+	for i := 0; i < padLen; i++ {
+		data = append(data, byte(padLen))
+	}
+	return data, nil
 }
 
 func pkcs7strip(data []byte, blockSize int) ([]byte, error) {
@@ -338,9 +376,13 @@ func pkcs7strip(data []byte, blockSize int) ([]byte, error) {
 		return nil, errInvalidDataLength
 	}
 	padLen := int(data[length-1])
-	ref := bytes.Repeat([]byte{byte(padLen)}, padLen%(blockSize+1))
-	if padLen > blockSize || padLen == 0 || !bytes.HasSuffix(data, ref) {
+	if padLen > blockSize || padLen == 0 {
 		return nil, errInvalidPadding
 	}
+	for _, b := range data[length-padLen:] {
+		if int(b) != padLen {
+			return nil, errInvalidPadding
+		}
+	}
 	return data[:length-padLen], nil
 }
@@ -2,6 +2,7 @@ package miio
 
 import (
 	"bytes"
+	"encoding/hex"
 	"fmt"
 	"testing"
 
@@ -105,6 +106,48 @@ func Test_decode(t *testing.T) {
 	}
 }
 
+func Test_DecodeHello(t *testing.T) {
+	tests := []struct {
+		name  string
+		data  []byte
+		want  string
+		token []byte
+		err   error
+	}{
+		{
+			name: "Hello reply",
+			data: h.FromHex("2131002000000000102695f0000b7567ffffffffffffffffffffffffffffffff"),
+			want: `{deviceID:0x102695f0,uptime:"208h35m51s"}`,
+		},
+		{
+			name:  "Hello reply with token",
+			data:  h.FromHex("2131002000000000102695f0000b756700112233445566778899aabbccddeeff"),
+			want:  `{deviceID:0x102695f0,uptime:"208h35m51s"}`,
+			token: h.FromHex("00112233445566778899aabbccddeeff"),
+		},
+		{
+			name: "Invalid magic",
+			data: h.FromHex("2231002000000000102695f0000b756700112233445566778899aabbccddeeff"),
+			err:  errInvalidMagicField,
+		},
+		{
+			name: "Short packet",
+			data: h.FromHex("2131002000000000102695f0000b7567"),
+			err:  errInvalidDataLength,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, token, err := DecodeHello(tt.data)
+			h.AssertError(t, err, tt.err)
+			if err == nil {
+				h.AssertEqual(t, got.String(), tt.want)
+			}
+			h.AssertEqual(t, token, tt.token)
+		})
+	}
+}
+
 func Test_Decode(t *testing.T) {
 	tests := []struct {
 		name  string
@@ -602,14 +645,21 @@ func TestPacket_decrypt(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, err := tt.packet.decrypt(tt.token)
+			got := tt.packet
+			c, err := cipherFor(tt.token)
+			if err == nil {
+				err = got.decrypt(c)
+			}
+			if err != nil {
+				got = nil
+			}
 			h.AssertError(t, err, tt.err)
 			h.AssertEqual(t, got, tt.want)
 		})
 	}
 }
 
-func TestPacket_encrypt(t *testing.T) {
+func TestPacket_MarshalTo(t *testing.T) {
 	tests := []struct {
 		name   string
 		packet *Packet
@@ -703,7 +753,13 @@ func TestPacket_encrypt(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, err := tt.packet.encrypt(tt.token)
+			var got *Packet
+			c, err := cipherFor(tt.token)
+			if err == nil {
+				var raw []byte
+				raw, err = tt.packet.MarshalTo(make([]byte, 0, 256), c)
+				got = packetFromHex(hex.EncodeToString(raw))
+			}
 			h.AssertError(t, err, tt.err)
 			h.AssertEqual(t, got, tt.want)
 		})
@@ -770,46 +826,6 @@ func TestPacketData_string(t *testing.T) {
 	}
 }
 
-func Test_dataLen(t *testing.T) {
-	tests := []struct {
-		name string
-		data interface{}
-		want int
-	}{
-		{
-			name: "Non-empty data",
-			data: []byte{1, 2, 3, 4, 5},
-			want: 5,
-		},
-		{
-			name: "Empty data",
-			data: []byte{},
-			want: 0,
-		},
-		{
-			name: "Nil data",
-			data: nil,
-			want: 0,
-		},
-		{
-			name: "Integer data",
-			data: 123,
-			want: -1,
-		},
-		{
-			name: "String data",
-			data: "Hello",
-			want: -1,
-		},
-	}
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			got := dataLen(tt.data)
-			h.AssertEqual(t, got, tt.want)
-		})
-	}
-}
-
 func Test_pkcs7pad(t *testing.T) {
 	tests := []struct {
 		name      string
@@ -967,3 +983,63 @@ func packetFromHex(s string) *Packet {
 	}
 	return p
 }
+
+func TestPacket_UnmarshalFrom(t *testing.T) {
+	token := h.FromHex("9c3b2d1da5beceee2808a3d3653b485d")
+	c, err := NewCipher(token)
+	h.AssertError(t, err, nil)
+	data := h.FromHex("2131005000000000047bd1b5002feedece53f7b9e63ae50c3fc22fac87cc3ee7053510f79d4e36f4ff504d8da4391c467b067c3d5a777aca3ed402f9009821176bc6bffeb40994d5e6889e48836d54a6")
+	p := Packet{}
+	h.AssertError(t, p.UnmarshalFrom(data, c), nil)
+	h.AssertEqual(t, &p, NewPacket(0x047bd1b5, 0x002feede, []byte(`{"result":["on","on",4,100,"off","on"],"id":1}`)))
+	h.AssertEqual(t, &p.Data[0], &data[32]) // decrypted in place
+	h.AssertEqual(t, c.Token(), token)
+}
+
+func BenchmarkPacket_Encode(b *testing.B) {
+	token := h.FromHex("9c3b2d1da5beceee2808a3d3653b485d")
+	p := NewPacket(0x047bd1b5, 0x002feede, []byte(`{"id":1,"method":"get_prop","params":["power","usb_state","aqi","battery","time_state","night_state"]}`))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := p.Encode(token); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPacket_MarshalTo(b *testing.B) {
+	c, _ := NewCipher(h.FromHex("9c3b2d1da5beceee2808a3d3653b485d"))
+	p := NewPacket(0x047bd1b5, 0x002feede, []byte(`{"id":1,"method":"get_prop","params":["power","usb_state","aqi","battery","time_state","night_state"]}`))
+	buf := make([]byte, 0, 1024)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := p.MarshalTo(buf, c); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecode(b *testing.B) {
+	token := h.FromHex("9c3b2d1da5beceee2808a3d3653b485d")
+	data := h.FromHex("2131005000000000047bd1b5002feedece53f7b9e63ae50c3fc22fac87cc3ee7053510f79d4e36f4ff504d8da4391c467b067c3d5a777aca3ed402f9009821176bc6bffeb40994d5e6889e48836d54a6")
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := Decode(data, token); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPacket_UnmarshalFrom(b *testing.B) {
+	c, _ := NewCipher(h.FromHex("9c3b2d1da5beceee2808a3d3653b485d"))
+	data := h.FromHex("2131005000000000047bd1b5002feedece53f7b9e63ae50c3fc22fac87cc3ee7053510f79d4e36f4ff504d8da4391c467b067c3d5a777aca3ed402f9009821176bc6bffeb40994d5e6889e48836d54a6")
+	buf := make([]byte, len(data))
+	p := Packet{}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		copy(buf, data) // the payload is decrypted in place
+		if err := p.UnmarshalFrom(buf, c); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package miio
+
+import (
+	"time"
+)
+
+// Scheduler tracks when each device is polled next, every device is polled at its own interval
+// aligned to the interval boundaries, so devices sharing the interval are polled together
+type Scheduler struct {
+	Interval  time.Duration // default poll interval
+	AheadTime time.Duration // polls start this time before the interval boundary
+	Models    Models
+	next      map[*Device]time.Time
+}
+
+func NewScheduler(interval, aheadTime time.Duration, models Models) *Scheduler {
+	return &Scheduler{
+		Interval:  interval,
+		AheadTime: aheadTime,
+		Models:    models,
+		next:      map[*Device]time.Time{},
+	}
+}
+
+// DeviceInterval returns the poll interval configured for the device, its model or the default one
+func (s *Scheduler) DeviceInterval(d *Device) time.Duration {
+	if d.PollInterval > 0 {
+		return d.PollInterval
+	}
+	if interval := s.Models.PollInterval(d.Model()); interval > 0 {
+		return interval
+	}
+	return s.Interval
+}
+
+// Next returns the earliest time one of the devices is due to be polled
+func (s *Scheduler) Next(now time.Time, devices Devices) time.Time {
+	result := nextTime(now, s.Interval, s.AheadTime)
+	for _, d := range devices {
+		next, ok := s.next[d]
+		if !ok {
+			next = nextTime(now, s.DeviceInterval(d), s.AheadTime)
+		}
+		if next.Before(result) {
+			result = next
+		}
+	}
+	if result.Before(now) {
+		return now
+	}
+	return result
+}
+
+// Due checks if the device poll interval has elapsed
+func (s *Scheduler) Due(now time.Time) CheckDevice {
+	return func(d *Device) bool {
+		next, ok := s.next[d]
+		return !ok || !now.Before(next)
+	}
+}
+
+// Schedule picks the devices due to be polled now and schedules their next polls, whatever stage they are in,
+// so devices that failed to update are retried at their own interval too; updated due devices are reset to Valid.
+// Unreachable devices resting after failed polls skip the due poll, so the backoff is counted in their own intervals.
+// It returns the check of the picked devices
+func (s *Scheduler) Schedule(now time.Time, devices Devices) CheckDevice {
+	due := s.Due(now)
+	picked := map[*Device]bool{}
+	for _, d := range devices {
+		if !due(d) {
+			continue
+		}
+		s.next[d] = nextTime(now, s.DeviceInterval(d), s.AheadTime)
+		if d.SkipPoll() {
+			continue
+		}
+		picked[d] = true
+		if DeviceUpdated(d) {
+			d.SetStage(Valid)
+		}
+	}
+	return func(d *Device) bool {
+		return picked[d]
+	}
+}
+
+// Outdated checks if the device was not updated for two of its poll intervals
+func (s *Scheduler) Outdated() CheckDevice {
+	return func(d *Device) bool {
+		return DeviceOutdated(2 * TimeStamp(s.DeviceInterval(d)/time.Second))(d)
+	}
+}
+
+func nextTime(now time.Time, interval time.Duration, aheadTime time.Duration) time.Time {
+	result := now.Add(interval).Truncate(interval).Add(-aheadTime)
+	if !result.After(now) {
+		return result.Add(interval)
+	}
+	return result
+}
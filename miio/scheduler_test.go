@@ -0,0 +1,148 @@
+package miio
+
+import (
+	"testing"
+	"time"
+
+	h "github.com/eip/miio2mqtt/helpers"
+)
+
+func Test_nextTime(t *testing.T) {
+	base := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		now      time.Time
+		interval time.Duration
+		want     time.Time
+	}{
+		{name: "Before boundary", now: base.Add(3 * time.Second), interval: 10 * time.Second, want: base.Add(10*time.Second - 100*time.Millisecond)},
+		{name: "Ahead of boundary", now: base.Add(9950 * time.Millisecond), interval: 10 * time.Second, want: base.Add(20*time.Second - 100*time.Millisecond)},
+		{name: "At poll time", now: base.Add(9900 * time.Millisecond), interval: 10 * time.Second, want: base.Add(20*time.Second - 100*time.Millisecond)},
+		{name: "Minute", now: base.Add(3 * time.Second), interval: time.Minute, want: base.Add(time.Minute - 100*time.Millisecond)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := nextTime(tt.now, tt.interval, 100*time.Millisecond)
+			h.AssertEqual(t, got, tt.want)
+		})
+	}
+}
+
+func TestScheduler_DeviceInterval(t *testing.T) {
+	models := Models{"*": DefaultModel(), "zhimi.airmonitor.v1": Model{PollInterval: 5 * time.Second}}
+	s := NewScheduler(10*time.Second, 0, models)
+	tests := []struct {
+		name   string
+		device *Device
+		want   time.Duration
+	}{
+		{name: "Default", device: &Device{model: "yeelink.light.lamp2"}, want: 10 * time.Second},
+		{name: "Unidentified", device: &Device{}, want: 10 * time.Second},
+		{name: "Model", device: &Device{model: "zhimi.airmonitor.v1"}, want: 5 * time.Second},
+		{name: "Device", device: &Device{DeviceCfg: DeviceCfg{PollInterval: time.Minute}, model: "zhimi.airmonitor.v1"}, want: time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h.AssertEqual(t, s.DeviceInterval(tt.device), tt.want)
+		})
+	}
+}
+
+func TestScheduler(t *testing.T) {
+	models := Models{"zhimi.airmonitor.v1": Model{PollInterval: 5 * time.Second}}
+	s := NewScheduler(10*time.Second, 0, models)
+	monitor := &Device{model: "zhimi.airmonitor.v1", stage: Updated}
+	lamp := &Device{DeviceCfg: DeviceCfg{PollInterval: time.Minute}, stage: Updated}
+	plug := &Device{stage: Updated}
+	devices := Devices{1: monitor, 2: lamp, 3: plug}
+	base := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	next := s.Next(base.Add(time.Second), devices)
+	h.AssertEqual(t, next, base.Add(5*time.Second))
+	poll := s.Schedule(next, devices) // all devices are due on the first poll
+	h.AssertEqual(t, devices.Count(poll), 3)
+	h.AssertEqual(t, []DeviceStage{monitor.Stage(), lamp.Stage(), plug.Stage()}, []DeviceStage{Valid, Valid, Valid})
+
+	polled := map[*Device]int{}
+	now := next
+	for now.Before(base.Add(time.Minute)) {
+		devices.SetStage(Updated, AnyDevice)
+		now = s.Next(now, devices)
+		poll = s.Schedule(now, devices)
+		h.AssertEqual(t, devices.Count(s.Due(now)), 0)
+		for _, d := range devices {
+			if poll(d) {
+				h.AssertEqual(t, d.Stage(), Valid)
+				polled[d]++
+			}
+		}
+	}
+	h.AssertEqual(t, now, base.Add(time.Minute))
+	h.AssertEqual(t, polled[monitor], 11)
+	h.AssertEqual(t, polled[plug], 6)
+	h.AssertEqual(t, polled[lamp], 1)
+}
+
+func TestScheduler_failed(t *testing.T) {
+	s := NewScheduler(10*time.Second, 0, Models{})
+	failed := &Device{DeviceCfg: DeviceCfg{PollInterval: time.Minute}, stage: Found}
+	updated := &Device{stage: Updated}
+	devices := Devices{1: failed, 2: updated}
+	base := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	polled := map[*Device]int{}
+	now := base
+	for now.Before(base.Add(time.Minute)) {
+		now = s.Next(now, devices)
+		poll := s.Schedule(now, devices)
+		for _, d := range devices {
+			if poll(d) {
+				polled[d]++
+			}
+		}
+		updated.SetStage(Updated)
+	}
+	h.AssertEqual(t, polled[updated], 6)
+	h.AssertEqual(t, polled[failed], 2) // on the first poll and at its own interval, not retried by the polls of other devices
+	h.AssertEqual(t, failed.Stage(), Found)
+}
+
+func TestScheduler_backoff(t *testing.T) {
+	s := NewScheduler(5*time.Second, 0, Models{})
+	unreachable := &Device{DeviceCfg: DeviceCfg{PollInterval: time.Minute}}
+	fast := &Device{stage: Updated}
+	devices := Devices{1: unreachable, 2: fast}
+	base := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	probes := []int{}
+	now := base
+	for now.Before(base.Add(30 * time.Minute)) {
+		now = s.Next(now, devices)
+		poll := s.Schedule(now, devices)
+		if poll(unreachable) {
+			probes = append(probes, int(now.Sub(base)/time.Minute))
+			unreachable.PollFailed(3, 10)
+		}
+		fast.SetStage(Updated)
+	}
+	h.AssertEqual(t, probes, []int{0, 1, 3, 13, 23}) // skips are counted in the device minutes, not in the polls of others
+}
+
+func TestScheduler_Outdated(t *testing.T) {
+	s := NewScheduler(10*time.Second, 0, Models{})
+	tests := []struct {
+		name   string
+		device *Device
+		want   bool
+	}{
+		{name: "Default", device: &Device{updatedAt: Now() - 15*sec, stage: Updated}, want: false},
+		{name: "Default timeout", device: &Device{updatedAt: Now() - 21*sec, stage: Updated}, want: true},
+		{name: "Device", device: &Device{DeviceCfg: DeviceCfg{PollInterval: time.Minute}, updatedAt: Now() - 61*sec, stage: Updated}, want: false},
+		{name: "Device timeout", device: &Device{DeviceCfg: DeviceCfg{PollInterval: time.Minute}, updatedAt: Now() - 121*sec, stage: Updated}, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h.AssertEqual(t, s.Outdated()(tt.device), tt.want)
+		})
+	}
+}
@@ -0,0 +1,191 @@
+package sim
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eip/miio2mqtt/miio"
+)
+
+// DeviceCfg represents the simulated device properties and the faults it injects
+type DeviceCfg struct {
+	ID          uint32                      `yaml:"ID"`
+	Token       string                      `yaml:"Token"`
+	Model       string                      `yaml:"Model"`
+	Uptime      time.Duration               `yaml:"Uptime"` // uptime at the simulator start
+	Props       map[string]interface{}      `yaml:"Props"`
+	LeakToken   bool                        `yaml:"LeakToken"`   // send the token in hello replies like reset devices do
+	Latency     time.Duration               `yaml:"Latency"`     // reply delay
+	Loss        float64                     `yaml:"Loss"`        // probability of ignoring the request
+	BadChecksum float64                     `yaml:"BadChecksum"` // probability of the reply with a wrong checksum
+	Errors      map[string]miio.DeviceError `yaml:"Errors"`      // method name => error reply
+	Drop        map[string]int              `yaml:"Drop"`        // method name => number of its first requests left without reply
+}
+
+// Device is the simulated miIO device, lock it to change the faults while the simulator is running
+type Device struct {
+	sync.Mutex
+	DeviceCfg
+	Name     string
+	cipher   *miio.Cipher
+	bootTime time.Time
+	props    map[string]interface{}
+	requests []string // method and params of the handled requests
+}
+
+type request struct {
+	ID     uint32          `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+}
+
+type resultReply struct {
+	Result interface{} `json:"result"`
+	ID     uint32      `json:"id"`
+}
+
+type errorReply struct {
+	Error *miio.DeviceError `json:"error"`
+	ID    uint32            `json:"id"`
+}
+
+var errMethodNotFound = miio.DeviceError{Code: -32601, Message: "Method not found"}
+var errInvalidParams = miio.DeviceError{Code: -32602, Message: "Invalid params"}
+
+// NewDevice creates the simulated device, the token should be 32 hex digits
+func NewDevice(cfg DeviceCfg, name string) (*Device, error) {
+	token, err := hex.DecodeString(cfg.Token)
+	if err != nil {
+		return nil, fmt.Errorf("invalid token %q for %s - %v", cfg.Token, name, err)
+	}
+	c, err := miio.NewCipher(token)
+	if err != nil {
+		return nil, fmt.Errorf("invalid token length %q for %s", cfg.Token, name)
+	}
+	d := Device{
+		DeviceCfg: cfg,
+		Name:      name,
+		cipher:    c,
+		bootTime:  time.Now().Add(-cfg.Uptime),
+		props:     map[string]interface{}{},
+	}
+	for k, v := range cfg.Props {
+		d.props[k] = v
+	}
+	d.Drop = map[string]int{}
+	for k, v := range cfg.Drop {
+		d.Drop[k] = v
+	}
+	return &d, nil
+}
+
+// Prop returns the current property value
+func (d *Device) Prop(name string) interface{} {
+	d.Lock()
+	defer d.Unlock()
+	return d.props[name]
+}
+
+// SetProp changes the property value
+func (d *Device) SetProp(name string, value interface{}) {
+	d.Lock()
+	defer d.Unlock()
+	d.props[name] = value
+}
+
+// Requests returns the method and params of every request handled so far, e.g. `get_prop ["power"]`
+func (d *Device) Requests() []string {
+	d.Lock()
+	defer d.Unlock()
+	return append([]string(nil), d.requests...)
+}
+
+// uptime returns the packet timestamp, which is the device uptime in seconds
+func (d *Device) uptime(now time.Time) miio.TimeStamp {
+	return miio.TimeStamp(now.Sub(d.bootTime) / time.Second)
+}
+
+// HelloReply builds the reply to the hello packet
+func (d *Device) HelloReply(now time.Time) []byte {
+	p := miio.NewPacket(d.ID, d.uptime(now), nil)
+	if d.LeakToken {
+		copy(p.Checksum[:], d.cipher.Token())
+	} else {
+		for i := range p.Checksum {
+			p.Checksum[i] = 0xff
+		}
+	}
+	data, _ := p.MarshalTo(nil, nil)
+	return data
+}
+
+// Reply decodes the request packet and builds the encrypted reply, the request data is decrypted in place;
+// nil is returned for the dropped request
+func (d *Device) Reply(data []byte, now time.Time) ([]byte, error) {
+	p := miio.Packet{}
+	if err := p.UnmarshalFrom(data, d.cipher); err != nil {
+		return nil, err
+	}
+	req := request{}
+	if err := json.Unmarshal(p.Data, &req); err != nil {
+		return nil, fmt.Errorf("invalid request %s: %v", p.Data, err)
+	}
+	result := d.execute(&req, now)
+	if result == nil {
+		return nil, nil
+	}
+	payload, err := json.Marshal(result)
+	if err != nil {
+		return nil, err
+	}
+	return miio.NewPacket(d.ID, d.uptime(now), payload).MarshalTo(nil, d.cipher)
+}
+
+// execute runs the request method and returns the reply payload, nil if the request is dropped
+func (d *Device) execute(req *request, now time.Time) interface{} {
+	d.Lock()
+	defer d.Unlock()
+	d.requests = append(d.requests, fmt.Sprintf("%s %s", req.Method, req.Params))
+	if d.Drop[req.Method] > 0 {
+		d.Drop[req.Method]--
+		return nil
+	}
+	if e, ok := d.Errors[req.Method]; ok {
+		return errorReply{Error: &e, ID: req.ID}
+	}
+	switch {
+	case req.Method == "miIO.info":
+		return resultReply{Result: map[string]interface{}{
+			"model":  d.Model,
+			"fw_ver": "sim",
+			"hw_ver": "Linux",
+			"life":   int(d.uptime(now)),
+		}, ID: req.ID}
+	case req.Method == "get_prop":
+		params := []string{}
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return errorReply{Error: &errInvalidParams, ID: req.ID}
+		}
+		result := make([]interface{}, len(params))
+		for i, p := range params {
+			result[i] = d.props[p]
+		}
+		return resultReply{Result: result, ID: req.ID}
+	case strings.HasPrefix(req.Method, "set_"):
+		params := []interface{}{}
+		if err := json.Unmarshal(req.Params, &params); err != nil || len(params) == 0 {
+			return errorReply{Error: &errInvalidParams, ID: req.ID}
+		}
+		var value interface{} = params
+		if len(params) == 1 {
+			value = params[0]
+		}
+		d.props[strings.TrimPrefix(req.Method, "set_")] = value
+		return resultReply{Result: []string{"ok"}, ID: req.ID}
+	}
+	return errorReply{Error: &errMethodNotFound, ID: req.ID}
+}
@@ -0,0 +1,189 @@
+// Package sim simulates miIO devices on UDP, so the bridge can be run and tested without real hardware
+package sim
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/eip/miio2mqtt/miio"
+	log "github.com/go-pkgz/lgr"
+	"gopkg.in/yaml.v2"
+)
+
+const defaultAddress = ":54321"
+
+const helloDeviceID = 0xffffffff
+
+// Config represents the simulator configuration file
+type Config struct {
+	Address string               `yaml:"Address"` // UDP address to listen on, all devices share it
+	Devices map[string]DeviceCfg `yaml:"Devices"`
+}
+
+// Simulator serves the simulated devices on the UDP address, requests are routed by the packet device ID
+type Simulator struct {
+	Address    string
+	Connection *net.UDPConn
+	devices    map[uint32]*Device
+	random     *rand.Rand
+	randomLock sync.Mutex
+	cancel     context.CancelFunc
+}
+
+// LoadConfig reads the simulator configuration file
+func LoadConfig(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg := Config{Address: defaultAddress}
+	if err := yaml.UnmarshalStrict(data, &cfg); err != nil {
+		return nil, err
+	}
+	if len(cfg.Devices) == 0 {
+		return nil, errors.New("no devices configured")
+	}
+	return &cfg, nil
+}
+
+// New creates the simulator of the configured devices
+func New(cfg *Config) (*Simulator, error) {
+	s := Simulator{
+		Address: cfg.Address,
+		devices: map[uint32]*Device{},
+		random:  rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+	for name, dc := range cfg.Devices {
+		d, err := NewDevice(dc, name)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := s.devices[d.ID]; ok {
+			return nil, fmt.Errorf("duplicate device ID %08x of %s", d.ID, name)
+		}
+		s.devices[d.ID] = d
+	}
+	return &s, nil
+}
+
+// Device returns the simulated device by ID
+func (s *Simulator) Device(id uint32) *Device {
+	return s.devices[id]
+}
+
+// Start listens on the simulator address and serves requests until the context is done or Stop is called
+func (s *Simulator) Start(ctx context.Context, wg *sync.WaitGroup) error {
+	addr, err := net.ResolveUDPAddr("udp4", s.Address)
+	if err != nil {
+		return err
+	}
+	s.Connection, err = net.ListenUDP("udp4", addr)
+	if err != nil {
+		return err
+	}
+	ctx, s.cancel = context.WithCancel(ctx)
+	wg.Add(2)
+	go func() { defer wg.Done(); <-ctx.Done(); s.Connection.Close() }()
+	go func() { defer wg.Done(); s.serve(ctx) }()
+	log.Printf("[INFO] simulating %d devices on %v", len(s.devices), s.Connection.LocalAddr())
+	return nil
+}
+
+// Stop closes the simulator connection
+func (s *Simulator) Stop() {
+	if s.cancel != nil {
+		s.cancel()
+	}
+}
+
+// LocalAddr returns the address the simulator listens on
+func (s *Simulator) LocalAddr() *net.UDPAddr {
+	return s.Connection.LocalAddr().(*net.UDPAddr)
+}
+
+func (s *Simulator) serve(ctx context.Context) {
+	buffer := make([]byte, 1024)
+	for {
+		n, addr, err := s.Connection.ReadFromUDP(buffer)
+		if err != nil {
+			if ctx.Err() != nil {
+				log.Print("[DEBUG] simulator stopped")
+				return
+			}
+			log.Printf("[WARN] %v", err)
+			continue
+		}
+		s.handle(append([]byte(nil), buffer[:n]...), addr)
+	}
+}
+
+func (s *Simulator) handle(data []byte, addr *net.UDPAddr) {
+	did, err := miio.GetDeviceID(data)
+	if err != nil {
+		log.Printf("[WARN] invalid packet received from %v: %x (%v)", addr, data, err)
+		return
+	}
+	now := time.Now()
+	if did == helloDeviceID {
+		log.Printf("[DEBUG] hello from %v", addr)
+		for _, d := range s.devices {
+			s.send(d, d.HelloReply(now), addr)
+		}
+		return
+	}
+	d, ok := s.devices[did]
+	if !ok {
+		log.Printf("[DEBUG] request to unknown device %08x from %v", did, addr)
+		return
+	}
+	reply, err := d.Reply(data, now)
+	if err != nil {
+		log.Printf("[WARN] %s: unable to handle request from %v: %v", d.Name, addr, err)
+		return
+	}
+	if reply == nil {
+		log.Printf("[DEBUG] %s: request from %v is dropped", d.Name, addr)
+		return
+	}
+	s.send(d, reply, addr)
+}
+
+// send delivers the reply after the device latency, unless it is lost, the checksum may be spoiled
+func (s *Simulator) send(d *Device, reply []byte, addr *net.UDPAddr) {
+	d.Lock()
+	loss, badChecksum, latency := d.Loss, d.BadChecksum, d.Latency
+	d.Unlock()
+	if s.chance(loss) {
+		log.Printf("[DEBUG] %s: reply to %v is lost", d.Name, addr)
+		return
+	}
+	if s.chance(badChecksum) {
+		log.Printf("[DEBUG] %s: reply to %v has a wrong checksum", d.Name, addr)
+		reply[16] ^= 0xff // the first checksum byte
+	}
+	write := func() {
+		if _, err := s.Connection.WriteToUDP(reply, addr); err != nil {
+			log.Printf("[WARN] %s: %v", d.Name, err)
+		}
+	}
+	if latency > 0 {
+		time.AfterFunc(latency, write)
+		return
+	}
+	write()
+}
+
+func (s *Simulator) chance(p float64) bool {
+	if p <= 0 {
+		return false
+	}
+	s.randomLock.Lock()
+	defer s.randomLock.Unlock()
+	return s.random.Float64() < p
+}
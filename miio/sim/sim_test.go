@@ -0,0 +1,201 @@
+package sim
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	h "github.com/eip/miio2mqtt/helpers"
+	"github.com/eip/miio2mqtt/miio"
+)
+
+const testToken = "00112233445566778899aabbccddeeff"
+
+func testDevice(t *testing.T, cfg DeviceCfg) *Device {
+	t.Helper()
+	if len(cfg.Token) == 0 {
+		cfg.Token = testToken
+	}
+	d, err := NewDevice(cfg, "Test Device")
+	h.AssertError(t, err, nil)
+	return d
+}
+
+func encodeRequest(t *testing.T, id uint32, token string, payload string) []byte {
+	t.Helper()
+	data, err := miio.NewPacket(id, 0x1000, []byte(payload)).Encode(h.FromHex(token))
+	h.AssertError(t, err, nil)
+	return data
+}
+
+func TestNewDevice(t *testing.T) {
+	_, err := NewDevice(DeviceCfg{Token: "0011"}, "Short")
+	h.AssertError(t, err, errors.New(`invalid token length "0011" for Short`))
+	_, err = NewDevice(DeviceCfg{Token: "xyz"}, "Invalid")
+	h.AssertError(t, err, errors.New(`invalid token "xyz" for Invalid - encoding/hex: invalid byte: U+0078 'x'`))
+}
+
+func TestDevice_HelloReply(t *testing.T) {
+	d := testDevice(t, DeviceCfg{ID: 0x01234567, Uptime: time.Hour})
+	now := d.bootTime.Add(time.Hour)
+	p, token, err := miio.DecodeHello(d.HelloReply(now))
+	h.AssertError(t, err, nil)
+	h.AssertEqual(t, p.DeviceID, uint32(0x01234567))
+	h.AssertEqual(t, p.TimeStamp, miio.TimeStamp(3600))
+	h.AssertEqual(t, token == nil, true)
+
+	d.LeakToken = true
+	_, token, err = miio.DecodeHello(d.HelloReply(now))
+	h.AssertError(t, err, nil)
+	h.AssertEqual(t, token, h.FromHex(testToken))
+}
+
+func TestDevice_Reply(t *testing.T) {
+	d := testDevice(t, DeviceCfg{
+		ID:     0x01234567,
+		Model:  "yeelink.light.lamp2",
+		Props:  map[string]interface{}{"power": "off", "bright": 50},
+		Errors: map[string]miio.DeviceError{"set_ct_abx": {Code: -5001, Message: "invalid arg"}},
+	})
+	tests := []struct {
+		name    string
+		request string
+		token   string
+		want    string
+		err     error
+	}{
+		{
+			name:    "Info",
+			request: `{"method":"miIO.info","params":[],"id":1}`,
+			want:    `{"result":{"fw_ver":"sim","hw_ver":"Linux","life":0,"model":"yeelink.light.lamp2"},"id":1}`,
+		},
+		{
+			name:    "Set",
+			request: `{"method":"set_power","params":["on"],"id":2}`,
+			want:    `{"result":["ok"],"id":2}`,
+		},
+		{
+			name:    "Get",
+			request: `{"method":"get_prop","params":["power","bright","ct"],"id":3}`,
+			want:    `{"result":["on",50,null],"id":3}`,
+		},
+		{
+			name:    "Injected error",
+			request: `{"method":"set_ct_abx","params":[4000,"smooth",500],"id":4}`,
+			want:    `{"error":{"code":-5001,"message":"invalid arg"},"id":4}`,
+		},
+		{
+			name:    "Invalid params",
+			request: `{"method":"set_power","params":[],"id":5}`,
+			want:    `{"error":{"code":-32602,"message":"Invalid params"},"id":5}`,
+		},
+		{
+			name:    "Unknown method",
+			request: `{"method":"toggle","params":[],"id":6}`,
+			want:    `{"error":{"code":-32601,"message":"Method not found"},"id":6}`,
+		},
+		{
+			name:    "Wrong token",
+			request: `{"method":"miIO.info","params":[],"id":7}`,
+			token:   "ffeeddccbbaa99887766554433221100",
+			err:     errors.New("invalid checksum"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token := tt.token
+			if len(token) == 0 {
+				token = testToken
+			}
+			data, err := d.Reply(encodeRequest(t, d.ID, token, tt.request), d.bootTime)
+			h.AssertError(t, err, tt.err)
+			if err != nil {
+				return
+			}
+			reply, err := miio.Decode(data, h.FromHex(testToken))
+			h.AssertError(t, err, nil)
+			h.AssertEqual(t, string(reply.Data), tt.want)
+		})
+	}
+	h.AssertEqual(t, d.Prop("power"), "on")
+	h.AssertEqual(t, len(d.Requests()), 6)
+	h.AssertEqual(t, d.Requests()[2], `get_prop ["power","bright","ct"]`)
+}
+
+func TestDevice_Reply_drop(t *testing.T) {
+	d := testDevice(t, DeviceCfg{ID: 0x01234567, Drop: map[string]int{"miIO.info": 1}})
+	request := encodeRequest(t, d.ID, testToken, `{"method":"miIO.info","params":[],"id":1}`)
+	data, err := d.Reply(append([]byte(nil), request...), d.bootTime)
+	h.AssertError(t, err, nil)
+	h.AssertEqual(t, data == nil, true)
+	data, err = d.Reply(request, d.bootTime)
+	h.AssertError(t, err, nil)
+	h.AssertEqual(t, data == nil, false)
+	h.AssertEqual(t, d.Requests(), []string{"miIO.info []", "miIO.info []"})
+}
+
+func TestSimulator(t *testing.T) {
+	cfg, err := LoadConfig("../../cmd/miio-sim/sim_sample.yml")
+	h.AssertError(t, err, nil)
+	cfg.Address = "127.0.0.1:0"
+	s, err := New(cfg)
+	h.AssertError(t, err, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := sync.WaitGroup{}
+	defer wg.Wait()
+	defer cancel()
+	h.AssertError(t, s.Start(ctx, &wg), nil)
+	conn, err := net.DialUDP("udp4", nil, s.LocalAddr())
+	h.AssertError(t, err, nil)
+	defer conn.Close()
+	read := func() ([]byte, error) {
+		buf := make([]byte, 1024)
+		_ = conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		n, err := conn.Read(buf)
+		return buf[:n], err
+	}
+
+	hello, _ := miio.NewHelloPacket().Encode(nil)
+	_, err = conn.Write(hello)
+	h.AssertError(t, err, nil)
+	ids := map[uint32]bool{}
+	for range cfg.Devices {
+		data, err := read()
+		h.AssertError(t, err, nil)
+		p, _, err := miio.DecodeHello(data)
+		h.AssertError(t, err, nil)
+		ids[p.DeviceID] = true
+	}
+	h.AssertEqual(t, ids, map[uint32]bool{0x11223301: true, 0x11223302: true})
+
+	const token = "7e7e7e7e7e7e7e7e7e7e7e7e7e7e7e7e"
+	_, err = conn.Write(encodeRequest(t, 0x11223301, token, `{"method":"get_prop","params":["power","aqi"],"id":1}`))
+	h.AssertError(t, err, nil)
+	data, err := read()
+	h.AssertError(t, err, nil)
+	reply, err := miio.Decode(data, h.FromHex(token))
+	h.AssertError(t, err, nil)
+	h.AssertEqual(t, string(reply.Data), `{"result":["on",12],"id":1}`)
+
+	d := s.Device(0x11223301)
+	d.Lock()
+	d.BadChecksum = 1
+	d.Unlock()
+	_, err = conn.Write(encodeRequest(t, 0x11223301, token, `{"method":"get_prop","params":["power"],"id":2}`))
+	h.AssertError(t, err, nil)
+	data, err = read()
+	h.AssertError(t, err, nil)
+	_, err = miio.Decode(data, h.FromHex(token))
+	h.AssertError(t, err, errors.New("invalid checksum"))
+
+	d.Lock()
+	d.Loss = 1
+	d.Unlock()
+	_, err = conn.Write(encodeRequest(t, 0x11223301, token, `{"method":"get_prop","params":["power"],"id":3}`))
+	h.AssertError(t, err, nil)
+	_, err = read()
+	h.AssertEqual(t, err != nil, true)
+}
@@ -0,0 +1,134 @@
+package miio
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// DeviceState is what was learned about the device, kept across restarts so it is not discovered again
+type DeviceState struct {
+	ID         uint32    `json:"id"`
+	Address    string    `json:"address"`
+	Model      string    `json:"model"`
+	TimeShift  TimeStamp `json:"time_shift,omitempty"` // zero if the device time was not known when saved
+	Properties string    `json:"properties,omitempty"` // last published state
+	UpdatedAt  TimeStamp `json:"updated_at"`
+}
+
+// State returns the learned state of the device, it reports false if the device is not identified yet
+func (d *Device) State() (DeviceState, bool) {
+	d.Lock()
+	defer d.Unlock()
+	if d.stage < Found || len(d.model) == 0 || d.ID == 0 {
+		return DeviceState{}, false
+	}
+	properties := d.properties
+	if d.stateChangedAt > d.statePublishedAt {
+		properties = "" // not published yet, so it is published after the restart
+	}
+	return DeviceState{
+		ID:         d.ID,
+		Address:    d.Address,
+		Model:      d.model,
+		TimeShift:  d.timeShift,
+		Properties: properties,
+		UpdatedAt:  d.updatedAt,
+	}, true
+}
+
+// RestoreState makes the device identified with the saved state, so it is polled without hello and miIO.info;
+// the state is ignored if it does not match the configured ID or address. The restored time shift is trusted
+// until the first error or unanswered request, the device is found again with hello then (see ResetRestored).
+// The device is treated as updated now, so it is discovered again if it does not reply within the outdate timeout
+func (d *Device) RestoreState(s DeviceState) bool {
+	if s.ID == 0 || len(s.Model) == 0 || len(s.Address) == 0 {
+		return false
+	}
+	if d.ID != 0 && d.ID != s.ID || len(d.Address) > 0 && d.Address != s.Address {
+		return false
+	}
+	now := Now()
+	d.Lock()
+	defer d.Unlock()
+	d.ID = s.ID
+	d.Address = s.Address
+	d.model = s.Model
+	d.timeShift = s.TimeShift
+	d.properties = s.Properties
+	d.updatedAt = now
+	d.stateChangedAt = now
+	d.statePublishedAt = now
+	d.stage = Found
+	if s.TimeShift != 0 {
+		d.stage = Valid
+		d.restored = true
+	}
+	return true
+}
+
+// ConfirmRestored trusts the restored time shift once the device replied without error
+func (d *Device) ConfirmRestored() {
+	d.Lock()
+	d.restored = false
+	d.Unlock()
+}
+
+// ResetRestored forgets the restored time shift which is not confirmed yet, e.g. the device was rebooted meanwhile,
+// so the device is found again with hello; it reports whether the device was reset
+func (d *Device) ResetRestored() bool {
+	d.Lock()
+	defer d.Unlock()
+	if !d.restored {
+		return false
+	}
+	d.restored = false
+	d.timeShift = 0
+	d.stage = Found
+	d.batches = nil
+	return true
+}
+
+// LoadState reads the state file, device name => state, a missing file is not an error
+func LoadState(path string) (map[string]DeviceState, error) {
+	result := map[string]DeviceState{}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return result, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// SaveState replaces the state file with the state of identified devices
+func SaveState(path string, devices Devices) error {
+	states := map[string]DeviceState{}
+	for _, d := range devices {
+		if s, ok := d.State(); ok {
+			states[d.Name] = s
+		}
+	}
+	data, err := json.MarshalIndent(states, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
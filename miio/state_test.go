@@ -0,0 +1,134 @@
+package miio
+
+import (
+	"path/filepath"
+	"testing"
+
+	h "github.com/eip/miio2mqtt/helpers"
+)
+
+func TestDevice_State(t *testing.T) {
+	tests := []struct {
+		name   string
+		device *Device
+		want   DeviceState
+		ok     bool
+	}{
+		{name: "Undiscovered", device: &Device{DeviceCfg: DeviceCfg{ID: 0x11223344}, stage: Undiscovered}},
+		{name: "Found", device: &Device{DeviceCfg: DeviceCfg{ID: 0x11223344}, timeShift: 1000 * sec, stage: Found}},
+		{
+			name:   "Restored without time",
+			device: &Device{DeviceCfg: DeviceCfg{ID: 0x11223344, Address: "192.168.1.11"}, model: "zhimi.airmonitor.v1", stage: Found},
+			want:   DeviceState{ID: 0x11223344, Address: "192.168.1.11", Model: "zhimi.airmonitor.v1"},
+			ok:     true,
+		},
+		{
+			name:   "Valid",
+			device: &Device{DeviceCfg: DeviceCfg{ID: 0x11223344, Address: "192.168.1.11"}, model: "zhimi.airmonitor.v1", timeShift: 1000 * sec, stage: Valid},
+			want:   DeviceState{ID: 0x11223344, Address: "192.168.1.11", Model: "zhimi.airmonitor.v1", TimeShift: 1000 * sec},
+			ok:     true,
+		},
+		{
+			name: "Published",
+			device: &Device{DeviceCfg: DeviceCfg{ID: 0x11223344, Address: "192.168.1.11"}, model: "zhimi.airmonitor.v1", timeShift: 1000 * sec,
+				properties: `{"aqi":10}`, updatedAt: 2000 * sec, stateChangedAt: 2000 * sec, statePublishedAt: 2000 * sec, stage: Updated},
+			want: DeviceState{ID: 0x11223344, Address: "192.168.1.11", Model: "zhimi.airmonitor.v1", TimeShift: 1000 * sec,
+				Properties: `{"aqi":10}`, UpdatedAt: 2000 * sec},
+			ok: true,
+		},
+		{
+			name: "Unpublished",
+			device: &Device{DeviceCfg: DeviceCfg{ID: 0x11223344, Address: "192.168.1.11"}, model: "zhimi.airmonitor.v1", timeShift: 1000 * sec,
+				properties: `{"aqi":10}`, updatedAt: 2000 * sec, stateChangedAt: 2000 * sec, statePublishedAt: 1000 * sec, stage: Updated},
+			want: DeviceState{ID: 0x11223344, Address: "192.168.1.11", Model: "zhimi.airmonitor.v1", TimeShift: 1000 * sec, UpdatedAt: 2000 * sec},
+			ok:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := tt.device.State()
+			h.AssertEqual(t, ok, tt.ok)
+			h.AssertEqual(t, got, tt.want)
+		})
+	}
+}
+
+func TestDevice_RestoreState(t *testing.T) {
+	state := DeviceState{ID: 0x11223344, Address: "192.168.1.11", Model: "zhimi.airmonitor.v1", TimeShift: 1000 * sec, Properties: `{"aqi":10}`, UpdatedAt: 2000 * sec}
+	tests := []struct {
+		name  string
+		cfg   DeviceCfg
+		state DeviceState
+		want  bool
+	}{
+		{name: "ID", cfg: DeviceCfg{ID: 0x11223344}, state: state, want: true},
+		{name: "Address", cfg: DeviceCfg{Address: "192.168.1.11"}, state: state, want: true},
+		{name: "Other ID", cfg: DeviceCfg{ID: 0x11223345}, state: state, want: false},
+		{name: "Other address", cfg: DeviceCfg{Address: "192.168.1.12"}, state: state, want: false},
+		{name: "Not identified", cfg: DeviceCfg{ID: 0x11223344}, state: DeviceState{ID: 0x11223344, Address: "192.168.1.11", TimeShift: 1000 * sec}, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := NewDevice(tt.cfg, "AirMonitor")
+			h.AssertEqual(t, d.RestoreState(tt.state), tt.want)
+			if !tt.want {
+				h.AssertEqual(t, d.Stage(), Undiscovered)
+				return
+			}
+			h.AssertEqual(t, d.Stage(), Valid)
+			h.AssertEqual(t, d.ID, tt.state.ID)
+			h.AssertEqual(t, d.Address, tt.state.Address)
+			h.AssertEqual(t, d.Model(), tt.state.Model)
+			h.AssertEqual(t, d.Properties(), tt.state.Properties)
+			h.AssertEqual(t, d.StateChangeUnpublished(), false)
+			h.AssertEqual(t, d.UpdatedIn() <= 1*sec, true)
+			ts, err := d.TimeStamp(Now())
+			h.AssertError(t, err, nil)
+			h.AssertEqual(t, ts, Now()-tt.state.TimeShift)
+		})
+	}
+}
+
+func TestDevice_ResetRestored(t *testing.T) {
+	state := DeviceState{ID: 0x11223344, Address: "192.168.1.11", Model: "zhimi.airmonitor.v1", TimeShift: 1000 * sec}
+	d := NewDevice(DeviceCfg{ID: 0x11223344}, "AirMonitor")
+	h.AssertEqual(t, d.RestoreState(state), true)
+	h.AssertEqual(t, d.ResetRestored(), true)
+	h.AssertEqual(t, d.Stage(), Found)
+	h.AssertEqual(t, d.TimeShiftKnown(), false)
+	h.AssertEqual(t, d.Model(), state.Model)
+	h.AssertEqual(t, d.ResetRestored(), false)
+
+	d = NewDevice(DeviceCfg{ID: 0x11223344}, "AirMonitor")
+	h.AssertEqual(t, d.RestoreState(state), true)
+	d.ConfirmRestored()
+	h.AssertEqual(t, d.ResetRestored(), false) // the time shift is trusted after the first reply
+	h.AssertEqual(t, d.Stage(), Valid)
+
+	state.TimeShift = 0 // saved before the device time was learned again
+	d = NewDevice(DeviceCfg{ID: 0x11223344}, "AirMonitor")
+	h.AssertEqual(t, d.RestoreState(state), true)
+	h.AssertEqual(t, d.Stage(), Found)
+	h.AssertEqual(t, d.ResetRestored(), false)
+}
+
+func TestState_SaveLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	states, err := LoadState(path)
+	h.AssertError(t, err, nil)
+	h.AssertEqual(t, states, map[string]DeviceState{})
+
+	identified := NewDevice(DeviceCfg{ID: 0x11223344}, "AirMonitor")
+	identified.RestoreState(DeviceState{ID: 0x11223344, Address: "192.168.1.11", Model: "zhimi.airmonitor.v1", TimeShift: 1000 * sec, Properties: `{"aqi":10}`})
+	devices := Devices{
+		0x11223344: identified,
+		0xc0a8010c: NewDevice(DeviceCfg{Address: "192.168.1.12"}, "DeskLamp"),
+	}
+	h.AssertError(t, SaveState(path, devices), nil)
+
+	states, err = LoadState(path)
+	h.AssertError(t, err, nil)
+	h.AssertEqual(t, states, map[string]DeviceState{
+		"AirMonitor": {ID: 0x11223344, Address: "192.168.1.11", Model: "zhimi.airmonitor.v1", TimeShift: 1000 * sec, Properties: `{"aqi":10}`, UpdatedAt: identified.UpdatedAt()},
+	})
+}
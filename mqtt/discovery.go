@@ -0,0 +1,181 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/eip/miio2mqtt/config"
+	h "github.com/eip/miio2mqtt/helpers"
+	"github.com/eip/miio2mqtt/miio"
+	log "github.com/go-pkgz/lgr"
+)
+
+const (
+	discoveryIDPrefix   = "miio2mqtt_"
+	discoveryBirthTopic = "/status"
+	discoveryBirthOn    = "online"
+)
+
+type discoveryDevice struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Model        string   `json:"model,omitempty"`
+	Manufacturer string   `json:"manufacturer"`
+}
+
+type discoveryAvailability struct {
+	Topic string `json:"topic"`
+}
+
+type discoveryConfig struct {
+	Name              string                  `json:"name"`
+	UniqueID          string                  `json:"unique_id"`
+	StateTopic        string                  `json:"state_topic"`
+	ValueTemplate     string                  `json:"value_template,omitempty"`
+	CommandTopic      string                  `json:"command_topic,omitempty"`
+	PayloadOn         string                  `json:"payload_on,omitempty"`
+	PayloadOff        string                  `json:"payload_off,omitempty"`
+	StateOn           string                  `json:"state_on,omitempty"`
+	StateOff          string                  `json:"state_off,omitempty"`
+	UnitOfMeasurement string                  `json:"unit_of_measurement,omitempty"`
+	DeviceClass       string                  `json:"device_class,omitempty"`
+	QoS               byte                    `json:"qos,omitempty"`
+	Availability      []discoveryAvailability `json:"availability,omitempty"`
+	AvailabilityMode  string                  `json:"availability_mode,omitempty"`
+	Device            discoveryDevice         `json:"device"`
+}
+
+// SubscribeDiscovery subscribes to Home Assistant birth messages to republish discovery configs
+// and to retained discovery configs to remove the ones of devices no longer configured
+func (c *Client) SubscribeDiscovery(devices miio.Devices) error {
+	prefix := c.config.Mqtt.DiscoveryPrefix
+	if len(prefix) == 0 {
+		return nil
+	}
+	configured := map[string]bool{}
+	for _, d := range devices {
+		configured[h.Slug(d.Name)] = true
+	}
+	return c.addSubscriptions(map[string]mqtt.MessageHandler{
+		prefix + discoveryBirthTopic: func(_ mqtt.Client, msg mqtt.Message) {
+			if string(msg.Payload()) != discoveryBirthOn {
+				return
+			}
+			log.Print("[DEBUG] Home Assistant is online, republishing discovery")
+			go c.republishDiscovery()
+		},
+		prefix + "/+/+/+/config": func(_ mqtt.Client, msg mqtt.Message) {
+			if staleDiscovery(configured, msg.Topic(), msg.Payload()) {
+				go c.removeDiscovery(msg.Topic())
+			}
+		},
+	})
+}
+
+// PublishDiscovery publishes retained Home Assistant discovery configs for every device param
+func (c *Client) PublishDiscovery(device *miio.Device) error {
+	prefix := c.config.Mqtt.DiscoveryPrefix
+	if len(prefix) == 0 || len(device.Topic) == 0 {
+		return nil
+	}
+	c.Lock()
+	c.discovered[device.Name] = device
+	c.Unlock()
+	model := device.Model()
+	node := h.Slug(device.Name)
+	for _, param := range c.config.Models.Params(model) {
+		meta := c.config.Models.Discovery(model, param)
+		topic := fmt.Sprintf("%s/%s/%s/%s/config", prefix, meta.Component, node, h.Slug(param))
+		payload, err := json.Marshal(c.discoveryConfig(device, param, meta))
+		if err != nil {
+			return err
+		}
+		if err := c.publish(&message{topic: topic, retained: true, payload: payload}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Client) discoveryConfig(device *miio.Device, param string, meta miio.ParamDiscovery) *discoveryConfig {
+	node := h.Slug(device.Name)
+	result := &discoveryConfig{
+		Name:              fmt.Sprintf("%s %s", device.Name, param),
+		UniqueID:          fmt.Sprintf("%s%s_%s", discoveryIDPrefix, node, h.Slug(param)),
+		StateTopic:        device.Topic,
+		ValueTemplate:     fmt.Sprintf("{{ value_json.%s }}", param),
+		UnitOfMeasurement: meta.Unit,
+		DeviceClass:       meta.DeviceClass,
+		QoS:               c.qos(device),
+		Device: discoveryDevice{
+			Identifiers:  []string{discoveryIDPrefix + node},
+			Name:         device.Name,
+			Model:        device.Model(),
+			Manufacturer: "Xiaomi",
+		},
+	}
+	if c.config.Mqtt.PublishMode == config.PublishProperties {
+		result.StateTopic = device.Topic + "/" + param
+		result.ValueTemplate = ""
+	}
+	if len(c.config.Mqtt.StatusTopic) > 0 {
+		result.Availability = append(result.Availability, discoveryAvailability{Topic: c.config.Mqtt.StatusTopic})
+	}
+	result.Availability = append(result.Availability, discoveryAvailability{Topic: device.Topic + availabilityTopicSuffix})
+	result.AvailabilityMode = "all"
+	on, off := c.stateValue("on"), c.stateValue("off")
+	switch meta.Component {
+	case "binary_sensor":
+		result.PayloadOn, result.PayloadOff = on, off
+	case "switch":
+		result.CommandTopic = device.Topic + commandTopicSuffix
+		result.PayloadOn = fmt.Sprintf(`{"%s":"on"}`, param)
+		result.PayloadOff = fmt.Sprintf(`{"%s":"off"}`, param)
+		result.StateOn, result.StateOff = on, off
+	}
+	return result
+}
+
+// stateValue returns the published representation of the device property value
+func (c *Client) stateValue(value string) string {
+	if fixed, ok := c.config.Properties[value]; ok {
+		return fmt.Sprint(fixed)
+	}
+	return value
+}
+
+func (c *Client) republishDiscovery() {
+	c.Lock()
+	devices := make([]*miio.Device, 0, len(c.discovered))
+	for _, d := range c.discovered {
+		devices = append(devices, d)
+	}
+	c.Unlock()
+	for _, d := range devices {
+		if err := c.PublishDiscovery(d); err != nil {
+			log.Printf("[WARN] unable to publish %s discovery: %v", d.Name, err)
+		}
+	}
+}
+
+// staleDiscovery checks if the discovery config was published by miio2mqtt for a device no longer configured
+func staleDiscovery(configured map[string]bool, topic string, payload []byte) bool {
+	if len(payload) == 0 {
+		return false
+	}
+	cfg := discoveryConfig{}
+	if err := json.Unmarshal(payload, &cfg); err != nil || !strings.HasPrefix(cfg.UniqueID, discoveryIDPrefix) {
+		return false
+	}
+	parts := strings.Split(topic, "/")
+	return len(parts) >= 3 && !configured[parts[len(parts)-3]]
+}
+
+func (c *Client) removeDiscovery(topic string) {
+	log.Printf("[INFO] removing discovery config of unknown device: %s", topic)
+	if err := c.publish(&message{topic: topic, retained: true, payload: []byte{}}); err != nil {
+		log.Printf("[WARN] unable to remove discovery config %s: %v", topic, err)
+	}
+}
@@ -0,0 +1,110 @@
+package mqtt
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/eip/miio2mqtt/config"
+	h "github.com/eip/miio2mqtt/helpers"
+	"github.com/eip/miio2mqtt/miio"
+)
+
+func testDiscoveryClient() *Client {
+	config := testConfig()
+	config.Mqtt.DiscoveryPrefix = "homeassistant"
+	config.Models["dummy.test.v1"] = miio.Model{
+		Params: []string{"power", "temp"},
+		Discovery: map[string]miio.ParamDiscovery{
+			"power": {Component: "switch"},
+			"temp":  {Unit: "°C", DeviceClass: "temperature"},
+		},
+	}
+	return connectedTestClient(config)
+}
+
+func TestClient_PublishDiscovery(t *testing.T) {
+	client := testDiscoveryClient()
+	mock := client.mqtt.(*mockMqttClient)
+	device := testDevice("home/devices/test", "")
+	device.Name = "Test Device"
+	device.SetModel("dummy.test.v1")
+	err := client.PublishDiscovery(device)
+	h.AssertError(t, err, nil)
+	h.AssertEqual(t, mock.published, []string{
+		`homeassistant/switch/test_device/power/config: {"name":"Test Device power","unique_id":"miio2mqtt_test_device_power","state_topic":"home/devices/test","value_template":"{{ value_json.power }}","command_topic":"home/devices/test/set","payload_on":"{\"power\":\"on\"}","payload_off":"{\"power\":\"off\"}","state_on":"1","state_off":"0","availability":[{"topic":"miio2mqtt/status"},{"topic":"home/devices/test/availability"}],"availability_mode":"all","device":{"identifiers":["miio2mqtt_test_device"],"name":"Test Device","model":"dummy.test.v1","manufacturer":"Xiaomi"}}`,
+		`homeassistant/sensor/test_device/temp/config: {"name":"Test Device temp","unique_id":"miio2mqtt_test_device_temp","state_topic":"home/devices/test","value_template":"{{ value_json.temp }}","unit_of_measurement":"°C","device_class":"temperature","availability":[{"topic":"miio2mqtt/status"},{"topic":"home/devices/test/availability"}],"availability_mode":"all","device":{"identifiers":["miio2mqtt_test_device"],"name":"Test Device","model":"dummy.test.v1","manufacturer":"Xiaomi"}}`,
+	})
+	h.AssertEqual(t, client.discovered["Test Device"], device)
+
+	mock.published = nil
+	client.republishDiscovery()
+	h.AssertEqual(t, len(mock.published), 2)
+}
+
+func TestClient_PublishDiscovery_Properties(t *testing.T) {
+	client := testDiscoveryClient()
+	client.config.Mqtt.PublishMode = config.PublishProperties
+	mock := client.mqtt.(*mockMqttClient)
+	device := testDevice("home/devices/test", "")
+	device.Name = "Test Device"
+	device.SetModel("dummy.test.v1")
+	err := client.PublishDiscovery(device)
+	h.AssertError(t, err, nil)
+	h.AssertEqual(t, mock.publishData, regexp.MustCompile(`^homeassistant/sensor/test_device/temp/config: \{"name":"Test Device temp","unique_id":"miio2mqtt_test_device_temp","state_topic":"home/devices/test/temp","unit_of_measurement"`))
+}
+
+func TestClient_PublishDiscovery_Disabled(t *testing.T) {
+	client := testDiscoveryClient()
+	client.config.Mqtt.DiscoveryPrefix = ""
+	mock := client.mqtt.(*mockMqttClient)
+	device := testDevice("home/devices/test", "")
+	device.SetModel("dummy.test.v1")
+	err := client.PublishDiscovery(device)
+	h.AssertError(t, err, nil)
+	h.AssertEqual(t, mock.publishCalls, 0)
+	h.AssertEqual(t, mock.connectCalls, 0)
+	h.AssertError(t, client.SubscribeDiscovery(miio.Devices{1: device}), nil)
+	h.AssertEqual(t, len(mock.subscribed), 0)
+}
+
+func TestClient_PublishDiscovery_Default(t *testing.T) {
+	client := connectedTestClient(testConfig())
+	mock := client.mqtt.(*mockMqttClient)
+	device := testDevice("home/devices/test", "")
+	device.SetModel("dummy.test.v1")
+	h.AssertError(t, client.PublishDiscovery(device), nil)
+	h.AssertEqual(t, mock.publishCalls, 0)
+}
+
+func TestClient_SubscribeDiscovery(t *testing.T) {
+	client := testDiscoveryClient()
+	mock := client.mqtt.(*mockMqttClient)
+	err := client.SubscribeDiscovery(miio.Devices{1: testDevice("home/devices/test", "")})
+	h.AssertError(t, err, nil)
+	_, ok := mock.subscribed["homeassistant/status"]
+	h.AssertEqual(t, ok, true)
+	_, ok = mock.subscribed["homeassistant/+/+/+/config"]
+	h.AssertEqual(t, ok, true)
+}
+
+func Test_staleDiscovery(t *testing.T) {
+	configured := map[string]bool{"desk_lamp": true}
+	tests := []struct {
+		name    string
+		topic   string
+		payload string
+		want    bool
+	}{
+		{name: "Empty payload", topic: "homeassistant/sensor/old_lamp/power/config", payload: "", want: false},
+		{name: "Invalid payload", topic: "homeassistant/sensor/old_lamp/power/config", payload: "foo", want: false},
+		{name: "Foreign config", topic: "homeassistant/sensor/old_lamp/power/config", payload: `{"unique_id":"zigbee_power"}`, want: false},
+		{name: "Configured device", topic: "homeassistant/sensor/desk_lamp/power/config", payload: `{"unique_id":"miio2mqtt_desk_lamp_power"}`, want: false},
+		{name: "Removed device", topic: "homeassistant/sensor/old_lamp/power/config", payload: `{"unique_id":"miio2mqtt_old_lamp_power"}`, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := staleDiscovery(configured, tt.topic, []byte(tt.payload))
+			h.AssertEqual(t, got, tt.want)
+		})
+	}
+}
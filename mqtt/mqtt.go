@@ -1,9 +1,18 @@
 package mqtt
 
 import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/eclipse/paho.golang/paho"
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/eip/miio2mqtt/config"
 	h "github.com/eip/miio2mqtt/helpers"
@@ -11,61 +20,656 @@ import (
 	log "github.com/go-pkgz/lgr"
 )
 
+const (
+	statusOnline  = "online"
+	statusOffline = "offline"
+)
+
+const (
+	availabilityTopicSuffix = "/availability"
+	errorTopicSuffix        = "/error"
+	commandTopicSuffix      = "/set"
+	rpcTopicSuffix          = "/rpc"
+	rpcResponseTopicSuffix  = "/rpc/response"
+)
+
+// ConnectionState represents the MQTT broker connection state
+type ConnectionState int32
+
+const (
+	Disconnected ConnectionState = iota
+	Connecting
+	Connected
+	Reconnecting
+)
+
+func (s ConnectionState) String() string {
+	switch s {
+	case Disconnected:
+		return "disconnected"
+	case Connecting:
+		return "connecting"
+	case Connected:
+		return "connected"
+	case Reconnecting:
+		return "reconnecting"
+	}
+	return "unknown"
+}
+
+const connectRetryInterval = 10 * time.Second
+
+var errQueueDisabled = errors.New("not connected to MQTT broker")
+
 type Client struct {
-	config *config.Config
-	mqtt   mqtt.Client
+	sync.Mutex
+	config        *config.Config
+	mqtt          mqtt.Client
+	state         int32
+	states        chan ConnectionState
+	queue         []*message // messages published while disconnected
+	flushing      bool
+	outbox        *outbox
+	subscriptions map[string]mqtt.MessageHandler
+	discovered    map[string]*miio.Device
+	published     map[string]map[string]string // topic => param => last published value
+	routes        map[string]*responseRoute    // device topic + RPC request id => response route
+}
+
+type message struct {
+	topic      string
+	qos        byte
+	retained   bool
+	payload    []byte
+	persist    bool      // device state to be stored in the outbox
+	time       time.Time // time the message was queued at
+	properties *publishProperties
+}
+
+// CommandHandler processes the command or RPC request payload received for the device
+type CommandHandler func(device *miio.Device, payload []byte)
+
+// deviceError is the payload of the device error topic
+type deviceError struct {
+	*miio.DeviceError
+	Time string `json:"time"`
+}
+
+// inventoryEntry is the payload of the discovered device token topic
+type inventoryEntry struct {
+	ID      string `json:"id"`
+	Address string `json:"address"`
+	Token   string `json:"token"`
+	Time    string `json:"time"`
+}
+
+// responseRoute is the MQTT 5 response topic and correlation data of the RPC request
+type responseRoute struct {
+	topic           string
+	correlationData []byte
 }
 
-var mqttFactory = mqtt.NewClient
+var (
+	mqttFactory   = mqtt.NewClient
+	mqttV5Factory = newV5Client
+)
 
-func NewClient(config *config.Config) *Client {
-	client := &Client{config: config}
-	client.mqtt = mqttFactory(client.createOptions())
-	return client
+func NewClient(config *config.Config) (*Client, error) {
+	client := &Client{
+		config:        config,
+		states:        make(chan ConnectionState, 4),
+		subscriptions: map[string]mqtt.MessageHandler{},
+		discovered:    map[string]*miio.Device{},
+		published:     map[string]map[string]string{},
+		routes:        map[string]*responseRoute{},
+	}
+	opts, err := client.createOptions()
+	if err != nil {
+		return nil, err
+	}
+	if client.v5() {
+		client.mqtt = mqttV5Factory(opts)
+	} else {
+		client.mqtt = mqttFactory(opts)
+	}
+	if len(config.Mqtt.Outbox) > 0 {
+		client.outbox = newOutbox(config.Mqtt.Outbox, config.Mqtt.OutboxMaxAge, int64(config.Mqtt.OutboxMaxSize))
+		queue, err := client.outbox.load()
+		if err != nil {
+			return nil, fmt.Errorf("unable to load MQTT outbox: %v", err)
+		}
+		if len(queue) > 0 {
+			log.Printf("[INFO] %d messages loaded from %s", len(queue), config.Mqtt.Outbox)
+		}
+		client.queue = queue
+	}
+	return client, nil
 }
 
-func (c *Client) createOptions() *mqtt.ClientOptions {
+func (c *Client) createOptions() (*mqtt.ClientOptions, error) {
 	opts := mqtt.NewClientOptions()
 	opts.AddBroker(c.config.Mqtt.BrokerURL)
-	opts.SetClientID(fmt.Sprintf("miio2mqtt-%06x", time.Now().UnixNano()%0x1000000))
+	if len(c.config.Mqtt.ClientID) > 0 {
+		opts.SetClientID(c.config.Mqtt.ClientID)
+	} else {
+		opts.SetClientID(fmt.Sprintf("miio2mqtt-%06x", time.Now().UnixNano()%0x1000000))
+	}
+	opts.SetUsername(c.config.Mqtt.Username)
+	opts.SetPassword(c.config.Mqtt.Password)
+	tlsConfig, err := newTLSConfig(c.config.Mqtt)
+	if err != nil {
+		return nil, fmt.Errorf("invalid MQTT TLS configuration: %v", err)
+	}
+	if tlsConfig != nil {
+		opts.SetTLSConfig(tlsConfig)
+	}
+	if c.config.Mqtt.KeepAlive > 0 {
+		opts.SetKeepAlive(c.config.Mqtt.KeepAlive)
+	}
+	opts.SetCleanSession(c.config.Mqtt.CleanSession)
+	if version := c.config.Mqtt.ProtocolVersion; version == 3 || version == 4 {
+		opts.SetProtocolVersion(uint(version))
+	}
 	opts.SetConnectTimeout(c.config.PushTimeout)
-	opts.SetAutoReconnect(false)
+	opts.SetAutoReconnect(true)
+	opts.SetMaxReconnectInterval(c.config.Mqtt.MaxReconnect)
+	opts.SetConnectRetry(true)
+	opts.SetConnectRetryInterval(connectRetryInterval)
+	opts.SetOnConnectHandler(c.connectHandler())
 	opts.SetConnectionLostHandler(c.connectionLostHandler())
-	return opts
+	opts.SetReconnectingHandler(c.reconnectingHandler())
+	if len(c.config.Mqtt.StatusTopic) > 0 {
+		opts.SetWill(c.config.Mqtt.StatusTopic, statusOffline, 0, true)
+	}
+	return opts, nil
+}
+
+// State returns the current broker connection state
+func (c *Client) State() ConnectionState {
+	return ConnectionState(atomic.LoadInt32(&c.state))
+}
+
+// StateChanges returns the channel of broker connection state changes
+func (c *Client) StateChanges() <-chan ConnectionState {
+	return c.states
 }
 
+func (c *Client) setState(state ConnectionState) {
+	if ConnectionState(atomic.SwapInt32(&c.state, int32(state))) != state {
+		c.notify(state)
+	}
+}
+
+func (c *Client) notify(state ConnectionState) {
+	select {
+	case c.states <- state:
+	default:
+	}
+}
+
+// Connect starts connecting to the broker, the connection is retried and restored in background
 func (c *Client) Connect() error {
-	if c.mqtt.IsConnected() {
+	if !atomic.CompareAndSwapInt32(&c.state, int32(Disconnected), int32(Connecting)) {
 		return nil
 	}
+	c.notify(Connecting)
 	log.Printf("[DEBUG] connecting to %v...", c.config.Mqtt.BrokerURL)
 	token := c.mqtt.Connect()
-	if token.Wait() && token.Error() != nil {
+	if !token.WaitTimeout(c.config.PushTimeout) {
+		log.Printf("[WARN] unable to connect to %v, retrying in background", c.config.Mqtt.BrokerURL)
+		return nil
+	}
+	if token.Error() != nil {
+		c.setState(Disconnected)
 		return token.Error()
 	}
-	log.Printf("[DEBUG] connected to %v", c.config.Mqtt.BrokerURL)
 	return nil
 }
 
 func (c *Client) Disconnect() {
+	if c.State() == Connected && len(c.config.Mqtt.StatusTopic) > 0 {
+		if err := c.publishStatus(statusOffline); err != nil {
+			log.Printf("[WARN] unable to publish bridge status: %v", err)
+		}
+	}
 	c.mqtt.Disconnect(uint(c.config.PushTimeout / time.Millisecond))
+	c.setState(Disconnected)
+	c.Lock()
+	dropped := 0
+	for _, msg := range c.queue {
+		if !msg.persist || c.outbox == nil {
+			dropped++
+		}
+	}
+	if dropped > 0 {
+		log.Printf("[WARN] %d queued MQTT messages were dropped", dropped)
+	}
+	c.queue = nil
+	c.Unlock()
 	log.Printf("[DEBUG] disconnected from %v", c.config.Mqtt.BrokerURL)
 }
 
 func (c *Client) Publish(device *miio.Device) error {
-	if err := c.Connect(); err != nil {
+	if c.config.Mqtt.PublishMode != config.PublishProperties {
+		msg := &message{topic: device.Topic, qos: c.qos(device), retained: c.retain(device), payload: []byte(device.Properties()), persist: true}
+		msg.properties = c.stateProperties(device)
+		if err := c.publish(msg); err != nil {
+			return err
+		}
+	}
+	if c.config.Mqtt.PublishMode != config.PublishJSON {
+		if err := c.publishProperties(device); err != nil {
+			return err
+		}
+	}
+	device.SetStatePublishedNow()
+	return nil
+}
+
+// publishProperties publishes changed device properties to <Topic>/<param> as scalar values
+func (c *Client) publishProperties(device *miio.Device) error {
+	props := map[string]interface{}{}
+	dec := json.NewDecoder(strings.NewReader(device.Properties()))
+	dec.UseNumber()
+	if err := dec.Decode(&props); err != nil {
+		return fmt.Errorf("invalid %s properties: %v", device.Name, err)
+	}
+	keys := make([]string, 0, len(props))
+	for k := range props {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	c.Lock()
+	published, ok := c.published[device.Topic]
+	if !ok {
+		published = map[string]string{}
+		c.published[device.Topic] = published
+	}
+	c.Unlock()
+	for _, key := range keys {
+		payload := scalarPayload(props[key])
+		if last, ok := published[key]; ok && last == payload {
+			continue
+		}
+		msg := &message{topic: device.Topic + "/" + key, qos: c.qos(device), retained: c.retain(device), payload: []byte(payload), persist: true}
+		msg.properties = c.stateProperties(device)
+		if err := c.publish(msg); err != nil {
+			return err
+		}
+		published[key] = payload
+	}
+	return nil
+}
+
+// publish sends the message to the broker, or queues it until the connection is restored
+func (c *Client) publish(msg *message) error {
+	c.Lock()
+	if c.State() != Connected || c.flushing {
+		defer c.Unlock()
+		return c.enqueue(msg)
+	}
+	if len(c.queue) > 0 { // previous flush was interrupted
+		err := c.enqueue(msg)
+		c.Unlock()
+		c.flush()
 		return err
 	}
-	if token := c.mqtt.Publish(device.Topic, 0, true, device.Properties()); token.Wait() && token.Error() != nil {
+	c.Unlock()
+	err := c.send(msg)
+	if err != nil && (c.State() != Connected || msg.persist && c.outbox != nil) {
+		c.Lock()
+		defer c.Unlock()
+		return c.enqueue(msg)
+	}
+	return err
+}
+
+// enqueue adds the message to the queue dropping the oldest one if the queue is full, should be called with the lock held
+func (c *Client) enqueue(msg *message) error {
+	size := c.config.Mqtt.QueueSize
+	if size <= 0 {
+		return errQueueDisabled
+	}
+	if len(c.queue) >= size {
+		log.Printf("[WARN] MQTT queue is full, dropping message to %s", c.queue[0].topic)
+		c.queue = c.queue[1:]
+	}
+	if msg.time.IsZero() {
+		msg.time = time.Now()
+	}
+	c.queue = append(c.queue, msg)
+	log.Printf("[DEBUG] queue message to %s (%d queued)", msg.topic, len(c.queue))
+	if msg.persist && c.outbox != nil {
+		if err := c.outbox.append(msg, c.queue); err != nil {
+			log.Printf("[WARN] unable to write MQTT outbox: %v", err)
+		}
+	}
+	return nil
+}
+
+// flush publishes queued messages in order while connected
+func (c *Client) flush() {
+	c.Lock()
+	if c.flushing {
+		c.Unlock()
+		return
+	}
+	c.flushing = true
+	count := len(c.queue)
+	c.Unlock()
+	if count > 0 {
+		log.Printf("[DEBUG] publishing %d queued messages", count)
+	}
+	defer c.saveOutbox()
+	for {
+		c.Lock()
+		if len(c.queue) == 0 || c.State() != Connected {
+			c.flushing = false
+			c.Unlock()
+			return
+		}
+		msg := c.queue[0]
+		c.queue = c.queue[1:]
+		c.Unlock()
+		replay := *msg
+		if msg.persist && c.outbox != nil {
+			if c.outbox.expired(msg) {
+				log.Printf("[DEBUG] drop expired message to %s queued at %v", msg.topic, msg.time.Format(time.RFC3339))
+				continue
+			}
+			replay.payload, replay.properties = c.replayed(msg)
+		}
+		if err := c.send(&replay); err != nil {
+			log.Printf("[WARN] unable to publish queued message to %s: %v", msg.topic, err)
+			c.Lock()
+			c.queue = append([]*message{msg}, c.queue...)
+			c.flushing = false
+			c.Unlock()
+			return
+		}
+	}
+}
+
+// saveOutbox rewrites the outbox file with messages left in the queue
+func (c *Client) saveOutbox() {
+	if c.outbox == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	if err := c.outbox.save(c.queue); err != nil {
+		log.Printf("[WARN] unable to write MQTT outbox: %v", err)
+	}
+}
+
+func (c *Client) send(msg *message) error {
+	var payload interface{} = msg.payload
+	if c.v5() && msg.properties != nil {
+		payload = &publishPayload{data: msg.payload, properties: msg.properties}
+	}
+	token := c.mqtt.Publish(msg.topic, msg.qos, msg.retained, payload)
+	if !token.WaitTimeout(c.config.PushTimeout) {
+		return fmt.Errorf("publish to %s timed out", msg.topic)
+	}
+	if token.Error() != nil {
 		return token.Error()
 	}
-	device.SetStatePublishedNow()
-	log.Printf("[DEBUG] publish to %s: %s", device.Topic, h.StripJSONQuotes(device.Properties()))
+	log.Printf("[DEBUG] publish to %s: %s", msg.topic, h.StripJSONQuotes(string(msg.payload)))
+	return nil
+}
+
+// qos returns the device QoS override or the global one
+func (c *Client) qos(device *miio.Device) byte {
+	if device.QoS != nil {
+		return *device.QoS
+	}
+	return c.config.Mqtt.QoS
+}
+
+// retain returns the device Retain override or the global one
+func (c *Client) retain(device *miio.Device) bool {
+	if device.Retain != nil {
+		return *device.Retain
+	}
+	return c.config.Mqtt.Retain
+}
+
+func scalarPayload(value interface{}) string {
+	switch value := value.(type) {
+	case string:
+		return value
+	case json.Number:
+		return value.String()
+	case nil:
+		return ""
+	case bool, float64:
+		return fmt.Sprint(value)
+	}
+	data, _ := json.Marshal(value)
+	return string(data)
+}
+
+// PublishAvailability publishes the device online/offline state to <Topic>/availability
+func (c *Client) PublishAvailability(device *miio.Device) error {
+	if len(device.Topic) == 0 {
+		return nil
+	}
+	payload := statusOffline
+	if device.Available() {
+		payload = statusOnline
+	}
+	return c.publish(&message{topic: device.Topic + availabilityTopicSuffix, qos: c.qos(device), retained: true, payload: []byte(payload)})
+}
+
+// PublishError publishes the last device error to <Topic>/error, the retained error is cleared once the device is updated
+func (c *Client) PublishError(device *miio.Device) error {
+	if len(device.Topic) == 0 {
+		return nil
+	}
+	payload := []byte{}
+	if err := device.LastError(); err != nil {
+		data, jerr := json.Marshal(deviceError{DeviceError: err, Time: time.Now().Format(time.RFC3339)})
+		if jerr != nil {
+			return jerr
+		}
+		payload = data
+	}
+	return c.publish(&message{topic: device.Topic + errorTopicSuffix, qos: c.qos(device), retained: true, payload: payload})
+}
+
+// PublishToken publishes the token leaked by the device to <InventoryTopic>/<device ID>,
+// it is not retained as the token is a credential controlling the device
+func (c *Client) PublishToken(token *miio.DiscoveredToken) error {
+	if len(c.config.Mqtt.InventoryTopic) == 0 {
+		return nil
+	}
+	payload, err := json.Marshal(inventoryEntry{
+		ID:      fmt.Sprintf("%#08x", token.ID),
+		Address: token.Address,
+		Token:   hex.EncodeToString(token.Token),
+		Time:    time.Now().Format(time.RFC3339),
+	})
+	if err != nil {
+		return err
+	}
+	topic := fmt.Sprintf("%s/%08x", c.config.Mqtt.InventoryTopic, token.ID)
+	return c.publish(&message{topic: topic, qos: c.config.Mqtt.QoS, payload: payload})
+}
+
+func (c *Client) publishStatus(status string) error {
+	return c.send(&message{topic: c.config.Mqtt.StatusTopic, retained: true, payload: []byte(status)})
+}
+
+// SubscribeCommands subscribes to <Topic>/set command topics of the devices
+func (c *Client) SubscribeCommands(devices miio.Devices, handler CommandHandler) error {
+	return c.subscribeDevices(devices, commandTopicSuffix, func(device *miio.Device, msg mqtt.Message) {
+		handler(device, msg.Payload())
+	})
+}
+
+// SubscribeRPC subscribes to <Topic>/rpc request topics of the devices
+func (c *Client) SubscribeRPC(devices miio.Devices, handler CommandHandler) error {
+	return c.subscribeDevices(devices, rpcTopicSuffix, func(device *miio.Device, msg mqtt.Message) {
+		c.addResponseRoute(device, msg)
+		handler(device, msg.Payload())
+	})
+}
+
+// PublishResponse publishes the RPC response to <Topic>/rpc/response,
+// or to the response topic with the correlation data of the MQTT 5 request
+func (c *Client) PublishResponse(device *miio.Device, payload []byte) error {
+	msg := &message{topic: device.Topic + rpcResponseTopicSuffix, qos: c.qos(device), payload: payload}
+	if route := c.takeResponseRoute(device, payload); route != nil {
+		msg.topic = route.topic
+		msg.properties = &publishProperties{CorrelationData: route.correlationData}
+	}
+	return c.publish(msg)
+}
+
+func (c *Client) subscribeDevices(devices miio.Devices, suffix string, handler func(*miio.Device, mqtt.Message)) error {
+	handlers := map[string]mqtt.MessageHandler{}
+	for _, d := range devices {
+		if len(d.Topic) == 0 {
+			continue
+		}
+		device := d
+		handlers[device.Topic+suffix] = func(_ mqtt.Client, msg mqtt.Message) {
+			log.Printf("[DEBUG] %s for %s: %s", msg.Topic(), device.Name, msg.Payload())
+			handler(device, msg)
+		}
+	}
+	return c.addSubscriptions(handlers)
+}
+
+func (c *Client) v5() bool {
+	return c.config.Mqtt.ProtocolVersion == 5
+}
+
+// replayed returns the payload and properties of the device state replayed from the outbox, its original time
+// is carried by the timestamp user property on MQTT 5; MQTT 3 has no properties, so only JSON object payloads get it
+func (c *Client) replayed(msg *message) ([]byte, *publishProperties) {
+	if !c.v5() {
+		return withTimestamp(msg.payload, msg.time), msg.properties
+	}
+	props := publishProperties{}
+	if msg.properties != nil {
+		props = *msg.properties
+		props.User = append(paho.UserProperties{}, props.User...)
+	}
+	props.User.Add(outboxTimestampKey, msg.time.Format(time.RFC3339))
+	return msg.payload, &props
+}
+
+// stateProperties returns MQTT 5 properties of the device state message
+func (c *Client) stateProperties(device *miio.Device) *publishProperties {
+	if !c.v5() {
+		return nil
+	}
+	result := &publishProperties{MessageExpiry: c.config.Mqtt.MessageExpiry}
+	result.User.Add("device_id", fmt.Sprintf("%08x", device.ID))
+	if model := device.Model(); len(model) > 0 {
+		result.User.Add("model", model)
+	}
+	if ts := device.UpdatedAt(); ts > 0 {
+		result.User.Add("updated", ts.Time().Format(time.RFC3339))
+	}
+	return result
+}
+
+// addResponseRoute remembers the response topic of the MQTT 5 RPC request
+func (c *Client) addResponseRoute(device *miio.Device, msg mqtt.Message) {
+	req, ok := msg.(interface {
+		ResponseTopic() string
+		CorrelationData() []byte
+	})
+	if !ok || len(req.ResponseTopic()) == 0 {
+		return
+	}
+	c.Lock()
+	c.routes[device.Topic+rpcID(msg.Payload())] = &responseRoute{topic: req.ResponseTopic(), correlationData: req.CorrelationData()}
+	c.Unlock()
+}
+
+func (c *Client) takeResponseRoute(device *miio.Device, payload []byte) *responseRoute {
+	key := device.Topic + rpcID(payload)
+	c.Lock()
+	defer c.Unlock()
+	route := c.routes[key]
+	delete(c.routes, key)
+	return route
+}
+
+// rpcID returns the compacted id of the RPC request or response
+func rpcID(payload []byte) string {
+	data := struct {
+		ID json.RawMessage `json:"id"`
+	}{}
+	if err := json.Unmarshal(payload, &data); err != nil || len(data.ID) == 0 {
+		return ""
+	}
+	id := bytes.Buffer{}
+	if err := json.Compact(&id, data.ID); err != nil {
+		return ""
+	}
+	return id.String()
+}
+
+// addSubscriptions subscribes to the topics if connected, subscriptions are made and restored on every (re)connect
+func (c *Client) addSubscriptions(handlers map[string]mqtt.MessageHandler) error {
+	c.Lock()
+	for topic, handler := range handlers {
+		c.subscriptions[topic] = handler
+	}
+	c.Unlock()
+	if c.State() == Connected {
+		return c.subscribe()
+	}
 	return nil
 }
 
+func (c *Client) subscribe() error {
+	c.Lock()
+	subscriptions := make(map[string]mqtt.MessageHandler, len(c.subscriptions))
+	for topic, handler := range c.subscriptions {
+		subscriptions[topic] = handler
+	}
+	c.Unlock()
+	for topic, handler := range subscriptions {
+		if token := c.mqtt.Subscribe(topic, c.config.Mqtt.QoS, handler); token.Wait() && token.Error() != nil {
+			return token.Error()
+		}
+		log.Printf("[DEBUG] subscribed to %s", topic)
+	}
+	return nil
+}
+
+// connectHandler restores subscriptions, publishes the bridge status and queued messages on every (re)connect
+func (c *Client) connectHandler() mqtt.OnConnectHandler {
+	return func(client mqtt.Client) {
+		log.Printf("[DEBUG] connected to %v", c.config.Mqtt.BrokerURL)
+		c.setState(Connected)
+		if err := c.subscribe(); err != nil {
+			log.Printf("[WARN] unable to subscribe to MQTT topics: %v", err)
+		}
+		if len(c.config.Mqtt.StatusTopic) > 0 {
+			if err := c.publishStatus(statusOnline); err != nil {
+				log.Printf("[WARN] unable to publish bridge status: %v", err)
+			}
+		}
+		c.flush()
+	}
+}
+
 func (c *Client) connectionLostHandler() mqtt.ConnectionLostHandler {
 	return func(client mqtt.Client, err error) {
 		log.Printf("[WARN] disconnected from %v: %v", c.config.Mqtt.BrokerURL, err)
+		c.setState(Reconnecting)
+	}
+}
+
+func (c *Client) reconnectingHandler() mqtt.ReconnectHandler {
+	return func(client mqtt.Client, opts *mqtt.ClientOptions) {
+		log.Printf("[DEBUG] reconnecting to %v...", c.config.Mqtt.BrokerURL)
+		c.setState(Reconnecting)
 	}
 }
@@ -1,6 +1,7 @@
 package mqtt
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/url"
@@ -42,6 +43,11 @@ type mockMqttClient struct {
 	connectErr      error
 	publishErr      error
 	publishData     string
+	publishQoS      byte
+	publishRetained bool
+	published       []string
+	subscribeErr    error
+	subscribed      map[string]mqtt.MessageHandler
 	connectCalls    int
 	disconnectCalls int
 	publishCalls    int
@@ -63,6 +69,10 @@ func (c *mockMqttClient) IsConnectionOpen() bool {
 
 func (c *mockMqttClient) Connect() mqtt.Token {
 	c.connectCalls++
+	c.isConnected = c.connectErr == nil
+	if c.isConnected && c.opts.OnConnect != nil {
+		c.opts.OnConnect(c)
+	}
 	return &mockMqttToken{err: c.connectErr}
 }
 
@@ -73,11 +83,19 @@ func (c *mockMqttClient) Disconnect(quiesce uint) {
 func (c *mockMqttClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
 	c.publishCalls++
 	c.publishData = fmt.Sprintf("%s: %s", topic, payload)
+	c.publishQoS, c.publishRetained = qos, retained
+	c.published = append(c.published, c.publishData)
 	return &mockMqttToken{err: c.publishErr}
 }
 
 func (c *mockMqttClient) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
-	return nil
+	if c.subscribed == nil {
+		c.subscribed = map[string]mqtt.MessageHandler{}
+	}
+	if c.subscribeErr == nil {
+		c.subscribed[topic] = callback
+	}
+	return &mockMqttToken{err: c.subscribeErr}
 }
 
 func (c *mockMqttClient) SubscribeMultiple(filters map[string]byte, callback mqtt.MessageHandler) mqtt.Token {
@@ -96,8 +114,22 @@ func (c *mockMqttClient) UpdateLastReceived() {}
 
 func (c *mockMqttClient) UpdateLastSent() {}
 
+type mockMqttMessage struct {
+	topic   string
+	payload []byte
+}
+
+func (m *mockMqttMessage) Duplicate() bool   { return false }
+func (m *mockMqttMessage) Qos() byte         { return 0 }
+func (m *mockMqttMessage) Retained() bool    { return false }
+func (m *mockMqttMessage) Topic() string     { return m.topic }
+func (m *mockMqttMessage) MessageID() uint16 { return 0 }
+func (m *mockMqttMessage) Payload() []byte   { return m.payload }
+func (m *mockMqttMessage) Ack()              {}
+
 func init() {
 	mqttFactory = mockMqttClientFactory
+	mqttV5Factory = mockMqttClientFactory
 }
 
 func testConfig() *config.Config {
@@ -114,66 +146,135 @@ func testDevice(topic, properties string) *miio.Device {
 	return device
 }
 
+func newTestClient(config *config.Config) *Client {
+	client, err := NewClient(config)
+	if err != nil {
+		panic(err)
+	}
+	return client
+}
+
+// connectedTestClient returns the connected client with reset mock counters
+func connectedTestClient(config *config.Config) *Client {
+	client := newTestClient(config)
+	if err := client.Connect(); err != nil {
+		panic(err)
+	}
+	mock := client.mqtt.(*mockMqttClient)
+	mock.connectCalls, mock.publishCalls, mock.publishData, mock.published = 0, 0, "", nil
+	return client
+}
+
 func Test_NewClient(t *testing.T) {
 	config := testConfig()
-	got := NewClient(config)
+	got, err := NewClient(config)
+	h.AssertError(t, err, nil)
 	h.AssertEqual(t, got.config, config)
 	gotOpts := got.mqtt.(*mockMqttClient).opts
 	h.AssertEqual(t, len(gotOpts.Servers), 1)
 	h.AssertEqual(t, gotOpts.ClientID, regexp.MustCompile(`miio2mqtt-[0-9a-f]{6}$`))
+
+	config.Mqtt.CAFile = "nonexistent.crt"
+	got, err = NewClient(config)
+	h.AssertError(t, err, errors.New("invalid MQTT TLS configuration: open nonexistent.crt: no such file or directory"))
+	h.AssertEqual(t, got == nil, true)
 }
 
 func TestClient_createOptions(t *testing.T) {
 	config := testConfig()
 	client := &Client{config: config}
-	got := client.createOptions()
+	got, err := client.createOptions()
+	h.AssertError(t, err, nil)
 	brokerURL, _ := url.Parse(config.Mqtt.BrokerURL)
 	h.AssertEqual(t, got.Servers, []*url.URL{brokerURL})
 	h.AssertEqual(t, got.ClientID, regexp.MustCompile(`miio2mqtt-[0-9a-f]{6}$`))
 	h.AssertEqual(t, got.ConnectTimeout, config.PushTimeout)
-	h.AssertEqual(t, got.AutoReconnect, false)
+	h.AssertEqual(t, got.AutoReconnect, true)
+	h.AssertEqual(t, got.MaxReconnectInterval, time.Minute)
+	h.AssertEqual(t, got.ConnectRetry, true)
+	h.AssertEqual(t, got.ConnectRetryInterval, connectRetryInterval)
+	h.AssertEqual(t, got.WillEnabled, true)
+	h.AssertEqual(t, got.WillTopic, "miio2mqtt/status")
+	h.AssertEqual(t, got.WillPayload, []byte("offline"))
+	h.AssertEqual(t, got.WillRetained, true)
+	h.AssertEqual(t, got.OnConnect != nil, true)
+	h.AssertEqual(t, got.OnReconnecting != nil, true)
+	h.AssertEqual(t, got.TLSConfig == nil, true)
 
 	testLog.Reset()
 	got.OnConnectionLost(nil, errors.New("connection lost error"))
 	h.AssertEqual(t, testLog.Message, "[WARN]  disconnected from tcp://localhost:1883: connection lost error\n")
+	h.AssertEqual(t, client.State(), Reconnecting)
 
 	def := mqtt.NewClientOptions()
 	got.Servers = def.Servers
 	got.ClientID = def.ClientID
 	got.ConnectTimeout = def.ConnectTimeout
 	got.AutoReconnect = def.AutoReconnect
+	got.MaxReconnectInterval = def.MaxReconnectInterval
+	got.ConnectRetry, got.ConnectRetryInterval = def.ConnectRetry, def.ConnectRetryInterval
+	got.WillEnabled, got.WillTopic, got.WillPayload, got.WillRetained = def.WillEnabled, def.WillTopic, def.WillPayload, def.WillRetained
+	got.OnConnect = def.OnConnect
+	got.OnReconnecting = def.OnReconnecting
 	got.OnConnectionLost, def.OnConnectionLost = nil, nil // reflect.DeepEqual func values workaround
 	h.AssertEqual(t, got, def)
 }
 
+func TestClient_createOptions_Identity(t *testing.T) {
+	config := testConfig()
+	config.Mqtt.ClientID = "miio2mqtt-test"
+	config.Mqtt.Username = "user"
+	config.Mqtt.Password = "secret"
+	config.Mqtt.KeepAlive = time.Minute
+	config.Mqtt.CleanSession = false
+	config.Mqtt.InsecureSkipVerify = true
+	client := &Client{config: config}
+	got, err := client.createOptions()
+	h.AssertError(t, err, nil)
+	h.AssertEqual(t, got.ClientID, "miio2mqtt-test")
+	h.AssertEqual(t, got.Username, "user")
+	h.AssertEqual(t, got.Password, "secret")
+	h.AssertEqual(t, got.KeepAlive, int64(60))
+	h.AssertEqual(t, got.CleanSession, false)
+	h.AssertEqual(t, got.TLSConfig.InsecureSkipVerify, true)
+}
+
 func TestClient_Connect(t *testing.T) {
 	tests := []struct {
 		name         string
 		client       *Client
 		err          error
 		connectCalls int
+		state        ConnectionState
 	}{
 		{
-			name:         "Already connected",
-			client:       func() *Client { c := NewClient(testConfig()); c.mqtt.(*mockMqttClient).isConnected = true; return c }(),
+			name: "Already connected",
+			client: func() *Client {
+				c := newTestClient(testConfig())
+				c.setState(Connected)
+				return c
+			}(),
 			err:          nil,
 			connectCalls: 0,
+			state:        Connected,
 		},
 		{
 			name:         "Success",
-			client:       NewClient(testConfig()),
+			client:       newTestClient(testConfig()),
 			err:          nil,
 			connectCalls: 1,
+			state:        Connected,
 		},
 		{
 			name: "Error",
 			client: func() *Client {
-				c := NewClient(testConfig())
+				c := newTestClient(testConfig())
 				c.mqtt.(*mockMqttClient).connectErr = errors.New("connect error")
 				return c
 			}(),
 			err:          errors.New("connect error"),
 			connectCalls: 1,
+			state:        Disconnected,
 		},
 	}
 	for _, tt := range tests {
@@ -183,16 +284,68 @@ func TestClient_Connect(t *testing.T) {
 			err := tt.client.Connect()
 			h.AssertError(t, err, tt.err)
 			h.AssertEqual(t, mock.connectCalls, tt.connectCalls)
+			h.AssertEqual(t, tt.client.State(), tt.state)
 		})
 	}
 }
 
 func TestClient_Disconnect(t *testing.T) {
-	client := NewClient(testConfig())
+	client := newTestClient(testConfig())
 	mock := client.mqtt.(*mockMqttClient)
 	h.AssertEqual(t, mock.disconnectCalls, 0)
 	client.Disconnect()
 	h.AssertEqual(t, mock.disconnectCalls, 1)
+	h.AssertEqual(t, mock.publishCalls, 0)
+
+	h.AssertError(t, client.Connect(), nil)
+	client.Disconnect()
+	h.AssertEqual(t, mock.disconnectCalls, 2)
+	h.AssertEqual(t, mock.publishData, "miio2mqtt/status: offline")
+	h.AssertEqual(t, client.State(), Disconnected)
+}
+
+func TestClient_PublishAvailability(t *testing.T) {
+	client := connectedTestClient(testConfig())
+	mock := client.mqtt.(*mockMqttClient)
+	device := testDevice("home/devices/test", "")
+	err := client.PublishAvailability(device)
+	h.AssertError(t, err, nil)
+	h.AssertEqual(t, mock.publishData, "home/devices/test/availability: offline")
+	device.SetAvailable(true)
+	err = client.PublishAvailability(device)
+	h.AssertError(t, err, nil)
+	h.AssertEqual(t, mock.publishData, "home/devices/test/availability: online")
+}
+
+func TestClient_PublishError(t *testing.T) {
+	client := connectedTestClient(testConfig())
+	mock := client.mqtt.(*mockMqttClient)
+	device := testDevice("home/devices/test", "")
+	device.SetError(&miio.DeviceError{Code: -5001, Message: "invalid_arg"})
+	err := client.PublishError(device)
+	h.AssertError(t, err, nil)
+	h.AssertEqual(t, mock.publishData, regexp.MustCompile(`^home/devices/test/error: {"code":-5001,"message":"invalid_arg","time":"[^"]+"}$`))
+	h.AssertEqual(t, mock.publishRetained, true)
+	device.SetError(nil)
+	err = client.PublishError(device)
+	h.AssertError(t, err, nil)
+	h.AssertEqual(t, mock.publishData, "home/devices/test/error: ")
+}
+
+func TestClient_PublishToken(t *testing.T) {
+	client := connectedTestClient(testConfig())
+	mock := client.mqtt.(*mockMqttClient)
+	h.AssertError(t, client.PublishToken(&miio.DiscoveredToken{ID: 0x01234567}), nil) // disabled by default
+	h.AssertEqual(t, mock.publishCalls, 0)
+	client.config.Mqtt.InventoryTopic = "miio2mqtt/inventory"
+	err := client.PublishToken(&miio.DiscoveredToken{ID: 0x01234567, Address: "192.168.0.10", Token: []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}})
+	h.AssertError(t, err, nil)
+	h.AssertEqual(t, mock.publishData, regexp.MustCompile(`^miio2mqtt/inventory/01234567: {"id":"0x01234567","address":"192.168.0.10","token":"000102030405060708090a0b0c0d0e0f","time":"[^"]+"}$`))
+	h.AssertEqual(t, mock.publishRetained, false)
+	client.config.Mqtt.InventoryTopic = ""
+	mock.publishCalls = 0
+	h.AssertError(t, client.PublishToken(&miio.DiscoveredToken{ID: 0x01234567}), nil)
+	h.AssertEqual(t, mock.publishCalls, 0)
 }
 
 func TestClient_Publish(t *testing.T) {
@@ -201,40 +354,44 @@ func TestClient_Publish(t *testing.T) {
 		client       *Client
 		arg          *miio.Device
 		err          error
-		connectCalls int
 		publishCalls int
 		publishData  string
+		queued       int
 	}{
 		{
-			name: "Connect error",
+			name:         "Not connected",
+			client:       newTestClient(testConfig()),
+			arg:          testDevice("home/devices/test", "test properties"),
+			publishCalls: 0,
+			queued:       1,
+		},
+		{
+			name: "Not connected, queue disabled",
 			client: func() *Client {
-				c := NewClient(testConfig())
-				c.mqtt.(*mockMqttClient).connectErr = errors.New("connect error")
-				return c
+				config := testConfig()
+				config.Mqtt.QueueSize = 0
+				return newTestClient(config)
 			}(),
 			arg:          testDevice("home/devices/test", "test properties"),
-			err:          errors.New("connect error"),
-			connectCalls: 1,
+			err:          errors.New("not connected to MQTT broker"),
 			publishCalls: 0,
 		},
 		{
 			name: "Publish error",
 			client: func() *Client {
-				c := NewClient(testConfig())
+				c := connectedTestClient(testConfig())
 				c.mqtt.(*mockMqttClient).publishErr = errors.New("publish error")
 				return c
 			}(),
 			arg:          testDevice("home/devices/test", "test properties"),
 			err:          errors.New("publish error"),
-			connectCalls: 1,
 			publishCalls: 1,
 			publishData:  "home/devices/test: test properties",
 		},
 		{
 			name:         "Success",
-			client:       NewClient(testConfig()),
+			client:       connectedTestClient(testConfig()),
 			arg:          testDevice("home/devices/test", "test properties"),
-			connectCalls: 1,
 			publishCalls: 1,
 			publishData:  "home/devices/test: test properties",
 		},
@@ -242,13 +399,288 @@ func TestClient_Publish(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			mock := tt.client.mqtt.(*mockMqttClient)
-			h.AssertEqual(t, mock.connectCalls, 0)
 			h.AssertEqual(t, mock.publishCalls, 0)
 			err := tt.client.Publish(tt.arg)
 			h.AssertError(t, err, tt.err)
-			h.AssertEqual(t, mock.connectCalls, tt.connectCalls)
+			h.AssertEqual(t, mock.connectCalls, 0)
 			h.AssertEqual(t, mock.publishCalls, tt.publishCalls)
 			h.AssertEqual(t, mock.publishData, tt.publishData)
+			h.AssertEqual(t, len(tt.client.queue), tt.queued)
+		})
+	}
+}
+
+func TestClient_Queue(t *testing.T) {
+	config := testConfig()
+	config.Mqtt.QueueSize = 3
+	client := newTestClient(config)
+	mock := client.mqtt.(*mockMqttClient)
+	device := testDevice("home/devices/test", "")
+	for i := 1; i <= 4; i++ {
+		device.SetProperties(fmt.Sprintf(`{"aqi":%d}`, i))
+		h.AssertError(t, client.Publish(device), nil)
+	}
+	h.AssertEqual(t, len(client.queue), 3)
+	h.AssertEqual(t, mock.publishCalls, 0)
+
+	h.AssertError(t, client.SubscribeCommands(miio.Devices{1: device}, func(*miio.Device, []byte) {}), nil)
+	h.AssertError(t, client.Connect(), nil)
+	h.AssertEqual(t, len(mock.subscribed), 1)
+	h.AssertEqual(t, mock.published, []string{
+		"miio2mqtt/status: online",
+		`home/devices/test: {"aqi":2}`,
+		`home/devices/test: {"aqi":3}`,
+		`home/devices/test: {"aqi":4}`,
+	})
+	h.AssertEqual(t, len(client.queue), 0)
+
+	// connection lost, the publish is queued and flushed after the session and subscriptions are restored
+	mock.published, mock.subscribed, mock.isConnected = nil, nil, false
+	mock.opts.OnConnectionLost(mock, errors.New("connection lost error"))
+	h.AssertEqual(t, client.State(), Reconnecting)
+	device.SetProperties(`{"aqi":5}`)
+	h.AssertError(t, client.Publish(device), nil)
+	h.AssertEqual(t, len(mock.published), 0)
+	mock.isConnected = true
+	mock.opts.OnConnect(mock)
+	h.AssertEqual(t, client.State(), Connected)
+	h.AssertEqual(t, len(mock.subscribed), 1)
+	h.AssertEqual(t, mock.published, []string{
+		"miio2mqtt/status: online",
+		`home/devices/test: {"aqi":5}`,
+	})
+
+	// interrupted flush keeps the order of messages
+	mock.published = nil
+	client.Lock()
+	client.queue = []*message{{topic: "home/devices/test", payload: []byte(`{"aqi":6}`)}}
+	client.Unlock()
+	device.SetProperties(`{"aqi":7}`)
+	h.AssertError(t, client.Publish(device), nil)
+	h.AssertEqual(t, mock.published, []string{
+		`home/devices/test: {"aqi":6}`,
+		`home/devices/test: {"aqi":7}`,
+	})
+
+	states := []ConnectionState{}
+	for len(client.StateChanges()) > 0 {
+		states = append(states, <-client.StateChanges())
+	}
+	h.AssertEqual(t, fmt.Sprint(states), "[connecting connected reconnecting connected]")
+}
+
+func TestClient_Publish_QoS(t *testing.T) {
+	qos, retain := byte(2), false
+	tests := []struct {
+		name     string
+		global   func(o *config.MqttOptions)
+		device   miio.DeviceCfg
+		qos      byte
+		retained bool
+	}{
+		{
+			name:     "Defaults",
+			global:   func(o *config.MqttOptions) {},
+			retained: true,
+		},
+		{
+			name:     "Global",
+			global:   func(o *config.MqttOptions) { o.QoS, o.Retain = 1, false },
+			qos:      1,
+			retained: false,
+		},
+		{
+			name:     "Device override",
+			global:   func(o *config.MqttOptions) { o.QoS = 1 },
+			device:   miio.DeviceCfg{QoS: &qos, Retain: &retain},
+			qos:      2,
+			retained: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := testConfig()
+			tt.global(&config.Mqtt)
+			client := connectedTestClient(config)
+			mock := client.mqtt.(*mockMqttClient)
+			device := testDevice("home/devices/test", `{"power":"on"}`)
+			device.QoS, device.Retain = tt.device.QoS, tt.device.Retain
+			err := client.Publish(device)
+			h.AssertError(t, err, nil)
+			h.AssertEqual(t, mock.publishQoS, tt.qos)
+			h.AssertEqual(t, mock.publishRetained, tt.retained)
+			err = client.PublishAvailability(device)
+			h.AssertError(t, err, nil)
+			h.AssertEqual(t, mock.publishQoS, tt.qos)
+			h.AssertEqual(t, mock.publishRetained, true)
+		})
+	}
+}
+
+func TestClient_SubscribeCommands(t *testing.T) {
+	devices := miio.Devices{
+		1: testDevice("home/devices/test1", ""),
+		2: testDevice("home/devices/test2", ""),
+		3: testDevice("", ""),
+	}
+	tests := []struct {
+		name       string
+		client     *Client
+		connect    bool
+		err        error
+		subscribed int
+	}{
+		{
+			name:       "Not connected",
+			client:     newTestClient(testConfig()),
+			subscribed: 0,
+		},
+		{
+			name:       "Connected afterwards",
+			client:     newTestClient(testConfig()),
+			connect:    true,
+			subscribed: 2,
+		},
+		{
+			name:       "Already connected",
+			client:     connectedTestClient(testConfig()),
+			subscribed: 2,
+		},
+		{
+			name: "Subscribe error",
+			client: func() *Client {
+				c := connectedTestClient(testConfig())
+				c.mqtt.(*mockMqttClient).subscribeErr = errors.New("subscribe error")
+				return c
+			}(),
+			err:        errors.New("subscribe error"),
+			subscribed: 0,
+		},
+		{
+			name: "Subscribe error on connect",
+			client: func() *Client {
+				c := newTestClient(testConfig())
+				c.mqtt.(*mockMqttClient).subscribeErr = errors.New("subscribe error")
+				return c
+			}(),
+			connect:    true,
+			subscribed: 0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var gotDevice *miio.Device
+			var gotPayload []byte
+			mock := tt.client.mqtt.(*mockMqttClient)
+			err := tt.client.SubscribeCommands(devices, func(d *miio.Device, payload []byte) { gotDevice, gotPayload = d, payload })
+			h.AssertError(t, err, tt.err)
+			h.AssertEqual(t, mock.connectCalls, 0) // the client is connected explicitly
+			if tt.connect {
+				h.AssertError(t, tt.client.Connect(), nil)
+			}
+			h.AssertEqual(t, len(mock.subscribed), tt.subscribed)
+			if tt.subscribed == 0 {
+				return
+			}
+			handler := mock.subscribed["home/devices/test2/set"]
+			handler(mock, &mockMqttMessage{topic: "home/devices/test2/set", payload: []byte(`{"power":"on"}`)})
+			h.AssertEqual(t, gotDevice, devices[2])
+			h.AssertEqual(t, gotPayload, []byte(`{"power":"on"}`))
+		})
+	}
+}
+
+func TestClient_SubscribeRPC(t *testing.T) {
+	devices := miio.Devices{1: testDevice("home/devices/test", "")}
+	client := connectedTestClient(testConfig())
+	mock := client.mqtt.(*mockMqttClient)
+	var gotPayload []byte
+	err := client.SubscribeRPC(devices, func(d *miio.Device, payload []byte) { gotPayload = payload })
+	h.AssertError(t, err, nil)
+	handler, ok := mock.subscribed["home/devices/test/rpc"]
+	h.AssertEqual(t, ok, true)
+	handler(mock, &mockMqttMessage{topic: "home/devices/test/rpc", payload: []byte(`{"method":"miIO.info","id":"abc"}`)})
+	h.AssertEqual(t, gotPayload, []byte(`{"method":"miIO.info","id":"abc"}`))
+}
+
+func TestClient_PublishResponse(t *testing.T) {
+	client := connectedTestClient(testConfig())
+	mock := client.mqtt.(*mockMqttClient)
+	err := client.PublishResponse(testDevice("home/devices/test", ""), []byte(`{"id":"abc","result":["ok"]}`))
+	h.AssertError(t, err, nil)
+	h.AssertEqual(t, mock.publishCalls, 1)
+	h.AssertEqual(t, mock.publishData, `home/devices/test/rpc/response: {"id":"abc","result":["ok"]}`)
+}
+
+func TestClient_Publish_Properties(t *testing.T) {
+	tests := []struct {
+		name      string
+		mode      string
+		published []string
+	}{
+		{
+			name: "JSON",
+			mode: config.PublishJSON,
+			published: []string{
+				`home/devices/test: {"aqi":4,"mode":"auto","power":1}`,
+				`home/devices/test: {"aqi":5,"mode":"auto","power":1}`,
+			},
+		},
+		{
+			name: "Properties",
+			mode: config.PublishProperties,
+			published: []string{
+				"home/devices/test/aqi: 4",
+				"home/devices/test/mode: auto",
+				"home/devices/test/power: 1",
+				"home/devices/test/aqi: 5",
+			},
+		},
+		{
+			name: "Both",
+			mode: config.PublishBoth,
+			published: []string{
+				`home/devices/test: {"aqi":4,"mode":"auto","power":1}`,
+				"home/devices/test/aqi: 4",
+				"home/devices/test/mode: auto",
+				"home/devices/test/power: 1",
+				`home/devices/test: {"aqi":5,"mode":"auto","power":1}`,
+				"home/devices/test/aqi: 5",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := testConfig()
+			config.Mqtt.PublishMode = tt.mode
+			client := connectedTestClient(config)
+			mock := client.mqtt.(*mockMqttClient)
+			device := testDevice("home/devices/test", `{"aqi":4,"mode":"auto","power":1}`)
+			h.AssertError(t, client.Publish(device), nil)
+			device.SetProperties(`{"aqi":5,"mode":"auto","power":1}`)
+			h.AssertError(t, client.Publish(device), nil)
+			h.AssertEqual(t, mock.published, tt.published)
+		})
+	}
+}
+
+func Test_scalarPayload(t *testing.T) {
+	tests := []struct {
+		name  string
+		value interface{}
+		want  string
+	}{
+		{name: "string", value: "on", want: "on"},
+		{name: "number", value: json.Number("12.50"), want: "12.50"},
+		{name: "float", value: 12.5, want: "12.5"},
+		{name: "bool", value: true, want: "true"},
+		{name: "null", value: nil, want: ""},
+		{name: "array", value: []interface{}{"a", json.Number("1")}, want: `["a",1]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := scalarPayload(tt.value)
+			h.AssertEqual(t, got, tt.want)
 		})
 	}
 }
@@ -0,0 +1,180 @@
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+)
+
+// outboxTimestampKey is the MQTT 5 user property with the original time of the replayed device state,
+// on MQTT 3 it is added to JSON object payloads instead
+const outboxTimestampKey = "timestamp"
+
+// outbox persists queued device states to a JSON lines file, so they survive broker outages and restarts
+type outbox struct {
+	path    string
+	maxAge  time.Duration
+	maxSize int64
+	size    int64
+}
+
+type outboxEntry struct {
+	Time       time.Time         `json:"time"`
+	Topic      string            `json:"topic"`
+	QoS        byte              `json:"qos,omitempty"`
+	Retained   bool              `json:"retained,omitempty"`
+	Payload    string            `json:"payload"`
+	Properties *outboxProperties `json:"properties,omitempty"` // MQTT 5 properties of the device state
+}
+
+// outboxProperties are MQTT 5 publish properties kept in the outbox
+type outboxProperties struct {
+	User          [][2]string   `json:"user,omitempty"` // key, value pairs in order
+	MessageExpiry time.Duration `json:"expiry,omitempty"`
+}
+
+func newOutbox(path string, maxAge time.Duration, maxSize int64) *outbox {
+	return &outbox{path: path, maxAge: maxAge, maxSize: maxSize}
+}
+
+// load reads not expired messages from the outbox file
+func (o *outbox) load() ([]*message, error) {
+	data, err := ioutil.ReadFile(o.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	o.size = int64(len(data))
+	result := []*message{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), len(data)+1)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		entry := outboxEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			log.Printf("[WARN] invalid outbox entry at %s:%d: %v", o.path, line, err)
+			continue
+		}
+		msg := &message{topic: entry.Topic, qos: entry.QoS, retained: entry.Retained, payload: []byte(entry.Payload), persist: true, time: entry.Time}
+		if p := entry.Properties; p != nil {
+			msg.properties = &publishProperties{MessageExpiry: p.MessageExpiry}
+			for _, u := range p.User {
+				msg.properties.User.Add(u[0], u[1])
+			}
+		}
+		if o.expired(msg) {
+			continue
+		}
+		result = append(result, msg)
+	}
+	return result, scanner.Err()
+}
+
+// append writes the message to the outbox file, the file is rewritten from the queue when it grows over the max size
+func (o *outbox) append(msg *message, queue []*message) error {
+	line, err := o.line(msg)
+	if err != nil {
+		return err
+	}
+	if o.maxSize > 0 && o.size+int64(len(line)) > o.maxSize {
+		return o.save(queue)
+	}
+	file, err := os.OpenFile(o.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	n, err := file.Write(line)
+	o.size += int64(n)
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// save rewrites the outbox file with persistent messages of the queue, dropping the oldest ones over the max size
+func (o *outbox) save(queue []*message) error {
+	lines := [][]byte{}
+	size := int64(0)
+	for _, msg := range queue {
+		if !msg.persist || o.expired(msg) {
+			continue
+		}
+		line, err := o.line(msg)
+		if err != nil {
+			return err
+		}
+		lines = append(lines, line)
+		size += int64(len(line))
+	}
+	for o.maxSize > 0 && size > o.maxSize && len(lines) > 0 {
+		log.Printf("[WARN] outbox is full, dropping the oldest message")
+		size -= int64(len(lines[0]))
+		lines = lines[1:]
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(o.path), filepath.Base(o.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(bytes.Join(lines, nil)); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), o.path); err != nil {
+		return err
+	}
+	o.size = size
+	return nil
+}
+
+func (o *outbox) expired(msg *message) bool {
+	return o.maxAge > 0 && time.Since(msg.time) > o.maxAge
+}
+
+func (o *outbox) line(msg *message) ([]byte, error) {
+	entry := outboxEntry{Time: msg.time, Topic: msg.topic, QoS: msg.qos, Retained: msg.retained, Payload: string(msg.payload)}
+	if p := msg.properties; p != nil {
+		entry.Properties = &outboxProperties{MessageExpiry: p.MessageExpiry}
+		for _, u := range p.User {
+			entry.Properties.User = append(entry.Properties.User, [2]string{u.Key, u.Value})
+		}
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return nil, fmt.Errorf("unable to encode outbox entry: %v", err)
+	}
+	return append(data, '\n'), nil
+}
+
+// withTimestamp adds the original message time to the JSON object payload, other payloads are not changed
+func withTimestamp(payload []byte, ts time.Time) []byte {
+	data := map[string]interface{}{}
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	dec.UseNumber()
+	if err := dec.Decode(&data); err != nil {
+		return payload
+	}
+	if _, ok := data[outboxTimestampKey]; ok {
+		return payload
+	}
+	data[outboxTimestampKey] = ts.Format(time.RFC3339)
+	result, err := json.Marshal(data)
+	if err != nil {
+		return payload
+	}
+	return result
+}
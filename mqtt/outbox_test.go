@@ -0,0 +1,192 @@
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	h "github.com/eip/miio2mqtt/helpers"
+)
+
+func testOutboxMessage(aqi int, ts time.Time) *message {
+	return &message{topic: "home/devices/test", retained: true, payload: []byte(fmt.Sprintf(`{"aqi":%d}`, aqi)), persist: true, time: ts}
+}
+
+func TestOutbox(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox.jsonl")
+	now := time.Now().Truncate(time.Second)
+	o := newOutbox(path, time.Hour, 0)
+	got, err := o.load()
+	h.AssertError(t, err, nil)
+	h.AssertEqual(t, len(got), 0)
+
+	queue := []*message{}
+	for i, ts := range []time.Time{now.Add(-2 * time.Hour), now.Add(-time.Minute), now} {
+		queue = append(queue, testOutboxMessage(i, ts))
+		h.AssertError(t, o.append(queue[i], queue), nil)
+	}
+	queue = append(queue, &message{topic: "home/devices/test/rpc/response", payload: []byte("{}"), time: now})
+
+	o = newOutbox(path, time.Hour, 0)
+	got, err = o.load()
+	h.AssertError(t, err, nil)
+	h.AssertEqual(t, len(got), 2) // expired message is skipped
+	h.AssertEqual(t, got[0].topic, "home/devices/test")
+	h.AssertEqual(t, got[0].payload, []byte(`{"aqi":1}`))
+	h.AssertEqual(t, got[0].retained, true)
+	h.AssertEqual(t, got[0].persist, true)
+	h.AssertEqual(t, got[0].time.Equal(now.Add(-time.Minute)), true)
+
+	h.AssertError(t, o.save(queue[2:]), nil)
+	data, _ := ioutil.ReadFile(path)
+	h.AssertEqual(t, strings.Count(string(data), "\n"), 1)
+	h.AssertEqual(t, o.size, int64(len(data)))
+}
+
+func TestOutbox_MaxSize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox.jsonl")
+	now := time.Now()
+	line, _ := (&outbox{}).line(testOutboxMessage(0, now))
+	o := newOutbox(path, 0, int64(2*len(line)))
+	queue := []*message{}
+	for i := 0; i < 5; i++ {
+		queue = append(queue, testOutboxMessage(i, now))
+		h.AssertError(t, o.append(queue[i], queue), nil)
+	}
+	got, err := o.load()
+	h.AssertError(t, err, nil)
+	h.AssertEqual(t, len(got), 2)
+	h.AssertEqual(t, got[0].payload, []byte(`{"aqi":3}`))
+	h.AssertEqual(t, got[1].payload, []byte(`{"aqi":4}`))
+}
+
+func TestOutbox_InvalidEntry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox.jsonl")
+	if err := ioutil.WriteFile(path, []byte("foo\n\n{\"topic\":\"home/devices/test\",\"payload\":\"1\"}\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	got, err := newOutbox(path, 0, 0).load()
+	h.AssertError(t, err, nil)
+	h.AssertEqual(t, len(got), 1)
+	h.AssertEqual(t, got[0].payload, []byte("1"))
+
+	_, err = newOutbox(t.TempDir(), 0, 0).load()
+	h.AssertEqual(t, err != nil, true)
+}
+
+func Test_withTimestamp(t *testing.T) {
+	ts := time.Date(2021, 3, 14, 15, 9, 26, 0, time.UTC)
+	tests := []struct {
+		name    string
+		payload string
+		want    string
+	}{
+		{name: "Object", payload: `{"power":"on","aqi":12.50}`, want: `{"aqi":12.50,"power":"on","timestamp":"2021-03-14T15:09:26Z"}`},
+		{name: "Existing timestamp", payload: `{"timestamp":1}`, want: `{"timestamp":1}`},
+		{name: "Scalar", payload: `on`, want: `on`},
+		{name: "Number", payload: `12.50`, want: `12.50`},
+		{name: "Array", payload: `[1,2]`, want: `[1,2]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := withTimestamp([]byte(tt.payload), ts)
+			h.AssertEqual(t, string(got), tt.want)
+		})
+	}
+}
+
+func TestClient_replayed(t *testing.T) {
+	ts := time.Date(2021, 3, 14, 15, 9, 26, 0, time.UTC)
+	config := testConfig()
+	config.Mqtt.ProtocolVersion = 5
+	client := newTestClient(config)
+	state := &publishProperties{MessageExpiry: time.Minute}
+	state.User.Add("device_id", "01234567")
+	msg := &message{topic: "home/devices/test/power", payload: []byte("on"), persist: true, time: ts, properties: state}
+
+	payload, props := client.replayed(msg)
+	h.AssertEqual(t, string(payload), "on") // the payload is not changed on MQTT 5
+	h.AssertEqual(t, props.MessageExpiry, time.Minute)
+	h.AssertEqual(t, props.User.Get("device_id"), "01234567")
+	h.AssertEqual(t, props.User.Get("timestamp"), "2021-03-14T15:09:26Z")
+	h.AssertEqual(t, len(state.User), 1) // the queued message properties are kept intact
+
+	config.Mqtt.ProtocolVersion = 4
+	payload, props = newTestClient(config).replayed(msg)
+	h.AssertEqual(t, string(payload), "on") // scalar values are not wrapped on MQTT 3
+	h.AssertEqual(t, props, state)
+}
+
+func TestOutbox_Properties(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox.jsonl")
+	o := newOutbox(path, 0, 0)
+	msg := testOutboxMessage(1, time.Now())
+	msg.properties = &publishProperties{MessageExpiry: time.Minute}
+	msg.properties.User.Add("device_id", "01234567").Add("model", "dummy.test.v1")
+	h.AssertError(t, o.append(msg, []*message{msg}), nil)
+
+	got, err := newOutbox(path, 0, 0).load()
+	h.AssertError(t, err, nil)
+	h.AssertEqual(t, len(got), 1)
+	h.AssertEqual(t, got[0].properties, msg.properties) // kept across restarts
+}
+
+func TestClient_Outbox(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox.jsonl")
+	config := testConfig()
+	config.Mqtt.Outbox = path
+	client := newTestClient(config)
+	device := testDevice("home/devices/test", `{"aqi":1}`)
+	h.AssertError(t, client.Publish(device), nil)
+	h.AssertError(t, client.PublishResponse(device, []byte(`{"id":1}`)), nil)
+	client.Disconnect()
+
+	// device states are replayed with their timestamps after restart
+	client = newTestClient(config)
+	mock := client.mqtt.(*mockMqttClient)
+	h.AssertEqual(t, len(client.queue), 1)
+	ts := client.queue[0].time.Format(time.RFC3339)
+	h.AssertError(t, client.Connect(), nil)
+	h.AssertEqual(t, mock.published, []string{
+		"miio2mqtt/status: online",
+		fmt.Sprintf(`home/devices/test: {"aqi":1,"timestamp":"%s"}`, ts),
+	})
+	data, err := ioutil.ReadFile(path)
+	h.AssertError(t, err, nil)
+	h.AssertEqual(t, len(data), 0)
+
+	// failed publish of a device state is kept in the outbox
+	mock.publishErr = errors.New("publish error")
+	h.AssertError(t, client.Publish(device), nil)
+	h.AssertEqual(t, len(client.queue), 1)
+	data, _ = ioutil.ReadFile(path)
+	h.AssertEqual(t, strings.Count(string(data), "\n"), 1)
+
+	config.Mqtt.Outbox = t.TempDir()
+	_, err = NewClient(config)
+	h.AssertEqual(t, err != nil, true)
+}
+
+func TestClient_OutboxProperties(t *testing.T) {
+	config := testConfig()
+	config.Mqtt.Outbox = filepath.Join(t.TempDir(), "outbox.jsonl")
+	config.Mqtt.PublishMode = "properties"
+	client := newTestClient(config)
+	h.AssertError(t, client.Publish(testDevice("home/devices/test", `{"aqi":1,"power":"on"}`)), nil)
+	client.Disconnect()
+
+	// scalar values are replayed as they are, so the retained value stays plain
+	client = newTestClient(config)
+	mock := client.mqtt.(*mockMqttClient)
+	h.AssertEqual(t, len(client.queue), 2)
+	h.AssertError(t, client.Connect(), nil)
+	h.AssertEqual(t, mock.published, []string{
+		"miio2mqtt/status: online",
+		"home/devices/test/aqi: 1",
+		"home/devices/test/power: on",
+	})
+}
@@ -0,0 +1,40 @@
+package mqtt
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/eip/miio2mqtt/config"
+)
+
+// newTLSConfig creates TLS settings from CA and client certificate files, nil if none is set
+func newTLSConfig(opts config.MqttOptions) (*tls.Config, error) {
+	if len(opts.CAFile) == 0 && len(opts.CertFile) == 0 && !opts.InsecureSkipVerify {
+		return nil, nil
+	}
+	result := &tls.Config{InsecureSkipVerify: opts.InsecureSkipVerify} // #nosec G402 -- explicitly requested
+	if len(opts.CAFile) > 0 {
+		pem, err := ioutil.ReadFile(opts.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		result.RootCAs = x509.NewCertPool()
+		if !result.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", opts.CAFile)
+		}
+	}
+	if len(opts.CertFile) > 0 || len(opts.KeyFile) > 0 {
+		if len(opts.CertFile) == 0 || len(opts.KeyFile) == 0 {
+			return nil, errors.New("both client certificate and key files should be set")
+		}
+		cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		result.Certificates = []tls.Certificate{cert}
+	}
+	return result, nil
+}
@@ -0,0 +1,219 @@
+package mqtt
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/eip/miio2mqtt/config"
+	h "github.com/eip/miio2mqtt/helpers"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+func newTestCert(t *testing.T, name string, parent *testCert, client bool) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+	}
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+		tmpl.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+		if client {
+			tmpl.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+func (c *testCert) write(t *testing.T, dir, name string) (certFile, keyFile string) {
+	t.Helper()
+	certFile = filepath.Join(dir, name+".crt")
+	keyFile = filepath.Join(dir, name+".key")
+	keyDer, _ := x509.MarshalECPrivateKey(c.key)
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func (c *testCert) tls() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+// startTestBroker starts a TLS listener accepting a single MQTT connection and answering CONNECT with CONNACK
+func startTestBroker(t *testing.T, ca, server *testCert) (string, <-chan string) {
+	t.Helper()
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{server.tls()},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	clients := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		tlsConn := conn.(*tls.Conn)
+		if err := tlsConn.Handshake(); err != nil {
+			clients <- ""
+			return
+		}
+		header := make([]byte, 2)
+		if _, err := io.ReadFull(conn, header); err != nil || header[0] != 0x10 {
+			clients <- ""
+			return
+		}
+		if _, err := io.ReadFull(conn, make([]byte, header[1])); err != nil {
+			clients <- ""
+			return
+		}
+		if _, err := conn.Write([]byte{0x20, 0x02, 0x00, 0x00}); err != nil {
+			return
+		}
+		clients <- tlsConn.ConnectionState().PeerCertificates[0].Subject.CommonName
+		_, _ = io.Copy(ioutil.Discard, conn)
+	}()
+	return "ssl://" + listener.Addr().String(), clients
+}
+
+func TestClient_Connect_TLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "Test CA", nil, false)
+	server := newTestCert(t, "broker", ca, false)
+	client := newTestCert(t, "miio2mqtt", ca, true)
+	caFile, _ := ca.write(t, dir, "ca")
+	certFile, keyFile := client.write(t, dir, "client")
+
+	tests := []struct {
+		name     string
+		opts     func(o *config.MqttOptions)
+		err      bool
+		clientCN string
+	}{
+		{
+			name: "Mutual TLS",
+			opts: func(o *config.MqttOptions) {
+				o.CAFile, o.CertFile, o.KeyFile = caFile, certFile, keyFile
+			},
+			clientCN: "miio2mqtt",
+		},
+		{
+			name: "No client certificate",
+			opts: func(o *config.MqttOptions) { o.CAFile = caFile },
+			err:  true,
+		},
+		{
+			name: "Unknown CA",
+			opts: func(o *config.MqttOptions) { o.CertFile, o.KeyFile = certFile, keyFile },
+			err:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			brokerURL, clients := startTestBroker(t, ca, server)
+			config := testConfig()
+			config.Mqtt.BrokerURL = brokerURL
+			config.Mqtt.StatusTopic = ""
+			config.PushTimeout = 500 * time.Millisecond
+			tt.opts(&config.Mqtt)
+			c := &Client{config: config, subscriptions: map[string]mqtt.MessageHandler{}}
+			opts, err := c.createOptions()
+			h.AssertError(t, err, nil)
+			c.mqtt = mqtt.NewClient(opts)
+			err = c.Connect()
+			defer c.mqtt.Disconnect(0)
+			h.AssertError(t, err, nil)
+			if tt.err { // the connection is retried in background
+				h.AssertEqual(t, c.State(), Connecting)
+				h.AssertEqual(t, c.mqtt.IsConnectionOpen(), false)
+				return
+			}
+			select {
+			case cn := <-clients:
+				h.AssertEqual(t, cn, tt.clientCN)
+			case <-time.After(time.Second):
+				t.Fatal(errors.New("broker has not accepted the connection"))
+			}
+		})
+	}
+}
+
+func Test_newTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "Test CA", nil, false)
+	caFile, _ := ca.write(t, dir, "ca")
+	certFile, keyFile := newTestCert(t, "miio2mqtt", ca, true).write(t, dir, "client")
+	tests := []struct {
+		name  string
+		opts  config.MqttOptions
+		nil   bool
+		certs int
+		err   error
+	}{
+		{name: "No TLS", opts: config.MqttOptions{}, nil: true},
+		{name: "CA only", opts: config.MqttOptions{CAFile: caFile}},
+		{name: "Client certificate", opts: config.MqttOptions{CAFile: caFile, CertFile: certFile, KeyFile: keyFile}, certs: 1},
+		{name: "Missing key", opts: config.MqttOptions{CertFile: certFile}, err: errors.New("both client certificate and key files should be set")},
+		{name: "Invalid CA", opts: config.MqttOptions{CAFile: keyFile}, err: errors.New("no certificates found in " + keyFile)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := newTLSConfig(tt.opts)
+			h.AssertError(t, err, tt.err)
+			if tt.err != nil {
+				return
+			}
+			h.AssertEqual(t, got == nil, tt.nil)
+			if got != nil {
+				h.AssertEqual(t, len(got.Certificates), tt.certs)
+			}
+		})
+	}
+}
@@ -0,0 +1,413 @@
+package mqtt
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// v5Client implements the paho v3 client interface on top of the MQTT 5 client,
+// so the same Client code works with both protocol versions
+type v5Client struct {
+	sync.Mutex
+	opts   *mqtt.ClientOptions
+	router *paho.StandardRouter
+	client *paho.Client
+	status int32
+	stop   chan struct{}
+}
+
+// publishProperties are MQTT 5 properties of the published message, ignored by MQTT 3 clients
+type publishProperties struct {
+	User            paho.UserProperties
+	MessageExpiry   time.Duration
+	CorrelationData []byte
+}
+
+// publishPayload carries MQTT 5 publish properties through the paho v3 client interface
+type publishPayload struct {
+	data       []byte
+	properties *publishProperties
+}
+
+func (p *publishPayload) String() string {
+	return string(p.data)
+}
+
+// v5Message exposes MQTT 5 request properties of the received message
+type v5Message struct {
+	*paho.Publish
+}
+
+type v5Token struct {
+	done chan struct{}
+	err  error
+}
+
+var errUnknownPayload = errors.New("unknown payload type")
+
+func newV5Client(opts *mqtt.ClientOptions) mqtt.Client {
+	return &v5Client{opts: opts, router: paho.NewStandardRouter()}
+}
+
+func (c *v5Client) IsConnected() bool {
+	switch ConnectionState(atomic.LoadInt32(&c.status)) {
+	case Connected:
+		return true
+	case Reconnecting:
+		return c.opts.AutoReconnect
+	case Connecting:
+		return c.opts.ConnectRetry
+	}
+	return false
+}
+
+func (c *v5Client) IsConnectionOpen() bool {
+	return ConnectionState(atomic.LoadInt32(&c.status)) == Connected
+}
+
+func (c *v5Client) Connect() mqtt.Token {
+	token := newV5Token()
+	if !atomic.CompareAndSwapInt32(&c.status, int32(Disconnected), int32(Connecting)) {
+		token.complete(nil)
+		return token
+	}
+	c.Lock()
+	c.stop = make(chan struct{})
+	stop := c.stop
+	c.Unlock()
+	go func() {
+		for {
+			err := c.connect()
+			if err == nil {
+				token.complete(nil)
+				return
+			}
+			if !c.opts.ConnectRetry || !sleep(stop, c.opts.ConnectRetryInterval) {
+				atomic.CompareAndSwapInt32(&c.status, int32(Connecting), int32(Disconnected))
+				token.complete(err)
+				return
+			}
+		}
+	}()
+	return token
+}
+
+// connect dials the broker and establishes the MQTT session
+func (c *v5Client) connect() error {
+	conn, err := c.dial()
+	if err != nil {
+		return err
+	}
+	var client *paho.Client
+	client = paho.NewClient(paho.ClientConfig{
+		ClientID:      c.opts.ClientID,
+		Conn:          conn,
+		Router:        c.router,
+		PacketTimeout: c.opts.ConnectTimeout,
+		OnClientError: func(err error) { c.connectionLost(client, err) },
+		OnServerDisconnect: func(d *paho.Disconnect) {
+			c.connectionLost(client, fmt.Errorf("disconnected by broker: %d", d.ReasonCode))
+		},
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), c.opts.ConnectTimeout)
+	defer cancel()
+	if _, err := client.Connect(ctx, c.connectPacket()); err != nil {
+		conn.Close()
+		return err
+	}
+	c.Lock()
+	status := ConnectionState(atomic.LoadInt32(&c.status))
+	if status != Connecting && status != Reconnecting { // disconnected meanwhile
+		c.Unlock()
+		_ = client.Disconnect(&paho.Disconnect{})
+		return nil
+	}
+	c.client = client
+	atomic.StoreInt32(&c.status, int32(Connected))
+	c.Unlock()
+	if c.opts.OnConnect != nil {
+		go c.opts.OnConnect(c)
+	}
+	return nil
+}
+
+func (c *v5Client) dial() (net.Conn, error) {
+	if len(c.opts.Servers) == 0 {
+		return nil, errors.New("no servers defined to connect to")
+	}
+	server := c.opts.Servers[0]
+	dialer := &net.Dialer{Timeout: c.opts.ConnectTimeout}
+	switch server.Scheme {
+	case "tcp", "mqtt":
+		return dialer.Dial("tcp", server.Host)
+	case "ssl", "tls", "mqtts", "tcps":
+		return tls.DialWithDialer(dialer, "tcp", server.Host, c.opts.TLSConfig)
+	}
+	return nil, fmt.Errorf("unsupported MQTT 5 broker URL scheme: %s", server.Scheme)
+}
+
+func (c *v5Client) connectPacket() *paho.Connect {
+	cp := &paho.Connect{
+		ClientID:     c.opts.ClientID,
+		KeepAlive:    uint16(c.opts.KeepAlive),
+		CleanStart:   c.opts.CleanSession,
+		Username:     c.opts.Username,
+		UsernameFlag: len(c.opts.Username) > 0,
+		Password:     []byte(c.opts.Password),
+		PasswordFlag: len(c.opts.Password) > 0,
+	}
+	if c.opts.WillEnabled {
+		cp.WillMessage = &paho.WillMessage{
+			Retain:  c.opts.WillRetained,
+			QoS:     c.opts.WillQos,
+			Topic:   c.opts.WillTopic,
+			Payload: c.opts.WillPayload,
+		}
+	}
+	return cp
+}
+
+// connectionLost handles the broken connection and starts reconnecting
+func (c *v5Client) connectionLost(client *paho.Client, err error) {
+	c.Lock()
+	if c.client != client {
+		c.Unlock()
+		return
+	}
+	c.client = nil
+	stop := c.stop
+	c.Unlock()
+	if !atomic.CompareAndSwapInt32(&c.status, int32(Connected), int32(Reconnecting)) {
+		return
+	}
+	if c.opts.OnConnectionLost != nil {
+		go c.opts.OnConnectionLost(c, err)
+	}
+	if !c.opts.AutoReconnect {
+		atomic.CompareAndSwapInt32(&c.status, int32(Reconnecting), int32(Disconnected))
+		return
+	}
+	go c.reconnect(stop)
+}
+
+func (c *v5Client) reconnect(stop chan struct{}) {
+	delay := time.Second
+	for ConnectionState(atomic.LoadInt32(&c.status)) == Reconnecting {
+		if c.opts.OnReconnecting != nil {
+			c.opts.OnReconnecting(c, c.opts)
+		}
+		if c.connect() == nil {
+			return
+		}
+		if !sleep(stop, delay) {
+			return
+		}
+		if delay *= 2; delay > c.opts.MaxReconnectInterval {
+			delay = c.opts.MaxReconnectInterval
+		}
+	}
+}
+
+func (c *v5Client) Disconnect(quiesce uint) {
+	atomic.StoreInt32(&c.status, int32(Disconnected))
+	c.Lock()
+	client := c.client
+	c.client = nil
+	if c.stop != nil {
+		close(c.stop)
+		c.stop = nil
+	}
+	c.Unlock()
+	if client != nil {
+		_ = client.Disconnect(&paho.Disconnect{})
+	}
+}
+
+func (c *v5Client) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	token := newV5Token()
+	pub := &paho.Publish{Topic: topic, QoS: qos, Retain: retained}
+	switch p := payload.(type) {
+	case string:
+		pub.Payload = []byte(p)
+	case []byte:
+		pub.Payload = p
+	case *publishPayload:
+		pub.Payload = p.data
+		pub.Properties = p.properties.packet()
+	default:
+		token.complete(errUnknownPayload)
+		return token
+	}
+	client := c.current()
+	if client == nil {
+		token.complete(mqtt.ErrNotConnected)
+		return token
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), c.opts.WriteTimeout+c.opts.ConnectTimeout)
+		defer cancel()
+		_, err := client.Publish(ctx, pub)
+		token.complete(err)
+	}()
+	return token
+}
+
+func (c *v5Client) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	return c.SubscribeMultiple(map[string]byte{topic: qos}, callback)
+}
+
+func (c *v5Client) SubscribeMultiple(filters map[string]byte, callback mqtt.MessageHandler) mqtt.Token {
+	token := newV5Token()
+	sub := &paho.Subscribe{Subscriptions: map[string]paho.SubscribeOptions{}}
+	for topic, qos := range filters {
+		c.AddRoute(topic, callback)
+		sub.Subscriptions[topic] = paho.SubscribeOptions{QoS: qos}
+	}
+	client := c.current()
+	if client == nil {
+		token.complete(mqtt.ErrNotConnected)
+		return token
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), c.opts.ConnectTimeout)
+		defer cancel()
+		_, err := client.Subscribe(ctx, sub)
+		token.complete(err)
+	}()
+	return token
+}
+
+func (c *v5Client) Unsubscribe(topics ...string) mqtt.Token {
+	token := newV5Token()
+	for _, topic := range topics {
+		c.router.UnregisterHandler(topic)
+	}
+	client := c.current()
+	if client == nil {
+		token.complete(mqtt.ErrNotConnected)
+		return token
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), c.opts.ConnectTimeout)
+		defer cancel()
+		_, err := client.Unsubscribe(ctx, &paho.Unsubscribe{Topics: topics})
+		token.complete(err)
+	}()
+	return token
+}
+
+// AddRoute replaces the handler of the topic, as the MQTT 5 router keeps all registered ones
+func (c *v5Client) AddRoute(topic string, callback mqtt.MessageHandler) {
+	c.router.UnregisterHandler(topic)
+	c.router.RegisterHandler(topic, func(p *paho.Publish) {
+		callback(c, &v5Message{p})
+	})
+}
+
+func (c *v5Client) OptionsReader() mqtt.ClientOptionsReader {
+	return mqtt.ClientOptionsReader{}
+}
+
+func (c *v5Client) current() *paho.Client {
+	c.Lock()
+	defer c.Unlock()
+	return c.client
+}
+
+func (p *publishProperties) packet() *paho.PublishProperties {
+	if p == nil {
+		return nil
+	}
+	result := &paho.PublishProperties{
+		User:            p.User,
+		CorrelationData: p.CorrelationData,
+	}
+	if p.MessageExpiry > 0 {
+		expiry := uint32(p.MessageExpiry / time.Second)
+		result.MessageExpiry = &expiry
+	}
+	return result
+}
+
+func (m *v5Message) Duplicate() bool   { return false }
+func (m *v5Message) Qos() byte         { return m.QoS }
+func (m *v5Message) Retained() bool    { return m.Retain }
+func (m *v5Message) Topic() string     { return m.Publish.Topic }
+func (m *v5Message) MessageID() uint16 { return m.PacketID }
+func (m *v5Message) Payload() []byte   { return m.Publish.Payload }
+func (m *v5Message) Ack()              {}
+
+// ResponseTopic returns the MQTT 5 response topic of the request
+func (m *v5Message) ResponseTopic() string {
+	if m.Properties == nil {
+		return ""
+	}
+	return m.Properties.ResponseTopic
+}
+
+// CorrelationData returns the MQTT 5 correlation data of the request
+func (m *v5Message) CorrelationData() []byte {
+	if m.Properties == nil {
+		return nil
+	}
+	return m.Properties.CorrelationData
+}
+
+func newV5Token() *v5Token {
+	return &v5Token{done: make(chan struct{})}
+}
+
+func (t *v5Token) complete(err error) {
+	t.err = err
+	close(t.done)
+}
+
+func (t *v5Token) Wait() bool {
+	<-t.done
+	return true
+}
+
+func (t *v5Token) WaitTimeout(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-t.done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+func (t *v5Token) Done() <-chan struct{} {
+	return t.done
+}
+
+func (t *v5Token) Error() error {
+	select {
+	case <-t.done:
+		return t.err
+	default:
+		return nil
+	}
+}
+
+// sleep waits for the duration, returns false if stopped
+func sleep(stop <-chan struct{}, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-stop:
+		return false
+	case <-timer.C:
+		return true
+	}
+}
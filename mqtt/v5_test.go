@@ -0,0 +1,189 @@
+package mqtt
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.golang/packets"
+	"github.com/eclipse/paho.golang/paho"
+	h "github.com/eip/miio2mqtt/helpers"
+	"github.com/eip/miio2mqtt/miio"
+)
+
+type testV5Broker struct {
+	listener net.Listener
+	packets  chan *packets.ControlPacket
+	conns    chan net.Conn
+}
+
+// startTestV5Broker starts a listener answering MQTT 5 CONNECT and SUBSCRIBE packets and reporting all received packets
+func startTestV5Broker(t *testing.T) *testV5Broker {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	b := &testV5Broker{listener: listener, packets: make(chan *packets.ControlPacket, 100), conns: make(chan net.Conn, 10)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			b.conns <- conn
+			go b.serve(conn)
+		}
+	}()
+	return b
+}
+
+func (b *testV5Broker) serve(conn net.Conn) {
+	defer conn.Close()
+	for {
+		cp, err := packets.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+		b.packets <- cp
+		switch p := cp.Content.(type) {
+		case *packets.Connect:
+			_, _ = packets.NewControlPacket(packets.CONNACK).WriteTo(conn)
+		case *packets.Subscribe:
+			ack := packets.NewControlPacket(packets.SUBACK)
+			ack.Content.(*packets.Suback).PacketID = p.PacketID
+			ack.Content.(*packets.Suback).Reasons = make([]byte, len(p.Subscriptions))
+			_, _ = ack.WriteTo(conn)
+		case *packets.Disconnect:
+			return
+		}
+	}
+}
+
+func (b *testV5Broker) url() string {
+	return "tcp://" + b.listener.Addr().String()
+}
+
+// wait returns the first received packet matching the filter
+func (b *testV5Broker) wait(t *testing.T, match func(cp *packets.ControlPacket) bool) *packets.ControlPacket {
+	t.Helper()
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case cp := <-b.packets:
+			if match(cp) {
+				return cp
+			}
+		case <-timeout:
+			t.Fatal("expected packet was not received")
+			return nil
+		}
+	}
+}
+
+func publishTo(topic string) func(cp *packets.ControlPacket) bool {
+	return func(cp *packets.ControlPacket) bool {
+		p, ok := cp.Content.(*packets.Publish)
+		return ok && p.Topic == topic
+	}
+}
+
+func isPacket(packetType byte) func(cp *packets.ControlPacket) bool {
+	return func(cp *packets.ControlPacket) bool { return cp.Type == packetType }
+}
+
+func TestClient_V5(t *testing.T) {
+	broker := startTestV5Broker(t)
+	mqttV5Factory = newV5Client
+	defer func() { mqttV5Factory = mockMqttClientFactory }()
+	config := testConfig()
+	config.Mqtt.BrokerURL = broker.url()
+	config.Mqtt.ClientID = "miio2mqtt-test"
+	config.Mqtt.ProtocolVersion = 5
+	config.Mqtt.MessageExpiry = time.Minute
+	config.PushTimeout = time.Second
+	client := newTestClient(config)
+	defer client.Disconnect()
+	device := testDevice("home/devices/test", `{"power":"on"}`)
+	device.ID = 0x01234567
+	device.SetModel("dummy.test.v1")
+
+	requests := make(chan string, 1)
+	err := client.SubscribeRPC(miio.Devices{1: device}, func(d *miio.Device, payload []byte) { requests <- string(payload) })
+	h.AssertError(t, err, nil)
+	h.AssertError(t, client.Connect(), nil)
+	cp := broker.wait(t, isPacket(packets.CONNECT))
+	connect := cp.Content.(*packets.Connect)
+	h.AssertEqual(t, connect.ProtocolVersion, byte(5))
+	h.AssertEqual(t, connect.ClientID, "miio2mqtt-test")
+	h.AssertEqual(t, connect.WillTopic, "miio2mqtt/status")
+	h.AssertEqual(t, connect.WillMessage, []byte("offline"))
+	broker.wait(t, isPacket(packets.SUBSCRIBE))
+	broker.wait(t, publishTo("miio2mqtt/status"))
+	h.AssertEqual(t, client.State(), Connected)
+
+	// state carries user properties and expiry
+	h.AssertError(t, client.Publish(device), nil)
+	cp = broker.wait(t, publishTo("home/devices/test"))
+	state := cp.Content.(*packets.Publish)
+	h.AssertEqual(t, state.Payload, []byte(`{"power":"on"}`))
+	h.AssertEqual(t, cp.Flags&1, byte(1)) // retain
+	h.AssertEqual(t, *state.Properties.MessageExpiry, uint32(60))
+	h.AssertEqual(t, state.Properties.User, []packets.User{{Key: "device_id", Value: "01234567"}, {Key: "model", Value: "dummy.test.v1"}})
+
+	// RPC response goes to the response topic with the correlation data
+	conn := <-broker.conns
+	req := packets.NewControlPacket(packets.PUBLISH)
+	req.Content.(*packets.Publish).Topic = "home/devices/test/rpc"
+	req.Content.(*packets.Publish).Payload = []byte(`{"method":"miIO.info","id":"abc"}`)
+	req.Content.(*packets.Publish).Properties.ResponseTopic = "replies/test"
+	req.Content.(*packets.Publish).Properties.CorrelationData = []byte("c1")
+	_, err = req.WriteTo(conn)
+	h.AssertError(t, err, nil)
+	select {
+	case request := <-requests:
+		h.AssertEqual(t, request, `{"method":"miIO.info","id":"abc"}`)
+	case <-time.After(2 * time.Second):
+		t.Fatal("RPC request was not received")
+	}
+	h.AssertError(t, client.PublishResponse(device, []byte(`{"id": "abc","result":["ok"]}`)), nil)
+	resp := broker.wait(t, publishTo("replies/test")).Content.(*packets.Publish)
+	h.AssertEqual(t, resp.Properties.CorrelationData, []byte("c1"))
+	h.AssertError(t, client.PublishResponse(device, []byte(`{"id":"abc","result":["ok"]}`)), nil)
+	broker.wait(t, publishTo("home/devices/test/rpc/response"))
+
+	// the session and subscriptions are restored after the connection is lost
+	conn.Close()
+	broker.wait(t, isPacket(packets.CONNECT))
+	broker.wait(t, isPacket(packets.SUBSCRIBE))
+	broker.wait(t, publishTo("miio2mqtt/status"))
+	h.AssertEqual(t, client.State(), Connected)
+}
+
+func Test_publishProperties_packet(t *testing.T) {
+	var p *publishProperties
+	h.AssertEqual(t, p.packet() == nil, true)
+	p = &publishProperties{CorrelationData: []byte("c1")}
+	h.AssertEqual(t, p.packet(), &paho.PublishProperties{CorrelationData: []byte("c1")})
+	p.MessageExpiry = 90 * time.Second
+	h.AssertEqual(t, *p.packet().MessageExpiry, uint32(90))
+}
+
+func Test_rpcID(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+		want    string
+	}{
+		{name: "String", payload: `{"id": "abc"}`, want: `"abc"`},
+		{name: "Object", payload: `{"id": {"a": 1}}`, want: `{"a":1}`},
+		{name: "No id", payload: `{"method":"miIO.info"}`, want: ""},
+		{name: "Invalid", payload: `foo`, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h.AssertEqual(t, rpcID([]byte(tt.payload)), tt.want)
+		})
+	}
+}
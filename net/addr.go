@@ -2,11 +2,13 @@ package net
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"net"
-)
+	"strconv"
 
-const probeAddress = "1.1.1.1:53"
+	"github.com/eip/miio2mqtt/config"
+)
 
 func ParseUDPAddr(host string, port int) *net.UDPAddr {
 	addr := net.JoinHostPort(host, fmt.Sprintf("%d", port))
@@ -18,30 +20,117 @@ func ParseUDPAddr(host string, port int) *net.UDPAddr {
 	return udpAddr
 }
 
-func GetUDPAddresses(port int) (*net.UDPAddr, *net.UDPAddr, error) {
-	localAddr, err := getLocalIPAddr()
+// ParseHostPort parses the address with an optional port, the default port is used if it is omitted
+func ParseHostPort(addr string, port int) *net.UDPAddr {
+	host, portStr, err := net.SplitHostPort(addr)
 	if err != nil {
-		return nil, nil, err
+		return ParseUDPAddr(addr, port)
+	}
+	if port, err = strconv.Atoi(portStr); err != nil {
+		return nil
 	}
-	localIPNet, err := getLocalIPNet(localAddr)
+	return ParseUDPAddr(host, port)
+}
+
+func GetUDPAddresses(port int) (*net.UDPAddr, *net.UDPAddr, error) {
+	localAddr, bcastAddr, _, err := ResolveInterface(config.InterfaceOptions{}, port)
+	return localAddr, bcastAddr, err
+}
+
+// ResolveInterface returns the local address to listen on, the broadcast address and the network of the interface options;
+// without options the interface of the default route is used, or the first broadcast capable one if there is no route
+func ResolveInterface(iface config.InterfaceOptions, port int) (*net.UDPAddr, *net.UDPAddr, *net.IPNet, error) {
+	ipNet, err := findIPNet(iface)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
+	}
+	var bcastAddr *net.IP
+	if len(iface.Broadcast) > 0 {
+		ip := net.ParseIP(iface.Broadcast).To4()
+		if ip == nil {
+			return nil, nil, nil, fmt.Errorf("invalid broadcast address: %s", iface.Broadcast)
+		}
+		bcastAddr = &ip
+	} else if bcastAddr, err = getBroadcastIPAddr(ipNet); err != nil {
+		return nil, nil, nil, err
+	}
+	return &net.UDPAddr{IP: ipNet.IP, Port: 0, Zone: ""}, &net.UDPAddr{IP: *bcastAddr, Port: port, Zone: ""}, ipNet, nil
+}
+
+func findIPNet(iface config.InterfaceOptions) (*net.IPNet, error) {
+	if len(iface.BindIP) > 0 {
+		ip := net.ParseIP(iface.BindIP).To4()
+		if ip == nil {
+			return nil, fmt.Errorf("invalid bind address: %s", iface.BindIP)
+		}
+		ipNet, err := interfaceIPNet(iface.Name, func(_ net.Interface, n *net.IPNet) bool { return n.IP.Equal(ip) })
+		if err == nil {
+			return ipNet, nil
+		}
+		if len(iface.Broadcast) > 0 { // e.g. 0.0.0.0, the network is unknown
+			return &net.IPNet{IP: ip}, nil
+		}
+		return nil, fmt.Errorf("cannot find interface with IP address %s", ip)
+	}
+	if len(iface.Name) > 0 {
+		return interfaceIPNet(iface.Name, func(_ net.Interface, _ *net.IPNet) bool { return true })
+	}
+	localAddr, err := getLocalIPAddr()
+	if err == nil {
+		return getLocalIPNet(localAddr)
+	}
+	// the default route is unknown, e.g. the routing table is not available on this OS
+	ipNet, ierr := interfaceIPNet("", broadcastCapable)
+	if ierr != nil {
+		return nil, fmt.Errorf("%v, %v", err, ierr)
 	}
-	bcastAddr, err := getBroadcastIPAddr(localIPNet)
+	return ipNet, nil
+}
+
+func broadcastCapable(iface net.Interface, n *net.IPNet) bool {
+	return iface.Flags&net.FlagUp != 0 && iface.Flags&net.FlagBroadcast != 0 && !n.IP.IsLoopback()
+}
+
+// interfaceIPNet returns the first IPv4 network matching the check of the named interface, or of any one if the name is empty
+func interfaceIPNet(name string, check func(iface net.Interface, n *net.IPNet) bool) (*net.IPNet, error) {
+	ifaces, err := net.Interfaces()
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
-	return &net.UDPAddr{IP: *localAddr, Port: 0, Zone: ""}, &net.UDPAddr{IP: *bcastAddr, Port: port, Zone: ""}, nil
+	for _, iface := range ifaces {
+		if len(name) > 0 && iface.Name != name {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.To4() != nil && check(iface, ipNet) {
+				return &net.IPNet{IP: ipNet.IP.To4(), Mask: ipNet.Mask}, nil
+			}
+		}
+		if len(name) > 0 {
+			return nil, fmt.Errorf("cannot find IPv4 address of interface %s", name)
+		}
+	}
+	if len(name) > 0 {
+		return nil, fmt.Errorf("cannot find interface %s", name)
+	}
+	return nil, errors.New("cannot find broadcast capable interface")
 }
 
+// getLocalIPAddr returns the IPv4 address of the default route interface
 func getLocalIPAddr() (*net.IP, error) {
-	conn, err := net.Dial(udpNetwork, probeAddress)
+	name, err := defaultRouteInterface()
+	if err != nil {
+		return nil, err
+	}
+	ipNet, err := interfaceIPNet(name, func(_ net.Interface, n *net.IPNet) bool { return !n.IP.IsLoopback() })
 	if err != nil {
 		return nil, err
 	}
-	defer conn.Close()
-	addr := conn.LocalAddr().(*net.UDPAddr).IP
-	return &addr, nil
+	return &ipNet.IP, nil
 }
 
 func getLocalIPNet(localAddr *net.IP) (*net.IPNet, error) {
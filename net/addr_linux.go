@@ -0,0 +1,47 @@
+package net
+
+import (
+	"errors"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// routeTable is the Linux IPv4 routing table, the interface of the default route is looked up in it
+var routeTable = "/proc/net/route"
+
+// defaultRouteInterface returns the interface of the default route
+func defaultRouteInterface() (string, error) {
+	return readDefaultRoute(routeTable)
+}
+
+// readDefaultRoute returns the interface of the default route with the lowest metric in the routing table file
+func readDefaultRoute(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	result := ""
+	metric := uint64(0)
+	for _, line := range strings.Split(string(data), "\n")[1:] { // the header is skipped
+		fields := strings.Fields(line)
+		if len(fields) < 8 || fields[1] != "00000000" || fields[7] != "00000000" {
+			continue
+		}
+		flags, err := strconv.ParseUint(fields[3], 16, 16)
+		if err != nil || flags&0x1 == 0 { // RTF_UP
+			continue
+		}
+		m, err := strconv.ParseUint(fields[6], 10, 32)
+		if err != nil {
+			continue
+		}
+		if len(result) == 0 || m < metric {
+			result, metric = fields[0], m
+		}
+	}
+	if len(result) == 0 {
+		return "", errors.New("cannot find default route")
+	}
+	return result, nil
+}
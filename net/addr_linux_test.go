@@ -0,0 +1,63 @@
+package net
+
+import (
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/eip/miio2mqtt/config"
+	h "github.com/eip/miio2mqtt/helpers"
+)
+
+func Test_readDefaultRoute(t *testing.T) {
+	header := "Iface\tDestination\tGateway \tFlags\tRefCnt\tUse\tMetric\tMask\t\tMTU\tWindow\tIRTT\n"
+	tests := []struct {
+		name  string
+		table string
+		want  string
+		err   error
+	}{
+		{
+			name:  "Default route",
+			table: "eth0\t000200C0\t00000000\t0001\t0\t0\t0\t00FFFFFF\t0\t0\t0\neth0\t00000000\t010200C0\t0003\t0\t0\t0\t00000000\t0\t0\t0\n",
+			want:  "eth0",
+		},
+		{
+			name:  "Lowest metric",
+			table: "wlan0\t00000000\t0101A8C0\t0003\t0\t0\t600\t00000000\t0\t0\t0\neth0\t00000000\t010200C0\t0003\t0\t0\t100\t00000000\t0\t0\t0\n",
+			want:  "eth0",
+		},
+		{
+			name:  "Route down",
+			table: "eth0\t00000000\t010200C0\t0002\t0\t0\t0\t00000000\t0\t0\t0\n",
+			err:   errors.New("cannot find default route"),
+		},
+		{
+			name: "No routes",
+			err:  errors.New("cannot find default route"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "route")
+			h.AssertError(t, ioutil.WriteFile(path, []byte(header+tt.table), 0600), nil)
+			got, err := readDefaultRoute(path)
+			h.AssertError(t, err, tt.err)
+			h.AssertEqual(t, got, tt.want)
+		})
+	}
+}
+
+func Test_findIPNet_noRouteTable(t *testing.T) {
+	defer func(path string) { routeTable = path }(routeTable)
+	routeTable = filepath.Join(t.TempDir(), "route")
+	want, werr := interfaceIPNet("", broadcastCapable)
+	got, err := findIPNet(config.InterfaceOptions{})
+	if werr != nil {
+		h.AssertEqual(t, err != nil, true)
+		return
+	}
+	h.AssertError(t, err, nil)
+	h.AssertEqual(t, got, want) // the first broadcast capable interface
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+// +build !linux
+
+package net
+
+import "errors"
+
+// defaultRouteInterface is not supported without the Linux routing table, a broadcast capable interface is used instead
+func defaultRouteInterface() (string, error) {
+	return "", errors.New("routing table is not available")
+}
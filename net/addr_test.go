@@ -7,6 +7,7 @@ import (
 	"regexp"
 	"testing"
 
+	"github.com/eip/miio2mqtt/config"
 	h "github.com/eip/miio2mqtt/helpers"
 )
 
@@ -45,6 +46,24 @@ func Test_ParseUDPAddr(t *testing.T) {
 	}
 }
 
+func Test_ParseHostPort(t *testing.T) {
+	tests := []struct {
+		addr string
+		want string
+	}{
+		{addr: "192.168.20.255", want: "192.168.20.255:54321"},
+		{addr: "192.168.20.255:12345", want: "192.168.20.255:12345"},
+		{addr: "192.168.20.255:port", want: "<nil>"},
+		{addr: "192.168.20.256", want: "<nil>"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			got := ParseHostPort(tt.addr, 54321)
+			h.AssertEqual(t, got.String(), tt.want)
+		})
+	}
+}
+
 func Test_GetUDPAddresses(t *testing.T) {
 	tests := []struct {
 		name      string
@@ -70,6 +89,32 @@ func Test_GetUDPAddresses(t *testing.T) {
 	}
 }
 
+func Test_ResolveInterface(t *testing.T) {
+	tests := []struct {
+		name      string
+		iface     config.InterfaceOptions
+		wantLocal string
+		wantBC    string
+		err       error
+	}{
+		{name: "Name", iface: config.InterfaceOptions{Name: "lo"}, wantLocal: "127.0.0.1:0", wantBC: "127.255.255.255:54321"},
+		{name: "Bind IP", iface: config.InterfaceOptions{BindIP: "127.0.0.1"}, wantLocal: "127.0.0.1:0", wantBC: "127.255.255.255:54321"},
+		{name: "Broadcast", iface: config.InterfaceOptions{Name: "lo", Broadcast: "127.0.0.255"}, wantLocal: "127.0.0.1:0", wantBC: "127.0.0.255:54321"},
+		{name: "Any IP", iface: config.InterfaceOptions{BindIP: "0.0.0.0", Broadcast: "255.255.255.255"}, wantLocal: "0.0.0.0:0", wantBC: "255.255.255.255:54321"},
+		{name: "Unknown name", iface: config.InterfaceOptions{Name: "nosuch0"}, wantLocal: "<nil>", wantBC: "<nil>", err: errors.New("cannot find interface nosuch0")},
+		{name: "Unknown IP", iface: config.InterfaceOptions{BindIP: "0.0.0.0"}, wantLocal: "<nil>", wantBC: "<nil>", err: errors.New("cannot find interface with IP address 0.0.0.0")},
+		{name: "Invalid IP", iface: config.InterfaceOptions{BindIP: "localhost"}, wantLocal: "<nil>", wantBC: "<nil>", err: errors.New("invalid bind address: localhost")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotLocal, gotBC, _, err := ResolveInterface(tt.iface, 54321)
+			h.AssertError(t, err, tt.err)
+			h.AssertEqual(t, gotLocal.String(), tt.wantLocal)
+			h.AssertEqual(t, gotBC.String(), tt.wantBC)
+		})
+	}
+}
+
 func Test_getLocalIPAddr(t *testing.T) {
 	tests := []struct {
 		name string
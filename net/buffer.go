@@ -0,0 +1,71 @@
+package net
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// maxDatagramSize is the largest miIO packet, its length field is 16 bit
+const maxDatagramSize = 0xffff
+
+// pooledBufferSize fits the realistic miIO packets, which stay within the Ethernet MTU;
+// larger ones get a buffer of their own size
+const pooledBufferSize = 1536
+
+// packetBuffer is the storage of the received datagram, it is owned by one UDPPacket until it is released
+type packetBuffer struct {
+	data []byte
+}
+
+// bufferPool keeps small buffers, so the queued packets do not pin the maximum datagram size each
+var bufferPool = sync.Pool{
+	New: func() interface{} { return &packetBuffer{data: make([]byte, pooledBufferSize)} },
+}
+
+// TransportStats are counters of the received packets
+type TransportStats struct {
+	Received  uint64
+	Truncated uint64 // shorter than their length field
+}
+
+// newPacketBuffer copies the datagram read into the shared buffer to the buffer owned by the packet
+func newPacketBuffer(data []byte) *packetBuffer {
+	if len(data) > pooledBufferSize {
+		b := &packetBuffer{data: make([]byte, len(data))}
+		copy(b.data, data)
+		return b
+	}
+	b := bufferPool.Get().(*packetBuffer)
+	b.data = b.data[:len(data)]
+	copy(b.data, data)
+	return b
+}
+
+func (b *packetBuffer) release() {
+	if cap(b.data) != pooledBufferSize {
+		return
+	}
+	bufferPool.Put(b)
+}
+
+// Release returns the packet buffer to the pool, the packet data must not be used afterwards
+func (p *UDPPacket) Release() {
+	if p.buffer == nil {
+		return
+	}
+	p.buffer.release()
+	p.buffer = nil
+	p.Data = nil
+}
+
+// declaredLength returns the packet length from the miIO header, the packet shorter than it is counted as truncated
+func declaredLength(data []byte, truncated *uint64) int {
+	if len(data) < 4 {
+		return len(data)
+	}
+	length := int(data[2])<<8 | int(data[3])
+	if length > len(data) {
+		atomic.AddUint64(truncated, 1)
+	}
+	return length
+}
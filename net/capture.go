@@ -0,0 +1,94 @@
+package net
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Capture directions
+const (
+	CaptureIn  = "in"
+	CaptureOut = "out"
+)
+
+// CaptureRecord is the datagram sent or received by the transport, stored as a JSON line
+type CaptureRecord struct {
+	Time      time.Time `json:"time"`
+	Direction string    `json:"dir"`
+	Peer      string    `json:"peer"` // remote ip:port
+	Data      string    `json:"data"` // hex encoded datagram
+}
+
+// Capture writes datagrams to the JSONL capture file
+type Capture struct {
+	sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+}
+
+// OpenCapture creates the capture file, the previous capture is truncated as request IDs start over in every run
+func OpenCapture(path string) (*Capture, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &Capture{file: file, enc: json.NewEncoder(file)}, nil
+}
+
+// Record writes the datagram to the capture file
+func (c *Capture) Record(t time.Time, direction string, peer *net.UDPAddr, data []byte) error {
+	c.Lock()
+	defer c.Unlock()
+	return c.enc.Encode(&CaptureRecord{Time: t, Direction: direction, Peer: peer.String(), Data: hex.EncodeToString(data)})
+}
+
+// Close closes the capture file
+func (c *Capture) Close() error {
+	c.Lock()
+	defer c.Unlock()
+	return c.file.Close()
+}
+
+// ReadCapture reads all records of the capture file
+func ReadCapture(path string) ([]CaptureRecord, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	result := []CaptureRecord{}
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		r := CaptureRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, line, err)
+		}
+		if r.Direction != CaptureIn && r.Direction != CaptureOut {
+			return nil, fmt.Errorf("%s:%d: invalid direction %q", path, line, r.Direction)
+		}
+		result = append(result, r)
+	}
+	return result, scanner.Err()
+}
+
+// Datagram returns the decoded datagram and the peer address
+func (r *CaptureRecord) Datagram() ([]byte, *net.UDPAddr, error) {
+	data, err := hex.DecodeString(r.Data)
+	if err != nil {
+		return nil, nil, err
+	}
+	addr, err := net.ResolveUDPAddr(udpNetwork, r.Peer)
+	if err != nil {
+		return nil, nil, err
+	}
+	return data, addr, nil
+}
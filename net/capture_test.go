@@ -0,0 +1,107 @@
+package net
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eip/miio2mqtt/config"
+	h "github.com/eip/miio2mqtt/helpers"
+)
+
+func TestCapture(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.jsonl")
+	c, err := OpenCapture(path)
+	h.AssertError(t, err, nil)
+	start := time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+	device := &net.UDPAddr{IP: net.IPv4(192, 168, 1, 11).To4(), Port: 54321}
+	h.AssertError(t, c.Record(start, CaptureOut, device, []byte{0x21, 0x31}), nil)
+	h.AssertError(t, c.Record(start.Add(time.Second), CaptureIn, device, []byte{0x21, 0x31, 0x00, 0x20}), nil)
+	h.AssertError(t, c.Close(), nil)
+
+	records, err := ReadCapture(path)
+	h.AssertError(t, err, nil)
+	h.AssertEqual(t, records, []CaptureRecord{
+		{Time: start, Direction: CaptureOut, Peer: "192.168.1.11:54321", Data: "2131"},
+		{Time: start.Add(time.Second), Direction: CaptureIn, Peer: "192.168.1.11:54321", Data: "21310020"},
+	})
+	data, addr, err := records[1].Datagram()
+	h.AssertError(t, err, nil)
+	h.AssertEqual(t, data, []byte{0x21, 0x31, 0x00, 0x20})
+	h.AssertEqual(t, addr.String(), "192.168.1.11:54321")
+
+	c, err = OpenCapture(path) // the next run starts a new capture
+	h.AssertError(t, err, nil)
+	h.AssertError(t, c.Record(start.Add(time.Hour), CaptureOut, device, []byte{0x21, 0x31}), nil)
+	h.AssertError(t, c.Close(), nil)
+	records, err = ReadCapture(path)
+	h.AssertError(t, err, nil)
+	h.AssertEqual(t, records, []CaptureRecord{{Time: start.Add(time.Hour), Direction: CaptureOut, Peer: "192.168.1.11:54321", Data: "2131"}})
+
+	h.AssertError(t, ioutil.WriteFile(path, []byte(`{"dir":"sideways"}`), 0600), nil)
+	_, err = ReadCapture(path)
+	h.AssertError(t, err, errors.New(path+`:1: invalid direction "sideways"`))
+}
+
+func TestReplayTransport(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "capture.jsonl")
+	hello := "21310020" + strings.Repeat("ff", 28)
+	packet := func(did string, fill string) string {
+		return "21310030" + "00000000" + did + "00000010" + strings.Repeat(fill, 32)
+	}
+	h.AssertError(t, ioutil.WriteFile(path, []byte(`{"time":"2021-03-01T12:00:00Z","dir":"out","peer":"192.168.1.255:54321","data":"`+hello+`"}
+{"time":"2021-03-01T12:00:00.01Z","dir":"in","peer":"192.168.1.11:54321","data":"21310020000000000011223300061e39ffffffffffffffffffffffffffffffff"}
+{"time":"2021-03-01T12:00:01Z","dir":"out","peer":"192.168.1.11:54321","data":"`+packet("00112233", "00")+`"}
+{"time":"2021-03-01T12:00:01.01Z","dir":"out","peer":"192.168.1.12:54321","data":"`+packet("00445566", "00")+`"}
+{"time":"2021-03-01T12:00:01.02Z","dir":"in","peer":"192.168.1.12:54321","data":"`+packet("00445566", "bb")+`"}
+{"time":"2021-03-01T12:00:01.03Z","dir":"in","peer":"192.168.1.11:54321","data":"`+packet("00112233", "aa")+`"}
+{"time":"2021-03-01T12:00:02Z","dir":"out","peer":"192.168.1.11:54321","data":"`+packet("00112233", "00")+`"}
+`), 0600), nil)
+	transport, err := NewReplayTransport(config.New(), path)
+	h.AssertError(t, err, nil)
+	h.AssertEqual(t, transport.Broadcast()[0].String(), "255.255.255.255:54321")
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := sync.WaitGroup{}
+	defer wg.Wait()
+	defer cancel()
+	h.AssertError(t, transport.Start(ctx, &wg), nil)
+	receive := func() *UDPPacket {
+		select {
+		case pkt := <-transport.Packets():
+			return pkt
+		case <-time.After(100 * time.Millisecond):
+			return nil
+		}
+	}
+	send := func(data string, addr *net.UDPAddr) {
+		raw, err := hex.DecodeString(data)
+		h.AssertError(t, err, nil)
+		h.AssertError(t, transport.Send(raw, addr), nil)
+	}
+
+	h.AssertEqual(t, receive() == nil, true) // waits for the hello packet
+	send(hello, transport.Broadcast()[0])
+	pkt := receive()
+	h.AssertEqual(t, pkt.Address.String(), "192.168.1.11:54321")
+	h.AssertEqual(t, len(pkt.Data), 32)
+	h.AssertEqual(t, receive() == nil, true)     // waits for the request
+	send(packet("00112233", "01"), &pkt.Address) // the other device was asked first in the capture
+	pkt = receive()
+	h.AssertEqual(t, hex.EncodeToString(pkt.Data), packet("00112233", "aa"))
+	send(packet("00445566", "01"), &net.UDPAddr{IP: net.IPv4(192, 168, 1, 12), Port: 54321})
+	pkt = receive()
+	h.AssertEqual(t, pkt.Address.String(), "192.168.1.12:54321")
+	h.AssertEqual(t, hex.EncodeToString(pkt.Data), packet("00445566", "bb"))
+	send(packet("00112233", "01"), &net.UDPAddr{IP: net.IPv4(192, 168, 1, 11), Port: 54321})
+	h.AssertEqual(t, receive() == nil, true) // the captured request was not answered
+	send(packet("00112233", "01"), &net.UDPAddr{IP: net.IPv4(192, 168, 1, 11), Port: 54321})
+	h.AssertEqual(t, receive() == nil, true) // nothing left to replay
+	h.AssertEqual(t, transport.Stats().Received, uint64(3))
+}
@@ -0,0 +1,150 @@
+package net
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/eip/miio2mqtt/config"
+	log "github.com/go-pkgz/lgr"
+)
+
+// MultiTransport serves several interfaces at once, each one with its own UDP transport;
+// received packets are merged and sent ones are routed to the transport of the destination network
+type MultiTransport struct {
+	transports []*UDPTransport
+	started    []*UDPTransport // transports started for the current poll
+	config     *config.Config
+	packets    chan *UDPPacket
+	cancel     context.CancelFunc
+	forwarders sync.WaitGroup
+	capture    *Capture // shared by all transports
+}
+
+// NewMultiTransport creates the transport of every configured interface
+func NewMultiTransport(config *config.Config) *MultiTransport {
+	m := MultiTransport{config: config}
+	for _, iface := range config.Interfaces {
+		m.transports = append(m.transports, NewInterfaceTransport(config, iface))
+	}
+	return &m
+}
+
+// Start starts the transports of all interfaces, the ones unable to listen are skipped until the next start
+func (m *MultiTransport) Start(ctx context.Context, wg *sync.WaitGroup) error {
+	if m.capture == nil && len(m.config.Capture) > 0 {
+		var err error
+		if m.capture, err = OpenCapture(m.config.Capture); err != nil {
+			return err
+		}
+		log.Printf("[INFO] capturing miIO traffic to %s", m.config.Capture)
+	}
+	m.started = nil
+	for _, t := range m.transports {
+		t.capture = m.capture
+		if err := t.Start(ctx, wg); err != nil {
+			log.Printf("[WARN] unable to listen on %s: %v", interfaceName(t.Interface), err)
+			continue
+		}
+		m.started = append(m.started, t)
+	}
+	if len(m.started) == 0 {
+		return errors.New("no interface to listen on")
+	}
+	m.packets = make(chan *UDPPacket, 1+2*len(m.config.Devices))
+	ctx, m.cancel = context.WithCancel(ctx)
+	for _, t := range m.started {
+		m.forwarders.Add(1)
+		go func(in <-chan *UDPPacket) { defer m.forwarders.Done(); m.forward(ctx, in) }(t.Packets())
+	}
+	return nil
+}
+
+func (m *MultiTransport) Stop() {
+	m.cancel()
+	m.forwarders.Wait()
+	for _, t := range m.started {
+		t.Stop()
+	}
+	count := 0
+loop:
+	for {
+		select {
+		case pkt := <-m.packets:
+			pkt.Release()
+			count++
+		default:
+			break loop
+		}
+	}
+	if count > 0 {
+		log.Printf("[DEBUG] %d packets purged", count)
+	}
+	m.packets = nil
+	m.started = nil
+}
+
+func (m *MultiTransport) Packets() <-chan *UDPPacket {
+	return m.packets
+}
+
+// Send writes the datagram through the transport of the destination network, the first one if there is no such one
+func (m *MultiTransport) Send(data []byte, addr *net.UDPAddr) error {
+	for _, t := range m.started {
+		if t.BroadcastAddress.IP.Equal(addr.IP) || t.Network != nil && t.Network.Contains(addr.IP) {
+			return t.Send(data, addr)
+		}
+	}
+	if len(m.started) == 0 {
+		return errors.New("no interface to send to " + addr.String())
+	}
+	return m.started[0].Send(data, addr)
+}
+
+// Broadcast returns the broadcast addresses of all interfaces
+func (m *MultiTransport) Broadcast() []*net.UDPAddr {
+	result := []*net.UDPAddr{}
+	for _, t := range m.started {
+		result = append(result, t.BroadcastAddress)
+	}
+	return result
+}
+
+// Stats returns the received packet counters of all interfaces
+func (m *MultiTransport) Stats() TransportStats {
+	result := TransportStats{}
+	for _, t := range m.transports {
+		s := t.Stats()
+		result.Received += s.Received
+		result.Truncated += s.Truncated
+	}
+	return result
+}
+
+func (m *MultiTransport) forward(ctx context.Context, in <-chan *UDPPacket) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case pkt := <-in:
+			select {
+			case m.packets <- pkt:
+				m.config.UpdateChanStat(len(m.packets), 0)
+			case <-ctx.Done():
+				pkt.Release()
+				return
+			}
+		}
+	}
+}
+
+func interfaceName(iface config.InterfaceOptions) string {
+	switch {
+	case len(iface.Name) > 0:
+		return iface.Name
+	case len(iface.BindIP) > 0:
+		return iface.BindIP
+	}
+	return "the default interface"
+}
@@ -0,0 +1,62 @@
+package net
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eip/miio2mqtt/config"
+	h "github.com/eip/miio2mqtt/helpers"
+)
+
+func TestMultiTransport(t *testing.T) {
+	cfg := config.New()
+	cfg.Interfaces = []config.InterfaceOptions{
+		{Name: "lo"},
+		{BindIP: "127.0.0.1", Broadcast: "127.0.0.255"},
+		{Name: "nosuch0"},
+	}
+	transport := NewMultiTransport(cfg)
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := sync.WaitGroup{}
+	defer wg.Wait()
+	defer cancel()
+	h.AssertError(t, transport.Start(ctx, &wg), nil)
+	defer transport.Stop()
+	h.AssertEqual(t, len(transport.started), 2)
+	h.AssertEqual(t, transport.Broadcast(), []*net.UDPAddr{
+		{IP: net.IPv4(127, 255, 255, 255).To4(), Port: cfg.MiioPort},
+		{IP: net.IPv4(127, 0, 0, 255).To4(), Port: cfg.MiioPort},
+	})
+
+	peer, err := net.ListenUDP(udpNetwork, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	h.AssertError(t, err, nil)
+	defer peer.Close()
+	for i, tr := range transport.started {
+		_, err := peer.WriteToUDP(testDatagram(i, 0, 64), tr.Connection.LocalAddr().(*net.UDPAddr))
+		h.AssertError(t, err, nil)
+	}
+	received := map[string]bool{}
+	for len(received) < 2 {
+		select {
+		case pkt := <-transport.Packets():
+			received[string(pkt.Data)] = true
+			pkt.Release()
+		case <-time.After(time.Second):
+			t.Fatalf("%d of 2 packets received", len(received))
+		}
+	}
+	h.AssertEqual(t, received[string(testDatagram(0, 0, 64))], true)
+	h.AssertEqual(t, received[string(testDatagram(1, 0, 64))], true)
+	h.AssertEqual(t, transport.Stats(), TransportStats{Received: 2})
+
+	h.AssertError(t, transport.Send([]byte{0x21, 0x31, 0x00, 0x04}, peer.LocalAddr().(*net.UDPAddr)), nil)
+	buffer := make([]byte, 16)
+	h.AssertError(t, peer.SetReadDeadline(time.Now().Add(time.Second)), nil)
+	n, from, err := peer.ReadFromUDP(buffer)
+	h.AssertError(t, err, nil)
+	h.AssertEqual(t, buffer[:n], []byte{0x21, 0x31, 0x00, 0x04})
+	h.AssertEqual(t, from.String(), transport.started[0].Connection.LocalAddr().String()) // the loopback network of the first interface
+}
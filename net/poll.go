@@ -2,8 +2,11 @@ package net
 
 import (
 	"context"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
 	"sync"
 	"time"
 
@@ -14,27 +17,84 @@ import (
 )
 
 type Poller struct {
-	config    *config.Config
-	transport *UDPTransport
-	devices   miio.Devices
-	updates   chan *miio.Device
+	config       *config.Config
+	transport    Transport
+	devices      miio.Devices
+	updates      chan *miio.Device
+	identified   chan *miio.Device
+	availability chan *miio.Device
+	errors       chan *miio.Device
+	tokens       chan *miio.DiscoveredToken
+	responses    chan *Response
+	foundTokens  map[uint32]string                 // device ID => reported token
+	polled       map[*miio.Device]miio.DeviceStage // devices polled during the current poll => stage at its start
+	broadcast    []*net.UDPAddr                    // extra hello targets
 }
 
-func NewPoller(config *config.Config, transport *UDPTransport, devices miio.Devices) *Poller {
+// Response represents the device reply to an RPC command
+type Response struct {
+	Device *miio.Device
+	Data   []byte
+}
+
+func NewPoller(config *config.Config, transport Transport, devices miio.Devices) *Poller {
 	updates := make(chan *miio.Device, 1+2*len(config.Devices)) // TODO check chan max length
-	return &Poller{config: config, transport: transport, devices: devices, updates: updates}
+	identified := make(chan *miio.Device, 1+len(config.Devices))
+	availability := make(chan *miio.Device, 1+2*len(config.Devices))
+	deviceErrors := make(chan *miio.Device, 1+2*len(config.Devices))
+	tokens := make(chan *miio.DiscoveredToken, 16)
+	responses := make(chan *Response, 1+2*len(config.Devices))
+	broadcast := []*net.UDPAddr{}
+	for _, b := range config.Broadcast {
+		if addr := ParseHostPort(b, config.MiioPort); addr != nil {
+			broadcast = append(broadcast, addr)
+			continue
+		}
+		log.Printf("[WARN] invalid broadcast address: %s", b)
+	}
+	return &Poller{
+		config:       config,
+		transport:    transport,
+		devices:      devices,
+		updates:      updates,
+		identified:   identified,
+		availability: availability,
+		errors:       deviceErrors,
+		tokens:       tokens,
+		responses:    responses,
+		foundTokens:  map[uint32]string{},
+		polled:       map[*miio.Device]miio.DeviceStage{},
+		broadcast:    broadcast,
+	}
 }
 
-// PollDevices queries devices and updates devices info
-func (p *Poller) PollDevices(ctx context.Context) error {
-	left := p.devices.Count(miio.DeviceNeedsUpdate)
-	if left == 0 {
+// PollDevices queries the devices picked by the poll check which are not updated yet and updates devices info
+func (p *Poller) PollDevices(ctx context.Context, poll miio.CheckDevice) error {
+	p.polled = map[*miio.Device]miio.DeviceStage{}
+	for _, d := range p.devices {
+		if d.InFinalStage() || !poll(d) {
+			p.rejectCommands(d)
+			continue
+		}
+		if d.Resting() { // woken up by a command between its scheduled polls
+			log.Printf("[DEBUG] %s is skipped after %d failed polls", d.Name, d.Failures())
+			p.rejectCommands(d)
+			continue
+		}
+		p.polled[d] = d.Stage()
+	}
+	left := p.devices.Count(p.deviceBusy)
+	if left == 0 && !p.config.DiscoverTokens {
 		log.Print("[INFO] no device to update")
 		return nil
 	}
 
 	ctx, cancel := context.WithTimeout(ctx, p.config.PollTimeout)
 	defer cancel()
+	for _, d := range p.devices {
+		d.ResetBatches()
+		d.ResetFailed()
+	}
 
 	wg := sync.WaitGroup{}
 	wg.Add(1)
@@ -52,103 +112,329 @@ loop:
 		}
 		if len(pkt.Data) == 32 {
 			p.processHelloReply(pkt)
+			pkt.Release()
 			continue
 		}
-		if ok := p.processReply(pkt); !ok {
-			continue
-		}
-		left--
-		if left == 0 {
+		p.processReply(pkt)
+		pkt.Release()
+		left = p.devices.Count(p.deviceBusy)       // commands may bring updated devices back or wait for RPC replies
+		if left == 0 && !p.config.DiscoverTokens { // keep listening for hello replies of unknown devices
 			break loop
 		}
 	}
 	cancel()
 	err := error(nil)
-	if left > 0 {
+	if p.devices.Count(p.deviceUnreachable) > 0 {
 		err = ctx.Err()
 	}
+	if failed := p.devices.Count(p.deviceFailed); failed > 0 {
+		if err != nil {
+			err = fmt.Errorf("%v, %d devices replied with error", err, failed)
+		} else {
+			err = fmt.Errorf("%d devices replied with error", failed)
+		}
+	}
 	wg.Wait()
+	p.expireRequests()
+	p.updateBackoff()
 	return err
 }
 
+// updateBackoff counts the failed polls of the devices that did not reply, they are skipped by the following polls
+func (p *Poller) updateBackoff() {
+	for d, stage := range p.polled {
+		if d.Stage() > stage || d.InFinalStage() || d.Failed() {
+			p.setReachable(d)
+			continue
+		}
+		if d.PollFailed(p.config.QuarantineAfter, p.config.ProbeEvery) {
+			log.Printf("[WARN] %s is unreachable, quarantined after %d failed polls", d.Name, d.Failures())
+		}
+	}
+}
+
+// setReachable resets the device backoff, the quarantined device return is logged
+func (p *Poller) setReachable(d *miio.Device) {
+	if failures, quarantined := d.PollSucceeded(); quarantined {
+		log.Printf("[INFO] %s is reachable again after %d failed polls", d.Name, failures)
+	}
+}
+
 func (p *Poller) Updates() <-chan *miio.Device {
 	return p.updates
 }
 
+// Identified returns the channel of devices which model was identified
+func (p *Poller) Identified() <-chan *miio.Device {
+	return p.identified
+}
+
+// AnnounceRestored queues devices identified by the saved state, so their discovery configs are published
+func (p *Poller) AnnounceRestored() {
+	for _, d := range p.devices {
+		if miio.DeviceFound(d) && len(d.Model()) > 0 {
+			p.queueIdentified(d)
+		}
+	}
+}
+
+func (p *Poller) queueIdentified(d *miio.Device) {
+	select {
+	case p.identified <- d:
+	default:
+		log.Printf("[WARN] unable to queue %s identification", d.Name)
+	}
+}
+
+// Availability returns the channel of devices which availability was changed
+func (p *Poller) Availability() <-chan *miio.Device {
+	return p.availability
+}
+
+// UpdateAvailability marks undiscovered (e.g. outdated) devices as unavailable
+func (p *Poller) UpdateAvailability() {
+	for _, d := range p.devices {
+		if !miio.DeviceFound(d) {
+			p.setAvailable(d, false)
+		}
+	}
+}
+
+func (p *Poller) setAvailable(d *miio.Device, available bool) {
+	if !d.SetAvailable(available) {
+		return
+	}
+	select {
+	case p.availability <- d:
+	default:
+		log.Printf("[WARN] unable to queue %s availability", d.Name)
+	}
+}
+
+// Errors returns the channel of devices which last error was changed
+func (p *Poller) Errors() <-chan *miio.Device {
+	return p.errors
+}
+
+func (p *Poller) setError(d *miio.Device, err *miio.DeviceError) {
+	if !d.SetError(err) {
+		return
+	}
+	select {
+	case p.errors <- d:
+	default:
+		log.Printf("[WARN] unable to queue %s error", d.Name)
+	}
+}
+
+// Tokens returns the channel of tokens leaked in hello replies
+func (p *Poller) Tokens() <-chan *miio.DiscoveredToken {
+	return p.tokens
+}
+
+// reportToken logs the token leaked by the device and queues it to be published, each token is reported once
+func (p *Poller) reportToken(did uint32, addr string, token []byte) {
+	if p.foundTokens[did] == hex.EncodeToString(token) {
+		return
+	}
+	p.foundTokens[did] = hex.EncodeToString(token)
+	log.Printf("[INFO] device %08x (%s) token: %x", did, addr, token)
+	select {
+	case p.tokens <- &miio.DiscoveredToken{ID: did, Address: addr, Token: token}:
+	default:
+		log.Printf("[WARN] unable to queue %08x token", did)
+	}
+}
+
+func (p *Poller) Responses() <-chan *Response {
+	return p.responses
+}
+
+// Respond queues the RPC command response to be published
+func (p *Poller) Respond(d *miio.Device, data []byte) {
+	select {
+	case p.responses <- &Response{Device: d, Data: data}:
+	default:
+		log.Printf("[WARN] unable to queue %s RPC response: %s", d.Name, data)
+	}
+}
+
+// rejectCommands fails the commands queued for the quarantined device, as they would wait for it for too long
+func (p *Poller) rejectCommands(d *miio.Device) {
+	if !d.Quarantined() {
+		return
+	}
+	for _, cmd := range d.PopCommands() {
+		if cmd.RPC {
+			p.Respond(d, cmd.ErrorResponse(errors.New("device is unreachable")))
+			continue
+		}
+		log.Printf("[WARN] unable to send %s to %s: device is unreachable", cmd.Request, d.Name)
+	}
+}
+
+// expireRequests forgets requests still waiting for reply at the end of the poll
+func (p *Poller) expireRequests() {
+	for _, d := range p.devices {
+		p.reportExpired(d, d.CancelRequests())
+	}
+}
+
+// reportExpired logs requests left without reply, RPC commands get the timeout response;
+// info and get_prop requests are sent again while the poll lasts, commands are not
+func (p *Poller) reportExpired(d *miio.Device, requests []*miio.SentRequest) {
+	if len(requests) > 0 && d.ResetRestored() { // the device may have been rebooted since its state was saved
+		log.Printf("[INFO] no reply from %s with the restored state, finding it again", d.Name)
+	}
+	for _, req := range requests {
+		if req.Kind != miio.CommandRequest {
+			log.Printf("[DEBUG] no reply from %s to %s", d.Name, req.Data)
+			continue
+		}
+		if req.Command.RPC {
+			p.Respond(d, req.Command.ErrorResponse(errors.New("timeout")))
+			continue
+		}
+		log.Printf("[WARN] no reply from %s to %s", d.Name, req.Data)
+	}
+}
+
+// nextRound returns the time until the next round of requests, which is the earliest request deadline
+// if it comes before the regular round
+func (p *Poller) nextRound(now time.Time) time.Duration {
+	result := p.config.PollTimeout / 5
+	for d := range p.polled {
+		deadline := d.NextDeadline()
+		if deadline.IsZero() {
+			continue
+		}
+		if in := deadline.Sub(now); in < result {
+			result = in
+		}
+	}
+	if result < 0 {
+		return 0
+	}
+	return result
+}
+
 func (p *Poller) sendPackets(ctx context.Context) {
 	helloPacket, _ := miio.NewHelloPacket().Encode(nil)
 	next := time.Duration(p.config.PollTimeout / 50)
 	log.Print("[DEBUG] start sending requests")
+	discover := p.config.DiscoverTokens
 	for {
 		select {
 		case <-time.After(next):
 			helloPacketSent := false
-			anyPacketSent := false
+			anyPacketSent := false // or any request is waiting for reply
+			now := time.Now()
+			if discover { // once per poll, as all known devices may be discovered already
+				discover = false
+				helloPacketSent = p.sendHello(helloPacket)
+				anyPacketSent = helloPacketSent // the discovered devices are queried by the next round
+			}
 			for _, d := range p.devices {
+				if _, ok := p.polled[d]; !ok {
+					continue
+				}
+				p.reportExpired(d, d.ExpireRequests(now))
 				if d.InFinalStage() {
 					continue
 				}
 				switch d.Stage() {
 				case miio.Undiscovered:
+					if len(d.Address) > 0 { // the configured address may be out of the broadcast reach
+						if p.sendDeviceHello(d, helloPacket) {
+							anyPacketSent = true
+						}
+						break
+					}
 					if helloPacketSent {
 						break
 					}
-					log.Printf("[DEBUG] sending hello packet to %v", p.transport.BroadcastAddress)
-					if _, err := p.transport.Connection.WriteToUDP(helloPacket, p.transport.BroadcastAddress); err != nil {
-						log.Printf("[WARN] %v", err)
+					if !p.sendHello(helloPacket) {
 						break
 					}
 					helloPacketSent = true
 					anyPacketSent = true
 				case miio.Found:
-					addr := ParseUDPAddr(d.Address, p.config.MiioPort)
+					if d.Failed() {
+						break
+					}
+					if !d.TimeShiftKnown() { // the restored device time is learned again
+						if p.sendDeviceHello(d, helloPacket) {
+							anyPacketSent = true
+						}
+						break
+					}
+					if d.Waiting(miio.InfoRequest, 0) {
+						anyPacketSent = true
+						break
+					}
+					addr := p.deviceAddr(d)
 					if addr == nil {
-						log.Printf("[WARN] invalid %s address: %s", d.Name, d.Address)
 						break
 					}
 					info := p.config.Models.MiioInfo("*")
 					if len(info) == 0 {
 						break
 					}
-					req, data, err := d.Request([]byte(info))
+					req, data, err := d.InfoRequest([]byte(info), p.config.RequestTimeout)
 					if err != nil {
 						log.Printf("[WARN] %v", err)
 						break
 					}
 					log.Printf("[DEBUG] sending %s to %s (%s)", req.Data, d.Name, addr)
-					if _, err := p.transport.Connection.WriteToUDP(data, addr); err != nil {
+					if err := p.transport.Send(data, addr); err != nil {
 						log.Printf("[WARN] %v", err)
 						break
 					}
 					anyPacketSent = true
 				case miio.Valid:
-					addr := ParseUDPAddr(d.Address, p.config.MiioPort)
+					addr := p.deviceAddr(d)
 					if addr == nil {
-						log.Printf("[WARN] invalid %s address: %s", d.Name, d.Address)
 						break
 					}
-					getProp := p.config.Models.GetProp(d.Model())
-					if len(getProp) == 0 {
-						break
+					for _, command := range d.PopCommands() {
+						req, data, err := d.CommandRequest(command, p.config.RequestTimeout)
+						if err != nil {
+							log.Printf("[WARN] %v", err)
+							continue
+						}
+						log.Printf("[DEBUG] sending %s to %s (%s)", req.Data, d.Name, addr)
+						if err := p.transport.Send(data, addr); err != nil {
+							log.Printf("[WARN] %v", err)
+						}
 					}
-					req, data, err := d.Request([]byte(getProp))
-					if err != nil {
-						log.Printf("[WARN] %v", err)
+					if d.Failed() {
 						break
 					}
-					log.Printf("[DEBUG] sending %s to %s (%s)", req.Data, d.Name, addr)
-					if _, err := p.transport.Connection.WriteToUDP(data, addr); err != nil {
-						log.Printf("[WARN] %v", err)
-						break
+					getProp := p.config.Models.GetProp(d.Model())
+					for _, i := range d.MissingBatches(len(getProp)) {
+						if d.Waiting(miio.PropRequest, i) {
+							anyPacketSent = true
+							continue
+						}
+						req, data, err := d.BatchRequest([]byte(getProp[i]), i, p.config.RequestTimeout)
+						if err != nil {
+							log.Printf("[WARN] %v", err)
+							break
+						}
+						log.Printf("[DEBUG] sending %s to %s (%s)", req.Data, d.Name, addr)
+						if err := p.transport.Send(data, addr); err != nil {
+							log.Printf("[WARN] %v", err)
+							break
+						}
+						anyPacketSent = true
 					}
-					anyPacketSent = true
 				}
 			}
 			if !anyPacketSent { // all devices were updated
 				log.Print("[DEBUG] no devices to send requests left")
 				return
 			}
-			next = time.Duration(p.config.PollTimeout / 5)
+			next = p.nextRound(time.Now())
 		case <-ctx.Done():
 			log.Print("[DEBUG] stop sending requests")
 			return
@@ -156,17 +442,61 @@ func (p *Poller) sendPackets(ctx context.Context) {
 	}
 }
 
+// sendHello broadcasts the hello packet to the local networks and the extra broadcast targets
+func (p *Poller) sendHello(helloPacket []byte) bool {
+	sent := false
+	for _, addr := range append(p.transport.Broadcast(), p.broadcast...) {
+		log.Printf("[DEBUG] sending hello packet to %v", addr)
+		if err := p.transport.Send(helloPacket, addr); err != nil {
+			log.Printf("[WARN] %v", err)
+			continue
+		}
+		sent = true
+	}
+	return sent
+}
+
+// sendDeviceHello sends the hello packet to the device address
+func (p *Poller) sendDeviceHello(d *miio.Device, helloPacket []byte) bool {
+	addr := p.deviceAddr(d)
+	if addr == nil {
+		return false
+	}
+	log.Printf("[DEBUG] sending hello packet to %s (%s)", d.Name, addr)
+	if err := p.transport.Send(helloPacket, addr); err != nil {
+		log.Printf("[WARN] %v", err)
+		return false
+	}
+	return true
+}
+
+// deviceAddr returns the UDP address of the device, its port overrides MiioPort
+func (p *Poller) deviceAddr(d *miio.Device) *net.UDPAddr {
+	port := p.config.MiioPort
+	if d.Port > 0 {
+		port = d.Port
+	}
+	addr := ParseUDPAddr(d.Address, port)
+	if addr == nil {
+		log.Printf("[WARN] invalid %s address: %s", d.Name, d.Address)
+	}
+	return addr
+}
+
 func (p *Poller) processHelloReply(pkt *UDPPacket) bool {
 	did, iaddr, saddr, err := getDeviceIDAndAddress(pkt)
 	if err != nil {
 		log.Printf("[WARN] invalid packet received from %s: %x (%v)", saddr, pkt.Data, err)
 		return false
 	}
-	reply, err := miio.Decode(pkt.Data, nil)
+	reply, token, err := miio.DecodeHello(pkt.Data)
 	if err != nil {
 		log.Printf("[WARN] invalid packet received from %s: %x (%v)", saddr, pkt.Data, err)
 		return false
 	}
+	if token != nil {
+		p.reportToken(did, saddr, token)
+	}
 	updateDID := false
 	d, ok := p.devices[did]
 	if !ok {
@@ -177,7 +507,7 @@ func (p *Poller) processHelloReply(pkt *UDPPacket) bool {
 		log.Printf("[DEBUG] hello reply from unknown device %08x (%s)", did, saddr)
 		return false
 	}
-	if miio.DeviceFound(d) {
+	if miio.DeviceFound(d) && d.TimeShiftKnown() {
 		log.Printf("[DEBUG] hello reply from already discovered %s", d.Name)
 		return false
 	}
@@ -190,6 +520,12 @@ func (p *Poller) processHelloReply(pkt *UDPPacket) bool {
 	} else {
 		d.Address = saddr
 	}
+	p.setReachable(d) // it may reply to the hello sent for other devices while skipped
+	if miio.DeviceFound(d) {
+		d.SetStage(miio.Valid) // restored from the saved state, its model is known already
+		log.Printf("[INFO] rediscovered %s: %08x (%s)", d.Name, d.ID, d.Address)
+		return true
+	}
 	d.SetStage(miio.Found)
 	log.Printf("[INFO] discovered %s: %08x (%s)", d.Name, d.ID, d.Address)
 	return true
@@ -206,20 +542,53 @@ func (p *Poller) processReply(pkt *UDPPacket) bool {
 		log.Printf("[DEBUG] reply from unknown device %08x (%s)", did, saddr)
 		return false
 	}
-	if d.InFinalStage() {
-		log.Printf("[DEBUG] reply from already updated %s", d.Name)
-		return false
-	}
-	reply, err := miio.Decode(pkt.Data, d.Token())
+	reply, err := d.Decode(pkt.Data)
 	if err != nil {
 		log.Printf("[WARN] unable to decode packet from %s: %x (%v)", d.Name, pkt.Data, err)
 		return false
 	}
+	parsed := miio.ParseReply(reply.Data)
+	req, match := d.MatchReply(parsed.ID, time.Now())
+	switch {
+	case match == miio.DuplicateReply:
+		log.Printf("[DEBUG] duplicate reply from %s: %s", d.Name, reply.Data)
+		return false
+	case match == miio.StaleReply && (req == nil || req.Kind != miio.CommandRequest):
+		log.Printf("[DEBUG] stale reply from %s: %s", d.Name, reply.Data)
+		return false
+	case match == miio.StaleReply: // the command was not reported as expired yet, so the late reply still answers it
+		log.Printf("[DEBUG] late %s reply from %s", req.Kind, d.Name)
+	default:
+		log.Printf("[DEBUG] %s reply from %s in %v", req.Kind, d.Name, d.Latency())
+	}
+	if req.Kind == miio.CommandRequest {
+		log.Printf("[INFO] %s command reply: %s", d.Name, h.StripJSONQuotes(string(reply.Data)))
+		if req.Command.RPC {
+			p.Respond(d, req.Command.Response(reply.Data))
+		}
+		return false
+	}
+	if d.InFinalStage() {
+		log.Printf("[DEBUG] reply from already updated %s", d.Name)
+		return false
+	}
 	log.Printf("[DEBUG] reply from %s (stage=%s): %s", d.Name, d.Stage(), reply.Data)
 
-	parsed := miio.ParseReply(reply.Data)
-	switch parsed.Type {
-	case miio.MiioInfo:
+	if parsed.Type == miio.Error {
+		if d.ResetRestored() { // the device may have been rebooted since its state was saved
+			log.Printf("[INFO] %s replied with error to %s, finding it again", d.Name, req.Data)
+			return false
+		}
+		log.Printf("[WARN] %s replied with error to %s: %v", d.Name, req.Data, parsed.Err)
+		p.setError(d, parsed.Err) // the request is not retried until the next poll
+		return false
+	}
+	d.ConfirmRestored()
+	switch req.Kind {
+	case miio.InfoRequest:
+		if parsed.Type != miio.MiioInfo {
+			break
+		}
 		if d.InStage(miio.Valid) {
 			log.Printf("[DEBUG] reply from already identified %s: %s", d.Name, reply.Data)
 			return false
@@ -227,13 +596,23 @@ func (p *Poller) processReply(pkt *UDPPacket) bool {
 		d.SetModel(parsed.Model)
 		d.SetStage(miio.Valid)
 		log.Printf("[INFO] identified %s model: %s", d.Name, d.Model())
+		p.queueIdentified(d)
 		return d.InFinalStage()
-	case miio.GetProp:
-		if d.InFinalStage() {
-			log.Printf("[DEBUG] reply from already updated %s: %s", d.Name, reply.Data)
+	case miio.PropRequest:
+		if parsed.Type != miio.GetProp && parsed.Type != miio.GetProperties {
+			break
+		}
+		merged, complete := d.AddBatch(req.Batch, parsed)
+		if !complete {
+			log.Printf("[DEBUG] partial reply from %s, waiting for other batches", d.Name)
 			return false
 		}
-		newProps, err := p.buildDeviceProperties(d, parsed.Props)
+		var newProps string
+		if merged.Type == miio.GetProperties {
+			newProps, err = p.buildMIoTProperties(d, merged.Results)
+		} else {
+			newProps, err = p.buildDeviceProperties(d, merged.Props)
+		}
 		if err != nil {
 			log.Printf("[WARN] %v", err)
 			return false
@@ -255,14 +634,15 @@ func (p *Poller) processReply(pkt *UDPPacket) bool {
 		d.SetTimeShift(pkt.TimeStamp, reply.TimeStamp)
 		d.SetUpdatedNow()
 		d.SetStage(miio.Updated)
+		p.setAvailable(d, true)
+		p.setError(d, nil)
 		if d.StateChangeUnpublished() {
 			p.updates <- d
 			p.config.UpdateChanStat(0, len(p.updates))
 		}
 		return true
-	default:
-		log.Printf("[WARN] unable to parse device reply: %v", reply)
 	}
+	log.Printf("[WARN] unexpected %s reply from %s: %v", req.Kind, d.Name, reply)
 	return false
 }
 
@@ -282,6 +662,26 @@ func (p *Poller) buildDeviceProperties(d *miio.Device, props []interface{}) (str
 	return string(result), nil
 }
 
+// buildMIoTProperties maps MIoT property values to the param names sent as did, failed properties are skipped
+func (p *Poller) buildMIoTProperties(d *miio.Device, results []miio.MIoTResult) (string, error) {
+	data := map[string]interface{}{}
+	for _, r := range results {
+		if r.Code != 0 {
+			log.Printf("[WARN] unable to get %s property %s (siid=%d, piid=%d): code %d", d.Name, r.DID, r.Siid, r.Piid, r.Code)
+			continue
+		}
+		data[r.DID] = p.fixProperty(r.Value)
+	}
+	if len(data) == 0 {
+		return "", fmt.Errorf("no valid properties for %s (%s)", d.Name, d.Model())
+	}
+	result, err := json.Marshal(data)
+	if err != nil {
+		return "", fmt.Errorf("unable to encode properties: %#v", data)
+	}
+	return string(result), nil
+}
+
 func (p *Poller) fixProperty(value interface{}) interface{} {
 	if fixed, ok := p.config.Properties[value]; ok {
 		return fixed
@@ -289,6 +689,23 @@ func (p *Poller) fixProperty(value interface{}) interface{} {
 	return value
 }
 
+// deviceBusy checks if the device polled during the current poll is not updated yet or waits for RPC replies
+func (p *Poller) deviceBusy(d *miio.Device) bool {
+	_, polled := p.polled[d]
+	return polled && !d.InFinalStage() && !d.Failed() || d.PendingRPC()
+}
+
+// deviceFailed checks if the device polled during the current poll replied with an error, it is not retried until the next poll
+func (p *Poller) deviceFailed(d *miio.Device) bool {
+	_, polled := p.polled[d]
+	return polled && d.Failed()
+}
+
+// deviceUnreachable checks if the device was not updated by the current poll, quarantined devices are expected to fail
+func (p *Poller) deviceUnreachable(d *miio.Device) bool {
+	return p.deviceBusy(d) && !d.Quarantined()
+}
+
 func getDeviceIDAndAddress(pkt *UDPPacket) (did uint32, iaddr uint32, saddr string, err error) {
 	saddr = pkt.Address.IP.String()
 	did, err = miio.GetDeviceID(pkt.Data)
@@ -0,0 +1,259 @@
+package net
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eip/miio2mqtt/config"
+	h "github.com/eip/miio2mqtt/helpers"
+	"github.com/eip/miio2mqtt/miio"
+	"github.com/eip/miio2mqtt/miio/sim"
+)
+
+const simToken = "00112233445566778899aabbccddeeff"
+
+const simModel = "yeelink.light.lamp2"
+
+// simTest is the poller of the devices served by the simulator on the loopback
+type simTest struct {
+	config    *config.Config
+	sim       *sim.Simulator
+	transport *UDPTransport
+	devices   miio.Devices
+	poller    *Poller
+}
+
+// newSimTest starts the simulator of the devices, they are configured for the poller by their IDs,
+// hello packets are sent to the simulator instead of the broadcast
+func newSimTest(t *testing.T, ctx context.Context, wg *sync.WaitGroup, devices map[string]sim.DeviceCfg) *simTest {
+	t.Helper()
+	for name, d := range devices {
+		if len(d.Token) == 0 {
+			d.Token = simToken
+		}
+		if len(d.Model) == 0 {
+			d.Model = simModel
+		}
+		d.Uptime += time.Hour
+		devices[name] = d
+	}
+	s, err := sim.New(&sim.Config{Address: "127.0.0.1:0", Devices: devices})
+	h.AssertError(t, err, nil)
+	h.AssertError(t, s.Start(ctx, wg), nil)
+
+	cfg := config.New()
+	cfg.PollTimeout = time.Second
+	cfg.RequestTimeout = 100 * time.Millisecond
+	cfg.MiioPort = s.LocalAddr().Port
+	cfg.Interfaces = []config.InterfaceOptions{{BindIP: "127.0.0.1", Broadcast: "127.0.0.1"}}
+	cfg.Models[simModel] = miio.Model{Params: []string{"power", "bright"}}
+	result := &simTest{config: cfg, sim: s, devices: miio.Devices{}}
+	for name, d := range devices {
+		cfg.Devices[name] = miio.DeviceCfg{ID: d.ID, Token: d.Token}
+		result.devices[d.ID] = miio.NewDevice(cfg.Devices[name], name)
+	}
+	result.transport = NewTransport(cfg)
+	result.poller = NewPoller(cfg, result.transport, result.devices)
+	return result
+}
+
+// poll runs one poll of the devices picked by the check
+func (st *simTest) poll(t *testing.T, ctx context.Context, wg *sync.WaitGroup, poll miio.CheckDevice) error {
+	t.Helper()
+	h.AssertError(t, st.transport.Start(ctx, wg), nil)
+	defer st.transport.Stop()
+	return st.poller.PollDevices(ctx, poll)
+}
+
+func TestPoller_poll(t *testing.T) {
+	props := map[string]interface{}{"power": "on", "bright": 50}
+	tests := []struct {
+		name           string
+		device         sim.DeviceCfg
+		batchSize      int
+		state          *miio.DeviceState // restored before the poll
+		discoverTokens bool              // keep polling until the timeout
+		err            error
+		stage          miio.DeviceStage
+		properties     string
+		requests       []string
+		received       uint64
+		published      bool
+		errors         int
+	}{
+		{
+			name:       "Discovery",
+			device:     sim.DeviceCfg{Props: props},
+			stage:      miio.Updated,
+			properties: `{"bright":50,"power":1}`,
+			requests:   []string{`miIO.info []`, `get_prop ["power","bright"]`},
+			received:   3,
+			published:  true,
+		},
+		{
+			name:       "Unanswered requests are retried after the request timeout",
+			device:     sim.DeviceCfg{Props: props, Drop: map[string]int{"miIO.info": 2}},
+			stage:      miio.Updated,
+			properties: `{"bright":50,"power":1}`,
+			requests:   []string{`miIO.info []`, `miIO.info []`, `miIO.info []`, `get_prop ["power","bright"]`},
+			received:   3,
+			published:  true,
+		},
+		{
+			name:       "Only the lost batch is requested again",
+			device:     sim.DeviceCfg{Props: props, Drop: map[string]int{"get_prop": 1}},
+			batchSize:  1,
+			stage:      miio.Updated,
+			properties: `{"bright":50,"power":1}`,
+			requests:   []string{`miIO.info []`, `get_prop ["power"]`, `get_prop ["bright"]`, `get_prop ["power"]`},
+			received:   4,
+			published:  true,
+		},
+		{
+			name:           "Error reply is not retried",
+			device:         sim.DeviceCfg{Errors: map[string]miio.DeviceError{"get_prop": {Code: -5001, Message: "busy"}}},
+			discoverTokens: true,
+			err:            errors.New("1 devices replied with error"),
+			stage:          miio.Valid,
+			requests:       []string{`miIO.info []`, `get_prop ["power","bright"]`},
+			errors:         1,
+		},
+		{
+			name:       "Restored device is polled without hello",
+			device:     sim.DeviceCfg{Props: props},
+			state:      &miio.DeviceState{ID: 0x01234567, Address: "127.0.0.1", Model: simModel, TimeShift: miio.Now() - 10, Properties: `{"bright":50,"power":1}`},
+			stage:      miio.Updated,
+			properties: `{"bright":50,"power":1}`,
+			requests:   []string{`get_prop ["power","bright"]`},
+			received:   1,
+		},
+		{
+			name:       "Restored device is found again after the timeout",
+			device:     sim.DeviceCfg{Props: props, Drop: map[string]int{"get_prop": 1}},
+			state:      &miio.DeviceState{ID: 0x01234567, Address: "127.0.0.1", Model: simModel, TimeShift: miio.Now() - 10, Properties: `{"bright":50,"power":1}`},
+			stage:      miio.Updated,
+			properties: `{"bright":50,"power":1}`,
+			requests:   []string{`get_prop ["power","bright"]`, `get_prop ["power","bright"]`}, // the model is not identified again
+			received:   2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			wg := sync.WaitGroup{}
+			defer wg.Wait()
+			defer cancel()
+			tt.device.ID = 0x01234567
+			st := newSimTest(t, ctx, &wg, map[string]sim.DeviceCfg{"Lamp": tt.device})
+			st.config.Models[simModel] = miio.Model{Params: []string{"power", "bright"}, BatchSize: tt.batchSize}
+			st.config.DiscoverTokens = tt.discoverTokens
+			if tt.discoverTokens {
+				st.config.PollTimeout = 500 * time.Millisecond
+			}
+			lamp := st.devices[0x01234567]
+			if tt.state != nil {
+				h.AssertEqual(t, lamp.RestoreState(*tt.state), true)
+			}
+
+			start := time.Now()
+			h.AssertError(t, st.poll(t, ctx, &wg, miio.AnyDevice), tt.err)
+			h.AssertEqual(t, time.Since(start) < st.config.PollTimeout, !tt.discoverTokens) // finished as soon as all replies are received
+			h.AssertEqual(t, lamp.Stage(), tt.stage)
+			h.AssertEqual(t, lamp.Properties(), tt.properties)
+			h.AssertEqual(t, st.sim.Device(0x01234567).Requests(), tt.requests)
+			if !tt.discoverTokens { // hello replies are received on every broadcast
+				h.AssertEqual(t, st.transport.Stats().Received, tt.received)
+			}
+			h.AssertEqual(t, len(st.poller.Errors()), tt.errors)
+			if tt.published {
+				h.AssertEqual(t, (<-st.poller.Updates()).Name, "Lamp") // published once, when all batches are received
+			}
+			h.AssertEqual(t, len(st.poller.Updates()), 0)
+		})
+	}
+}
+
+func TestPoller_quarantine(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := sync.WaitGroup{}
+	defer wg.Wait()
+	defer cancel()
+	st := newSimTest(t, ctx, &wg, map[string]sim.DeviceCfg{
+		"Lamp": {ID: 0x01234567, Loss: 1},
+	})
+	st.config.PollTimeout = 200 * time.Millisecond
+	st.config.QuarantineAfter, st.config.ProbeEvery = 1, 10
+	lamp := st.devices[0x01234567]
+
+	h.AssertError(t, st.poll(t, ctx, &wg, miio.AnyDevice), context.DeadlineExceeded)
+	h.AssertEqual(t, lamp.Quarantined(), true)
+	h.AssertEqual(t, lamp.Resting(), true)
+
+	cmd, err := miio.NewRPCCommand([]byte(`{"method":"get_prop","params":["power"],"id":"abc"}`))
+	h.AssertError(t, err, nil)
+	lamp.PushCommand(cmd)
+	lamp.PushCommand(miio.NewCommand(`{"method":"set_power","params":["on"],"id":#}`))
+	h.AssertError(t, st.poll(t, ctx, &wg, miio.DeviceHasCommands), nil) // the wake-up does not probe the resting device
+	h.AssertEqual(t, lamp.HasCommands(), false)
+	h.AssertEqual(t, lamp.Failures(), 1)
+	resp := <-st.poller.Responses()
+	h.AssertEqual(t, string(resp.Data), `{"error":{"message":"device is unreachable"},"id":"abc"}`)
+}
+
+func TestPoller_replay(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := sync.WaitGroup{}
+	defer wg.Wait()
+	defer cancel()
+	st := newSimTest(t, ctx, &wg, map[string]sim.DeviceCfg{
+		"Lamp":      {ID: 0x01234567, Props: map[string]interface{}{"power": "on", "bright": 50}, Drop: map[string]int{"miIO.info": 1}},
+		"Desk Lamp": {ID: 0x01234568, Props: map[string]interface{}{"power": "off", "bright": 10}},
+	})
+	st.config.Capture = filepath.Join(t.TempDir(), "capture.jsonl")
+	h.AssertError(t, st.poll(t, ctx, &wg, miio.AnyDevice), nil)
+
+	cfg := config.New()
+	cfg.PollTimeout = st.config.PollTimeout
+	cfg.RequestTimeout = 50 * time.Millisecond // the replay does not depend on the original timing
+	cfg.MiioPort = st.config.MiioPort
+	cfg.Models, cfg.Devices = st.config.Models, st.config.Devices
+	devices := miio.Devices{}
+	for name, dc := range cfg.Devices {
+		devices[dc.ID] = miio.NewDevice(dc, name)
+	}
+	transport, err := NewReplayTransport(cfg, st.config.Capture)
+	h.AssertError(t, err, nil)
+	h.AssertError(t, transport.Start(ctx, &wg), nil)
+	poller := NewPoller(cfg, transport, devices)
+	h.AssertError(t, poller.PollDevices(ctx, miio.AnyDevice), nil)
+	for id, d := range st.devices {
+		h.AssertEqual(t, devices[id].Stage(), miio.Updated)
+		h.AssertEqual(t, devices[id].Model(), simModel)
+		h.AssertEqual(t, devices[id].Properties(), d.Properties())
+	}
+	h.AssertEqual(t, len(poller.Updates()), 2)
+}
+
+func TestPoller_lateCommandReply(t *testing.T) {
+	cfg := config.New()
+	token, _ := hex.DecodeString(simToken)
+	d := miio.NewDevice(miio.DeviceCfg{ID: 0x01234567, Token: simToken}, "Lamp")
+	h.AssertError(t, d.SetTimeShift(miio.Now(), miio.Now()-100), nil)
+	poller := NewPoller(cfg, nil, miio.Devices{d.ID: d})
+	cmd, err := miio.NewRPCCommand([]byte(`{"method":"set_power","params":["on"],"id":"abc"}`))
+	h.AssertError(t, err, nil)
+	_, _, err = d.CommandRequest(cmd, 0) // the reply comes after the deadline but before the request is expired
+	h.AssertError(t, err, nil)
+	data, err := miio.NewPacket(d.ID, miio.Now(), []byte(`{"result":["ok"],"id":1}`)).Encode(token)
+	h.AssertError(t, err, nil)
+
+	poller.processReply(&UDPPacket{Address: net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 54321}, Data: data})
+	h.AssertEqual(t, string((<-poller.Responses()).Data), `{"id":"abc","result":["ok"]}`)
+	h.AssertEqual(t, len(d.ExpireRequests(time.Now())), 0) // not reported as timed out again
+}
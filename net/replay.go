@@ -0,0 +1,154 @@
+package net
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+
+	"github.com/eip/miio2mqtt/config"
+	"github.com/eip/miio2mqtt/miio"
+	log "github.com/go-pkgz/lgr"
+)
+
+// helloID is the device ID field of the hello packet, replies to the broadcast are replayed by it
+const helloID = 0xffffffff
+
+// ReplayTransport feeds received datagrams of the capture file to the Poller instead of the network,
+// the replies to the n-th captured request to the device are delivered as soon as the Poller sends
+// its own n-th request to the device, hello replies follow hello packets the same way;
+// so neither the original delays nor the interleaving of devices have to be reproduced
+type ReplayTransport struct {
+	received         uint64 // datagrams replayed, updated atomically, kept first for 64-bit alignment
+	BroadcastAddress *net.UDPAddr
+	config           *config.Config
+	sync.Mutex
+	replies    map[uint32][][]*UDPPacket // replies to the captured requests by device ID, in order of sending
+	pending    []*UDPPacket              // replies to the sent datagrams not delivered yet
+	total      int
+	packets    chan *UDPPacket
+	sentSignal chan struct{} // wakes the replay up when a datagram is sent
+	started    bool
+}
+
+// NewReplayTransport reads the capture file to be replayed
+func NewReplayTransport(config *config.Config, path string) (*ReplayTransport, error) {
+	records, err := ReadCapture(path)
+	if err != nil {
+		return nil, err
+	}
+	t := &ReplayTransport{
+		BroadcastAddress: &net.UDPAddr{IP: net.IPv4bcast, Port: config.MiioPort},
+		config:           config,
+		replies:          map[uint32][][]*UDPPacket{},
+		packets:          make(chan *UDPPacket, 1+2*len(config.Devices)),
+		sentSignal:       make(chan struct{}, 1),
+	}
+	unsolicited := 0
+	for i := range records {
+		data, addr, err := records[i].Datagram()
+		if err != nil {
+			return nil, fmt.Errorf("invalid captured packet %d: %v", i+1, err)
+		}
+		did, err := miio.GetDeviceID(data)
+		if err != nil {
+			log.Printf("[DEBUG] skipping captured packet %d: %v", i+1, err)
+			continue
+		}
+		if records[i].Direction == CaptureOut {
+			t.replies[did] = append(t.replies[did], nil)
+			continue
+		}
+		if len(data) == 32 { // hello reply
+			did = helloID
+		}
+		requests := t.replies[did]
+		if len(requests) == 0 {
+			unsolicited++
+			continue
+		}
+		requests[len(requests)-1] = append(requests[len(requests)-1], &UDPPacket{Address: *addr, Data: data})
+		t.total++
+	}
+	if unsolicited > 0 {
+		log.Printf("[INFO] %d captured packets do not reply to any captured request, skipped", unsolicited)
+	}
+	return t, nil
+}
+
+// Start starts the replay on the first call, it runs until the context is done
+func (t *ReplayTransport) Start(ctx context.Context, wg *sync.WaitGroup) error {
+	if t.started {
+		return nil
+	}
+	t.started = true
+	log.Printf("[INFO] replaying %d captured packets", t.total)
+	wg.Add(1)
+	go func() { defer wg.Done(); t.replay(ctx) }()
+	return nil
+}
+
+// Stop does nothing, the replay goes on across polls
+func (t *ReplayTransport) Stop() {}
+
+func (t *ReplayTransport) Packets() <-chan *UDPPacket {
+	return t.packets
+}
+
+// Send queues the captured replies to the next request of the same device, the datagram is not delivered anywhere
+func (t *ReplayTransport) Send(data []byte, addr *net.UDPAddr) error {
+	did, err := miio.GetDeviceID(data)
+	if err != nil {
+		return err
+	}
+	t.Lock()
+	requests := t.replies[did]
+	if len(requests) == 0 {
+		t.Unlock()
+		log.Printf("[DEBUG] no captured replies to the request to %v left", addr)
+		return nil
+	}
+	t.pending = append(t.pending, requests[0]...)
+	t.replies[did] = requests[1:]
+	t.Unlock()
+	select {
+	case t.sentSignal <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Broadcast returns the address hello packets are broadcast to
+func (t *ReplayTransport) Broadcast() []*net.UDPAddr {
+	return []*net.UDPAddr{t.BroadcastAddress}
+}
+
+// Stats returns the number of replayed packets
+func (t *ReplayTransport) Stats() TransportStats {
+	return TransportStats{Received: atomic.LoadUint64(&t.received)}
+}
+
+func (t *ReplayTransport) replay(ctx context.Context) {
+	for {
+		select {
+		case <-t.sentSignal:
+		case <-ctx.Done():
+			return
+		}
+		t.Lock()
+		pending := t.pending
+		t.pending = nil
+		t.Unlock()
+		for _, r := range pending {
+			pkt := &UDPPacket{Address: r.Address, Data: r.Data, TimeStamp: miio.Now()}
+			select {
+			case t.packets <- pkt:
+				atomic.AddUint64(&t.received, 1)
+				log.Printf("[DEBUG] %d bytes replayed from %v", len(pkt.Data), &pkt.Address)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"context"
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/eip/miio2mqtt/config"
 	"github.com/eip/miio2mqtt/miio"
@@ -13,31 +15,68 @@ import (
 const udpNetwork = "udp4"
 const errNetClosingString = "use of closed network connection" // defined in internal/poll package
 
+// Transport sends and receives miIO datagrams for the Poller
+type Transport interface {
+	Start(ctx context.Context, wg *sync.WaitGroup) error
+	Stop()
+	Packets() <-chan *UDPPacket
+	Send(data []byte, addr *net.UDPAddr) error
+	Broadcast() []*net.UDPAddr
+	Stats() TransportStats
+}
+
 type UDPTransport struct {
+	stats            TransportStats // updated atomically, kept first for 64-bit alignment
+	Interface        config.InterfaceOptions
 	LocalAddress     *net.UDPAddr
 	BroadcastAddress *net.UDPAddr
+	Network          *net.IPNet // local network of the interface, nil if unknown
 	Connection       *net.UDPConn
 	config           *config.Config
 	packets          chan *UDPPacket
 	cancel           context.CancelFunc
+	capture          *Capture // opened on the first start and kept open across polls
 }
 
+// UDPPacket is the received datagram, its data is owned by the packet until Release is called
 type UDPPacket struct {
 	Address   net.UDPAddr
 	Data      []byte
 	TimeStamp miio.TimeStamp
+	buffer    *packetBuffer
 }
 
+// NewTransport creates the transport of the first configured interface, or of the default one
 func NewTransport(config *config.Config) *UDPTransport {
-	return &UDPTransport{config: config}
+	t := &UDPTransport{config: config}
+	if len(config.Interfaces) > 0 {
+		t.Interface = config.Interfaces[0]
+	}
+	return t
+}
+
+// NewInterfaceTransport creates the transport listening on the interface
+func NewInterfaceTransport(config *config.Config, iface config.InterfaceOptions) *UDPTransport {
+	return &UDPTransport{config: config, Interface: iface}
 }
 
 func (t *UDPTransport) Start(ctx context.Context, wg *sync.WaitGroup) error {
 	var err error
-	t.LocalAddress, t.BroadcastAddress, err = GetUDPAddresses(t.config.MiioPort)
+	t.LocalAddress, t.BroadcastAddress, t.Network, err = ResolveInterface(t.Interface, t.config.MiioPort)
 	if err != nil {
 		return err
 	}
+	if t.capture == nil && len(t.config.Capture) > 0 {
+		if t.capture, err = OpenCapture(t.config.Capture); err != nil {
+			return err
+		}
+		log.Printf("[INFO] capturing miIO traffic to %s", t.config.Capture)
+	}
+	return t.listen(ctx, wg)
+}
+
+func (t *UDPTransport) listen(ctx context.Context, wg *sync.WaitGroup) error {
+	var err error
 	t.Connection, err = net.ListenUDP(udpNetwork, t.LocalAddress)
 	if err != nil {
 		return err
@@ -45,9 +84,11 @@ func (t *UDPTransport) Start(ctx context.Context, wg *sync.WaitGroup) error {
 	t.packets = make(chan *UDPPacket, 1+2*len(t.config.Devices)) // TODO check chan max length
 	ctx, cancel := context.WithCancel(ctx)
 	t.cancel = cancel
-	// defer listener.cancel()
 	wg.Add(1)
-	go func() { defer wg.Done(); t.listenUDPPackets(ctx) }()
+	go func(conn *net.UDPConn, packets chan *UDPPacket) {
+		defer wg.Done()
+		t.listenUDPPackets(ctx, conn, packets)
+	}(t.Connection, t.packets)
 	return nil
 }
 
@@ -64,12 +105,42 @@ func (t *UDPTransport) Packets() <-chan *UDPPacket {
 	return t.packets
 }
 
+// Send writes the datagram to the address, it is captured first so that the reply is never captured before it
+func (t *UDPTransport) Send(data []byte, addr *net.UDPAddr) error {
+	t.record(CaptureOut, addr, data)
+	_, err := t.Connection.WriteToUDP(data, addr)
+	return err
+}
+
+// Broadcast returns the address hello packets are broadcast to
+func (t *UDPTransport) Broadcast() []*net.UDPAddr {
+	return []*net.UDPAddr{t.BroadcastAddress}
+}
+
+func (t *UDPTransport) record(direction string, addr *net.UDPAddr, data []byte) {
+	if t.capture == nil {
+		return
+	}
+	if err := t.capture.Record(time.Now(), direction, addr, data); err != nil {
+		log.Printf("[WARN] unable to capture the packet: %v", err)
+	}
+}
+
+// Stats returns the received packet counters
+func (t *UDPTransport) Stats() TransportStats {
+	return TransportStats{
+		Received:  atomic.LoadUint64(&t.stats.Received),
+		Truncated: atomic.LoadUint64(&t.stats.Truncated),
+	}
+}
+
 func (t *UDPTransport) purgePackets() {
 	count := 0
 loop:
 	for {
 		select {
-		case <-t.packets:
+		case pkt := <-t.packets:
+			pkt.Release()
 			count++
 		default:
 			break loop
@@ -80,12 +151,11 @@ loop:
 	}
 }
 
-func (t *UDPTransport) listenUDPPackets(ctx context.Context) {
-	log.Printf("[DEBUG] listening %v for UDP packets...", t.Connection.LocalAddr())
-	// defer close(udpPackets)
-	buffer := make([]byte, 1024)
+func (t *UDPTransport) listenUDPPackets(ctx context.Context, conn *net.UDPConn, packets chan<- *UDPPacket) {
+	log.Printf("[DEBUG] listening %v for UDP packets...", conn.LocalAddr())
+	buffer := make([]byte, maxDatagramSize) // shared by the reads, the datagram is copied to the packet buffer
 	for {
-		n, addr, err := t.Connection.ReadFromUDP(buffer)
+		n, addr, err := conn.ReadFromUDP(buffer)
 		if err != nil {
 			if nerr, ok := err.(*net.OpError); ok && nerr.Err.Error() == errNetClosingString {
 				log.Print("[DEBUG] stop listening for UDP packets")
@@ -99,14 +169,22 @@ func (t *UDPTransport) listenUDPPackets(ctx context.Context) {
 			continue
 		}
 		pktTime := miio.Now()
+		atomic.AddUint64(&t.stats.Received, 1)
+		t.record(CaptureIn, addr, buffer[:n])
+		if declaredLength(buffer[:n], &t.stats.Truncated) > n {
+			log.Printf("[WARN] truncated packet received from %v: %d bytes", addr, n)
+			continue
+		}
+		pb := newPacketBuffer(buffer[:n])
+		pkt := &UDPPacket{Address: *addr, Data: pb.data, TimeStamp: pktTime, buffer: pb}
 		select {
 		case <-ctx.Done():
 			log.Print("[DEBUG] stop listening for UDP packets")
-			t.Stop()
+			pkt.Release()
 			return
-		case t.packets <- &UDPPacket{Address: *addr, Data: buffer[:n], TimeStamp: pktTime}:
+		case packets <- pkt:
 			log.Printf("[DEBUG] %d bytes received from %v", n, addr)
-			t.config.UpdateChanStat(len(t.packets), 0)
+			t.config.UpdateChanStat(len(packets), 0)
 		}
 	}
 }
@@ -0,0 +1,192 @@
+package net
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eip/miio2mqtt/config"
+	h "github.com/eip/miio2mqtt/helpers"
+)
+
+// testDatagram builds the datagram with the miIO length field and the sender and sequence numbers in the payload
+func testDatagram(sender, seq, size int) []byte {
+	data := make([]byte, size)
+	binary.BigEndian.PutUint16(data[0:], 0x2131)
+	binary.BigEndian.PutUint16(data[2:], uint16(size))
+	binary.BigEndian.PutUint32(data[4:], uint32(sender))
+	binary.BigEndian.PutUint32(data[8:], uint32(seq))
+	for i := 12; i < size; i++ {
+		data[i] = byte(sender + seq + i)
+	}
+	return data
+}
+
+func startTestTransport(t *testing.T, ctx context.Context, wg *sync.WaitGroup) *UDPTransport {
+	cfg := config.New()
+	transport := NewTransport(cfg)
+	transport.LocalAddress = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	h.AssertError(t, transport.listen(ctx, wg), nil)
+	return transport
+}
+
+func TestUDPTransport_receive(t *testing.T) {
+	const senders, count = 4, 50
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := sync.WaitGroup{}
+	transport := startTestTransport(t, ctx, &wg)
+	defer wg.Wait()
+	defer transport.Stop()
+	defer cancel()
+	addr := transport.Connection.LocalAddr().(*net.UDPAddr)
+
+	sendWG := sync.WaitGroup{}
+	for s := 0; s < senders; s++ {
+		sendWG.Add(1)
+		go func(sender int) {
+			defer sendWG.Done()
+			conn, err := net.DialUDP(udpNetwork, nil, addr)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer conn.Close()
+			for seq := 0; seq < count; seq++ {
+				if _, err := conn.Write(testDatagram(sender, seq, 32+(sender*count+seq)*20)); err != nil {
+					t.Error(err)
+				}
+				time.Sleep(time.Millisecond)
+			}
+		}(s)
+	}
+
+	held := []*UDPPacket{}
+	received := 0
+loop:
+	for received < senders*count {
+		select {
+		case pkt := <-transport.Packets():
+			received++
+			held = append(held, pkt) // keep some packets to check their buffers are not reused
+			if len(held) > 10 {
+				held[0].Release()
+				held = held[1:]
+			}
+			time.Sleep(100 * time.Microsecond) // slow consumer
+		case <-time.After(500 * time.Millisecond): // the rest is dropped by the system
+			break loop
+		}
+		for _, pkt := range held {
+			sender := int(binary.BigEndian.Uint32(pkt.Data[4:]))
+			seq := int(binary.BigEndian.Uint32(pkt.Data[8:]))
+			if !bytes.Equal(pkt.Data, testDatagram(sender, seq, len(pkt.Data))) {
+				t.Fatalf("packet %d/%d is corrupted", sender, seq)
+			}
+		}
+	}
+	sendWG.Wait()
+	for _, pkt := range held {
+		pkt.Release()
+	}
+	stats := transport.Stats()
+	h.AssertEqual(t, stats.Received, uint64(received))
+	h.AssertEqual(t, stats.Truncated, uint64(0))
+	if received == 0 {
+		t.Fatal("no packets received")
+	}
+}
+
+func TestUDPTransport_receiveLarge(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	wg := sync.WaitGroup{}
+	transport := startTestTransport(t, ctx, &wg)
+	defer wg.Wait()
+	defer transport.Stop()
+	defer cancel()
+	conn, err := net.DialUDP(udpNetwork, nil, transport.Connection.LocalAddr().(*net.UDPAddr))
+	h.AssertError(t, err, nil)
+	defer conn.Close()
+
+	receive := func() *UDPPacket {
+		select {
+		case pkt := <-transport.Packets():
+			return pkt
+		case <-time.After(time.Second):
+			return nil
+		}
+	}
+
+	large := testDatagram(1, 1, 60000)
+	_, err = conn.Write(large)
+	h.AssertError(t, err, nil)
+	pkt := receive()
+	if pkt == nil {
+		t.Fatal("large packet is not received")
+	}
+	h.AssertEqual(t, len(pkt.Data), len(large))
+	h.AssertEqual(t, bytes.Equal(pkt.Data, large), true)
+	pkt.Release()
+
+	short := testDatagram(2, 2, 100)
+	binary.BigEndian.PutUint16(short[2:], 200)
+	_, err = conn.Write(short)
+	h.AssertError(t, err, nil)
+	_, err = conn.Write(testDatagram(3, 3, 64))
+	h.AssertError(t, err, nil)
+	pkt = receive()
+	if pkt == nil {
+		t.Fatal("packet is not received")
+	}
+	h.AssertEqual(t, pkt.Data, testDatagram(3, 3, 64))
+	pkt.Release()
+
+	stats := transport.Stats()
+	h.AssertEqual(t, stats, TransportStats{Received: 3, Truncated: 1})
+}
+
+func Test_newPacketBuffer(t *testing.T) {
+	tests := []struct {
+		name    string
+		size    int
+		wantCap int
+	}{
+		{name: "Short", size: 32, wantCap: pooledBufferSize},
+		{name: "Pooled", size: pooledBufferSize, wantCap: pooledBufferSize},
+		{name: "Large", size: 60000, wantCap: 60000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := testDatagram(1, 1, tt.size)
+			b := newPacketBuffer(data)
+			h.AssertEqual(t, b.data, data)
+			h.AssertEqual(t, cap(b.data), tt.wantCap) // queued packets do not pin the maximum datagram size
+			data[12]++
+			h.AssertEqual(t, b.data[12] != data[12], true)
+			b.release()
+		})
+	}
+}
+
+func Test_declaredLength(t *testing.T) {
+	tests := []struct {
+		name          string
+		data          []byte
+		want          int
+		wantTruncated uint64
+	}{
+		{name: "Complete", data: testDatagram(1, 1, 32), want: 32},
+		{name: "Truncated", data: testDatagram(1, 1, 64)[:40], want: 64, wantTruncated: 1},
+		{name: "No header", data: []byte{0x21, 0x31}, want: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			truncated := uint64(0)
+			h.AssertEqual(t, declaredLength(tt.data, &truncated), tt.want)
+			h.AssertEqual(t, truncated, tt.wantTruncated)
+		})
+	}
+}
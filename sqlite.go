@@ -0,0 +1,8 @@
+//go:build sqlite
+// +build sqlite
+
+package main
+
+import (
+	_ "github.com/mattn/go-sqlite3" // Mi Home backup import
+)